@@ -0,0 +1,587 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== ADMIN API ====================
+//
+// /api/admin/* manages the tile cache and the key pool. It is disabled unless
+// settings.yaml sets admin.token (sent as "Authorization: Bearer <token>") or
+// admin.username and admin.password (HTTP basic auth). Reads are GET, changes
+// are POST, and every endpoint answers JSON:
+//
+//	GET  /api/admin/cache            cache stats (same as /api/cache)
+//	POST /api/admin/cache/clear      delete every entry
+//	POST /api/admin/cache/cleanup    drop expired entries and enforce size limits
+//	POST /api/admin/cache/purge      delete entries by path prefix or region
+//	POST /api/admin/cache/prewarm    fetch one tile into the cache (?path=, see prewarm.go)
+//	GET  /api/admin/cache/entry      inspect one entry (?url=<upstream path and query> or ?key=)
+//	DELETE /api/admin/cache/entry    delete one entry
+//	GET  /api/admin/cache/entries    list entries by path prefix (?prefix=&limit=)
+//	GET  /api/admin/keys             key pool status (IDs only, never key values)
+//	POST /api/admin/config/reload    re-read settings.yaml
+
+// AdminConfig holds admin API credentials from YAML
+type AdminConfig struct {
+	Token    string `yaml:"token"`    // Bearer token
+	Username string `yaml:"username"` // Basic auth, used with password
+	Password string `yaml:"password"`
+}
+
+// adminHandlerFunc handles one admin endpoint of a server
+type adminHandlerFunc func(s *Server, w http.ResponseWriter, r *http.Request)
+
+// adminRoute maps the methods of one admin endpoint to their handlers
+type adminRoute map[string]adminHandlerFunc
+
+// Admin endpoints by path after /api/admin/
+var adminRoutes = map[string]adminRoute{
+	"cache":         {http.MethodGet: (*Server).adminCacheStatsHandler},
+	"cache/clear":   {http.MethodPost: (*Server).adminCacheClearHandler},
+	"cache/cleanup": {http.MethodPost: (*Server).adminCacheCleanupHandler},
+	"cache/purge":   {http.MethodPost: (*Server).adminCachePurgeHandler},
+	"cache/prewarm": {http.MethodPost: (*Server).adminCachePrewarmHandler},
+	"cache/entry":   {http.MethodGet: (*Server).adminCacheEntryHandler, http.MethodDelete: (*Server).adminCacheEntryDeleteHandler},
+	"cache/entries": {http.MethodGet: (*Server).adminCacheEntriesHandler},
+	"keys":          {http.MethodGet: (*Server).adminKeysHandler},
+	"config/reload": {http.MethodPost: (*Server).adminConfigReloadHandler},
+}
+
+// adminSettings returns the current admin credentials
+func (s *Server) adminSettings() AdminConfig {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.admin
+}
+
+// adminEnabled reports whether admin credentials are configured
+func (s *Server) adminEnabled() bool {
+	cfg := s.adminSettings()
+	return cfg.Token != "" || (cfg.Username != "" && cfg.Password != "")
+}
+
+// adminAuthorized checks a request's bearer token or basic auth credentials
+func (s *Server) adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	cfg := s.adminSettings()
+
+	if cfg.Username != "" && cfg.Password != "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gde-admin"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gde-admin"`)
+	}
+
+	if cfg.Token != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secureEqual(token, cfg.Token) {
+			return true
+		}
+	}
+	if cfg.Username != "" && cfg.Password != "" {
+		if user, pass, ok := r.BasicAuth(); ok && secureEqual(user, cfg.Username) && secureEqual(pass, cfg.Password) {
+			return true
+		}
+	}
+	return false
+}
+
+// secureEqual compares secrets in constant time (hashing hides their length)
+func secureEqual(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// adminHandler authenticates and routes /api/admin/* requests
+func (s *Server) adminHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !s.adminEnabled() {
+		writeAdminError(w, http.StatusNotFound, "Admin API is disabled")
+		return
+	}
+	if !s.adminAuthorized(w, r) {
+		requestLog(r).With("ip", clientIP(r, s.proxySettings().RateLimit.TrustProxyHeaders), "method", r.Method, "path", r.URL.Path).Warn("🔐 Unauthorized admin request")
+		writeAdminError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	route, ok := adminRoutes[strings.TrimPrefix(r.URL.Path, "/api/admin/")]
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, "Unknown admin endpoint")
+		return
+	}
+	handler, ok := route[r.Method]
+	if !ok {
+		var methods []string
+		for method := range route {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeAdminError(w, http.StatusMethodNotAllowed, "Use "+strings.Join(methods, " or "))
+		return
+	}
+	handler(s, w, r)
+}
+
+// writeAdminJSON writes an admin response
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+// writeAdminError writes an admin error response
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
+
+func (s *Server) adminCacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	s.cache.writeCacheStats(w)
+}
+
+func (s *Server) adminCacheClearHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.cache.clearCache(); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "Failed to clear cache: "+err.Error())
+		return
+	}
+	logInfo("🗑️ Cache cleared via admin API")
+	writeAdminJSON(w, http.StatusOK, map[string]string{"status": "cleared"})
+}
+
+func (s *Server) adminCacheCleanupHandler(w http.ResponseWriter, r *http.Request) {
+	go s.cache.cleanupCache()
+	writeAdminJSON(w, http.StatusAccepted, map[string]string{"status": "cleanup_started"})
+}
+
+// adminPurgeRequest selects the entries to purge: a path prefix, or the map
+// tiles covering a region
+type adminPurgeRequest struct {
+	Prefix  string   `json:"prefix"`  // Upstream path prefix, e.g. "v1/maptiles/winter/"
+	Region  string   `json:"region"`  // Boundary key or file name from boundaries/index.json
+	Zoom    string   `json:"zoom"`    // Zoom level or range for a region (default: 8-14)
+	Mapsets []string `json:"mapsets"` // Mapsets for a region (default: all)
+}
+
+// adminPurgeResult reports what a purge removed
+type adminPurgeResult struct {
+	Purged      int   `json:"purged"`
+	FreedBytes  int64 `json:"freed_bytes"`
+	UnknownPath int   `json:"unknown_path"` // Entries without a recorded path, which a prefix can't match
+}
+
+func (s *Server) adminCachePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	var req adminPurgeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		return
+	}
+	if s.cache.idx == nil {
+		writeAdminError(w, http.StatusServiceUnavailable, "Cache index not loaded")
+		return
+	}
+
+	var keys []string
+	var unknown int
+	switch {
+	case req.Prefix != "" && req.Region != "":
+		writeAdminError(w, http.StatusBadRequest, "Set either prefix or region, not both")
+		return
+	case req.Prefix != "":
+		prefix := strings.TrimPrefix(req.Prefix, "/")
+		keys, unknown = s.cache.matchCachePaths(func(path string) bool {
+			return strings.HasPrefix(path, prefix)
+		})
+	case req.Region != "":
+		var err error
+		if keys, unknown, err = s.regionCacheKeys(req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		writeAdminError(w, http.StatusBadRequest, "Set prefix or region")
+		return
+	}
+
+	result := adminPurgeResult{UnknownPath: unknown}
+	for _, key := range keys {
+		size := s.cache.idx.Remove(key)
+		if size == 0 {
+			// Only computed from the region; make sure it exists
+			if _, err := s.cache.store.Stat(key); err != nil {
+				continue
+			}
+		}
+		s.cache.removeCacheEntry(key)
+		result.Purged++
+		result.FreedBytes += size
+	}
+
+	logWith("entries", result.Purged, "freed_bytes", result.FreedBytes, "prefix", req.Prefix, "region", req.Region).
+		Info("🗑️ Purged cache entries via admin API")
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+// adminPrewarmResult is the answer of POST /api/admin/cache/prewarm
+type adminPrewarmResult struct {
+	Path   string `json:"path"`
+	Cached bool   `json:"cached"` // Already cached and fresh, nothing was fetched
+}
+
+// adminCachePrewarmHandler fetches one tile (?path=<upstream path>) into the
+// cache unless a fresh copy is cached; it backs `server prewarm -server`
+func (s *Server) adminCachePrewarmHandler(w http.ResponseWriter, r *http.Request) {
+	apiPath := strings.TrimPrefix(r.URL.Query().Get("path"), "/")
+	if apiPath == "" {
+		writeAdminError(w, http.StatusBadRequest, "Set path")
+		return
+	}
+	if !s.isPathAllowed(apiPath) {
+		writeAdminError(w, http.StatusBadRequest, "Path not allowed")
+		return
+	}
+	rule := s.cache.matchCacheRule(apiPath)
+	if rule == nil {
+		writeAdminError(w, http.StatusBadRequest, "No cache rule matches the path")
+		return
+	}
+
+	cached, err := s.prewarmTile(apiPath, rule)
+	if err != nil {
+		writeAdminError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, adminPrewarmResult{Path: apiPath, Cached: cached})
+}
+
+// regionCacheKeys finds the cached map tiles covering a region: entries by
+// their recorded path, plus the keys of query-less tile URLs for entries
+// written before paths were recorded
+func (s *Server) regionCacheKeys(req adminPurgeRequest) ([]string, int, error) {
+	zoom := req.Zoom
+	if zoom == "" {
+		zoom = "8-14"
+	}
+	minZoom, maxZoom, err := parseZoomRange(zoom)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	boundaries := s.assets.boundaries()
+	entry, err := findBoundary(boundaries, req.Region)
+	if err != nil {
+		return nil, 0, err
+	}
+	rings, err := loadBoundaryRings(boundaries, entry.File)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to load boundary %s: %v", entry.File, err)
+	}
+
+	tiles := make(map[tileCoord]bool)
+	for z := minZoom; z <= maxZoom; z++ {
+		for _, t := range tilesCoveringRings(rings, z) {
+			tiles[t] = true
+		}
+	}
+	mapsets := make(map[string]bool)
+	for _, mapset := range req.Mapsets {
+		mapsets[strings.TrimSpace(mapset)] = true
+	}
+
+	// v1/maptiles/<mapset>/<size>/<z>/<x>/<y>
+	keys, unknown := s.cache.matchCachePaths(func(path string) bool {
+		parts := strings.Split(strings.TrimPrefix(path, "v1/maptiles/"), "/")
+		if len(parts) != 5 || !strings.HasPrefix(path, "v1/maptiles/") {
+			return false
+		}
+		if len(mapsets) > 0 && !mapsets[parts[0]] {
+			return false
+		}
+		z, err1 := strconv.Atoi(parts[2])
+		x, err2 := strconv.Atoi(parts[3])
+		y, err3 := strconv.Atoi(parts[4])
+		return err1 == nil && err2 == nil && err3 == nil && tiles[tileCoord{z, x, y}]
+	})
+
+	for mapset := range mapsets {
+		for t := range tiles {
+			path := fmt.Sprintf("v1/maptiles/%s/256/%d/%d/%d", mapset, t.Z, t.X, t.Y)
+			if rule := s.cache.matchCacheRule(path); rule != nil {
+				keys = append(keys, getCacheKey(path, url.Values{}, rule))
+			}
+		}
+	}
+
+	// Both lookups can find the same entry
+	sort.Strings(keys)
+	unique := keys[:0]
+	for i, key := range keys {
+		if i == 0 || key != keys[i-1] {
+			unique = append(unique, key)
+		}
+	}
+	return unique, unknown, nil
+}
+
+// adminEntryKey resolves the entry an entry request names by ?url= or ?key=
+func (s *Server) adminEntryKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if key := r.URL.Query().Get("key"); key != "" {
+		if !validTileKey(key) {
+			writeAdminError(w, http.StatusBadRequest, "key must be 32 lowercase hex characters")
+			return "", false
+		}
+		return key, true
+	}
+	raw := r.URL.Query().Get("url")
+	if raw == "" {
+		writeAdminError(w, http.StatusBadRequest, "Set url (upstream path and query) or key")
+		return "", false
+	}
+	key, err := s.cache.resolveCacheURL(raw)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	return key, true
+}
+
+func (s *Server) adminCacheEntryHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := s.adminEntryKey(w, r)
+	if !ok {
+		return
+	}
+	info, err := s.cache.inspectCacheEntry(key)
+	if err == errTileNotFound {
+		writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "Not cached", "key": key})
+		return
+	} else if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "Failed to read cache entry: "+err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, info)
+}
+
+func (s *Server) adminCacheEntryDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := s.adminEntryKey(w, r)
+	if !ok {
+		return
+	}
+	if _, err := s.cache.store.Stat(key); err == errTileNotFound {
+		writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "Not cached", "key": key})
+		return
+	}
+	var freed int64
+	if s.cache.idx != nil {
+		freed = s.cache.idx.Remove(key)
+	}
+	s.cache.removeCacheEntry(key)
+
+	logWith("key", key).Info("🗑️ Deleted cache entry via admin API")
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"deleted":     key,
+		"freed_bytes": freed,
+	})
+}
+
+func (s *Server) adminCacheEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.cache.idx == nil {
+		writeAdminError(w, http.StatusServiceUnavailable, "Cache index not loaded")
+		return
+	}
+	prefix := strings.TrimPrefix(r.URL.Query().Get("prefix"), "/")
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeAdminError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+
+	keys, unknown := s.cache.matchCachePaths(func(path string) bool {
+		return strings.HasPrefix(path, prefix)
+	})
+	entries := make([]cacheEntryInfo, 0, len(keys))
+	for _, key := range keys {
+		if info, ok := s.cache.indexedCacheEntryInfo(key); ok {
+			entries = append(entries, info)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	total := len(entries)
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"total":        total,
+		"unknown_path": unknown,
+		"entries":      entries,
+	})
+}
+
+// adminKeyStatus describes one key of the pool
+type adminKeyStatus struct {
+	ID         string     `json:"id"`
+	Requests   uint64     `json:"requests"`
+	Failures   uint64     `json:"failures"`
+	LastStatus int64      `json:"last_status"`
+	LastUsed   *time.Time `json:"last_used"`
+}
+
+func (s *Server) adminKeysHandler(w http.ResponseWriter, r *http.Request) {
+	pool := s.keys.list()
+	keys := make([]adminKeyStatus, 0, len(pool))
+	for _, key := range pool {
+		status := adminKeyStatus{ID: key.ID}
+		if stats, ok := s.keys.keyStats(key.ID); ok {
+			status.Requests = atomic.LoadUint64(&stats.requests)
+			status.Failures = atomic.LoadUint64(&stats.failures)
+			status.LastStatus = atomic.LoadInt64(&stats.lastStatus)
+			lastUsed := time.Unix(atomic.LoadInt64(&stats.lastUsed), 0).UTC()
+			status.LastUsed = &lastUsed
+		}
+		keys = append(keys, status)
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"size": len(keys),
+		"keys": keys,
+	})
+}
+
+func (s *Server) adminConfigReloadHandler(w http.ResponseWriter, r *http.Request) {
+	restartRequired, err := s.reloadConfig()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "Failed to reload config: "+err.Error())
+		return
+	}
+
+	keys := len(s.keys.list())
+
+	logWith("keys", keys).Info("🔄 Config reloaded via admin API")
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"status":           "reloaded",
+		"keys":             keys,
+		"restart_required": restartRequired,
+	})
+}
+
+// reloadConfig loads the config again, the way it was loaded at startup, and
+// applies it to the running server. The listen address and tile store settings
+// only apply at startup; changes to them are reported and kept at their
+// current values.
+func (s *Server) reloadConfig() ([]string, error) {
+	config, err := loadConfig(s.configFile, s.configFlags)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.keyList()) == 0 {
+		return nil, fmt.Errorf("no API keys configured")
+	}
+	rc := config.resolve()
+	for _, issue := range rc.issues {
+		logWarn("⚠️  %s", issue)
+	}
+	cacheConfig, rules := rc.Cache, rc.cacheRules
+	proxyConfig, allowPatterns := rc.Proxy, rc.allowPatterns
+
+	// Rules keep their counters across reloads
+	c := s.cache
+	for _, rule := range rules {
+		if old := c.findCacheRule(rule.Name); old != nil {
+			rule.hits, rule.misses = atomic.LoadUint64(&old.hits), atomic.LoadUint64(&old.misses)
+		}
+	}
+
+	restartRequired := []string{}
+	c.mutex.Lock()
+	before := c.config
+	if cacheConfig.Dir != before.Dir {
+		restartRequired = append(restartRequired, "cache.dir")
+		cacheConfig.Dir = before.Dir
+	}
+	if cacheConfig.Backend != before.Backend {
+		restartRequired = append(restartRequired, "cache.backend")
+		cacheConfig.Backend = before.Backend
+	}
+	if cacheConfig.KV != before.KV {
+		restartRequired = append(restartRequired, "cache.kv")
+		cacheConfig.KV = before.KV
+	}
+	if !reflect.DeepEqual(cacheConfig.ObjectStore, before.ObjectStore) {
+		restartRequired = append(restartRequired, "cache.object_store")
+		cacheConfig.ObjectStore = before.ObjectStore
+	}
+	if cacheConfig.MemoryMB != before.MemoryMB {
+		restartRequired = append(restartRequired, "cache.memory_mb")
+		cacheConfig.MemoryMB = before.MemoryMB
+	}
+	c.config = cacheConfig
+	c.rules = rules
+	c.mutex.Unlock()
+
+	s.keys.set(config.keyList())
+
+	// Timeouts and TLS settings live in the client
+	s.keys.setHTTPClient(newHTTPClient(proxyConfig))
+
+	setupLogging(rc.Logging)
+	s.sessions.setLimits(rc.Multiplayer)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	serverConfig := rc.Server
+	if serverConfig.Host != s.server.Host {
+		restartRequired = append(restartRequired, "server.host")
+		serverConfig.Host = s.server.Host
+	}
+	if serverConfig.Port != s.server.Port {
+		restartRequired = append(restartRequired, "server.port")
+		serverConfig.Port = s.server.Port
+	}
+	if serverConfig.StaticDir != s.server.StaticDir {
+		restartRequired = append(restartRequired, "server.static_dir")
+		serverConfig.StaticDir = s.server.StaticDir
+	}
+	if serverConfig.TLS != s.server.TLS {
+		// Renewed certificates in the same files are picked up without this
+		restartRequired = append(restartRequired, "server.tls")
+		serverConfig.TLS = s.server.TLS
+	}
+	s.server = serverConfig
+
+	// A rate <= 0 makes the running limiter let everything through
+	if proxyConfig.RateLimit != s.proxy.RateLimit {
+		if s.rateLimiter != nil {
+			s.rateLimiter.SetLimits(proxyConfig.RateLimit.RequestsPerSecond, proxyConfig.RateLimit.Burst)
+		} else if proxyConfig.RateLimit.RequestsPerSecond > 0 {
+			restartRequired = append(restartRequired, "proxy.rate_limit")
+		}
+	}
+	s.proxy = proxyConfig
+	s.allowPatterns = allowPatterns
+	s.admin = config.Admin
+
+	return restartRequired, nil
+}
+
+// ==================== END ADMIN API ====================
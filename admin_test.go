@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestAdminCacheEntryRejectsInvalidKeys(t *testing.T) {
+	root := t.TempDir()
+	victim := filepath.Join(root, "victim")
+	if err := os.WriteFile(victim, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Cache.Dir = filepath.Join(root, "cache", "tiles")
+		cfg.Admin.Token = "secret"
+	})
+
+	keys := map[string]string{
+		"short":     "a",
+		"traversal": "../victim", // <dir>/../../victim
+		"absolute":  "../../../etc/hostname",
+		"uppercase": "0123456789ABCDEF0123456789ABCDEF",
+	}
+	for name, key := range keys {
+		for _, method := range []string{http.MethodGet, http.MethodDelete} {
+			t.Run(name+"/"+method, func(t *testing.T) {
+				req := httptest.NewRequest(method, "/api/admin/cache/entry?key="+url.QueryEscape(key), nil)
+				req.Header.Set("Authorization", "Bearer secret")
+				rec := httptest.NewRecorder()
+				s.ServeHTTP(rec, req)
+				if rec.Code != http.StatusBadRequest {
+					t.Errorf("status = %d, want %d (body %q)", rec.Code, http.StatusBadRequest, rec.Body)
+				}
+			})
+		}
+	}
+
+	if _, err := os.Stat(victim); err != nil {
+		t.Errorf("file outside the cache dir was touched: %v", err)
+	}
+}
+
+func TestAdminCacheEntryUnknownKey(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.Admin.Token = "secret" })
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/cache/entry?key=0123456789abcdef0123456789abcdef", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminRequiresCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		admin  AdminConfig
+		header http.Header
+		want   int
+	}{
+		{"disabled", AdminConfig{}, http.Header{"Authorization": {"Bearer "}}, http.StatusNotFound},
+		{"missing token", AdminConfig{Token: "secret"}, nil, http.StatusUnauthorized},
+		{"wrong token", AdminConfig{Token: "secret"}, http.Header{"Authorization": {"Bearer wrong"}}, http.StatusUnauthorized},
+		{"token prefix", AdminConfig{Token: "secret"}, http.Header{"Authorization": {"Bearer secre"}}, http.StatusUnauthorized},
+		{"not bearer", AdminConfig{Token: "secret"}, http.Header{"Authorization": {"secret"}}, http.StatusUnauthorized},
+		{"token", AdminConfig{Token: "secret"}, http.Header{"Authorization": {"Bearer secret"}}, http.StatusOK},
+		{"missing basic", AdminConfig{Username: "admin", Password: "pw"}, nil, http.StatusUnauthorized},
+		{"wrong password", AdminConfig{Username: "admin", Password: "pw"}, basicAuth("admin", "nope"), http.StatusUnauthorized},
+		{"wrong user", AdminConfig{Username: "admin", Password: "pw"}, basicAuth("root", "pw"), http.StatusUnauthorized},
+		{"basic", AdminConfig{Username: "admin", Password: "pw"}, basicAuth("admin", "pw"), http.StatusOK},
+		{"username only", AdminConfig{Username: "admin"}, basicAuth("admin", ""), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(cfg *Config) { cfg.Admin = tt.admin })
+			for _, target := range []string{"/api/admin/cache", "/api/admin/keys"} {
+				rec := get(s, target, tt.header)
+				if rec.Code != tt.want {
+					t.Errorf("%s: status = %d, want %d", target, rec.Code, tt.want)
+				}
+				if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+					t.Errorf("%s: 401 without WWW-Authenticate", target)
+				}
+			}
+		})
+	}
+
+	// Credentials are checked before anything else, so unknown endpoints don't leak
+	s := newTestServer(t, func(cfg *Config) { cfg.Admin.Token = "secret" })
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/cache/clear", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("clear with a wrong token: status = %d, want 401", rec.Code)
+	}
+	if rec := get(s, "/api/admin/nope", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unknown endpoint without credentials: status = %d, want 401", rec.Code)
+	}
+}
+
+// Run with -race: reloads swap the logger, limits and key pool under requests
+func TestAdminConfigReloadUnderLoad(t *testing.T) {
+	_, upstreamURL := newMockUpstreamServer(t, nil)
+	cacheDir := t.TempDir()
+	file := filepath.Join(t.TempDir(), "settings.yaml")
+	writeSettings := func(format string, maxPlayers int) {
+		t.Helper()
+		yaml := fmt.Sprintf(`api_keys:
+  - good: "good"
+proxy:
+  upstream_url: %q
+cache:
+  dir: %q
+  memory_mb: -1
+  startup_scan: "off"
+logging:
+  level: ERROR
+  format: %s
+multiplayer:
+  max_players: %d
+admin:
+  token: "secret"
+`, upstreamURL, cacheDir, format, maxPlayers)
+		if err := os.WriteFile(file, []byte(yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeSettings(LogFormatText, 4)
+	t.Cleanup(func() { setupLogging(LoggingConfig{Level: "ERROR"}) })
+
+	config, err := loadConfig(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				get(s, fmt.Sprintf("/api/mapy/v1/maptiles/basic/256/10/%d/%d", 550+i, 300+n%8), nil)
+				get(s, "/readyz", nil)
+			}
+		}(i)
+	}
+
+	auth := http.Header{"Authorization": {"Bearer secret"}}
+	for i := 0; i < 20; i++ {
+		format := LogFormatText
+		if i%2 == 0 {
+			format = LogFormatJSON
+		}
+		writeSettings(format, 4+i)
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/config/reload", nil)
+		req.Header = auth.Clone()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("reload %d: status = %d: %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if got := s.sessions.settings().MaxPlayers; got != 23 {
+		t.Errorf("max_players after reloads = %d, want 23", got)
+	}
+}
+
+// basicAuth returns an Authorization header for HTTP basic auth
+func basicAuth(user, password string) http.Header {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth(user, password)
+	return req.Header
+}
@@ -144,9 +144,9 @@ async function loadRegionBoundaries() {
 // Load and display version info
 async function loadVersionInfo() {
     try {
-        const response = await fetch('version.json');
+        const response = await fetch('/api/version');
         if (!response.ok) {
-            throw new Error('Version file not found');
+            throw new Error('Version endpoint not available');
         }
         const versionData = await response.json();
         
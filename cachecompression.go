@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ==================== CACHE COMPRESSION ====================
+//
+// Compressible responses (panorama metadata, JSON, text) are gzipped on their
+// way into the tile store and stored with Content-Encoding: gzip. Clients that
+// accept gzip get the stored bytes as they are, everyone else a decoded copy.
+// Images are stored untouched - they are compressed already.
+//
+// zstd would compress a little better, but needs a third-party module; gzip is
+// in the standard library and every browser accepts it.
+
+// Cache compression modes (cache.compression)
+const (
+	CacheCompressionGzip = "gzip"
+	CacheCompressionOff  = "off"
+)
+
+// compressibleTypes are the content types worth compressing, matched by prefix
+var compressibleTypes = []string{
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+	"text/",
+}
+
+// shouldCompress reports whether a response is stored gzipped
+func (c *tileCache) shouldCompress(contentType, contentEncoding string) bool {
+	if c.settings().Compression != CacheCompressionGzip || contentEncoding != "" {
+		return false
+	}
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if strings.HasSuffix(contentType, "+json") || strings.HasSuffix(contentType, "+xml") {
+		return true
+	}
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip checks a request's Accept-Encoding for gzip (or *) without q=0
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		rejected := false
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					rejected = true
+				}
+			}
+		}
+		if !rejected {
+			return true
+		}
+	}
+	return false
+}
+
+// gunzip decodes a stored entry for clients that don't accept gzip
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// weakETag marks an ETag weak, for the gzip variant of an entry
+func weakETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return "W/" + etag
+}
+
+// ==================== END CACHE COMPRESSION ====================
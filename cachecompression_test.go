@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCachedJSONServedPerAcceptEncoding(t *testing.T) {
+	_, upstreamURL := newMockUpstreamServer(t, nil)
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Proxy.UpstreamURL = upstreamURL
+		cfg.APIKeys = []map[string]string{{"good": "good"}}
+		cfg.Cache.Rules = []CacheRule{{Name: "suggest", Path: `^v1/suggest$`}}
+	})
+	fixture, err := os.ReadFile("mockdata/v1/suggest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const target = "/api/mapy/v1/suggest?query=praha"
+	if rec := get(s, target, nil); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), fixture) {
+		t.Fatalf("miss: status = %d, body matches fixture = %t", rec.Code, bytes.Equal(rec.Body.Bytes(), fixture))
+	}
+
+	// Clients that accept gzip get the stored bytes and a weak ETag
+	gz := get(s, target, http.Header{"Accept-Encoding": {"br, gzip"}})
+	if gz.Header().Get("X-Cache") != "HIT" || gz.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("gzip hit: X-Cache = %q, Content-Encoding = %q, want HIT gzip", gz.Header().Get("X-Cache"), gz.Header().Get("Content-Encoding"))
+	}
+	if body, err := gunzip(gz.Body.Bytes()); err != nil || !bytes.Equal(body, fixture) {
+		t.Errorf("gzip hit doesn't decode to the fixture: %v", err)
+	}
+	weak := gz.Header().Get("ETag")
+	if !strings.HasPrefix(weak, `W/"`) {
+		t.Errorf("gzip hit ETag = %q, want a weak ETag", weak)
+	}
+	if gz.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("gzip hit Vary = %q, want Accept-Encoding", gz.Header().Get("Vary"))
+	}
+
+	// Everyone else gets a decoded copy under the strong ETag
+	for _, acceptEncoding := range []string{"", "identity", "gzip;q=0"} {
+		rec := get(s, target, http.Header{"Accept-Encoding": {acceptEncoding}})
+		if rec.Header().Get("Content-Encoding") != "" || !bytes.Equal(rec.Body.Bytes(), fixture) {
+			t.Errorf("Accept-Encoding %q: Content-Encoding = %q, body matches fixture = %t",
+				acceptEncoding, rec.Header().Get("Content-Encoding"), bytes.Equal(rec.Body.Bytes(), fixture))
+		}
+		if etag := rec.Header().Get("ETag"); etag != strings.TrimPrefix(weak, "W/") {
+			t.Errorf("Accept-Encoding %q: ETag = %q, want the strong form of %q", acceptEncoding, etag, weak)
+		}
+	}
+
+	// Either variant's ETag validates the other's copy
+	if rec := get(s, target, http.Header{"If-None-Match": {weak}}); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match with the weak ETag: status = %d, want 304", rec.Code)
+	}
+}
+
+func TestConfigRejectsZstdCompression(t *testing.T) {
+	rc := Config{Cache: CacheConfig{Compression: "zstd"}}.resolve()
+	if rc.Cache.Compression != CacheCompressionGzip {
+		t.Errorf("compression = %q, want the gzip default", rc.Cache.Compression)
+	}
+	found := false
+	for _, problem := range rc.validate() {
+		found = found || strings.Contains(problem, "zstd")
+	}
+	if !found {
+		t.Error("config validate doesn't report zstd")
+	}
+}
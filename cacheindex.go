@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== CACHE INDEX ====================
+//
+// The cache index tracks every tile cache entry (size, store time, last access)
+// in memory, ordered by last access, and persists it as an append-only log in
+// the cache dir, whichever backend holds the entries. Stats are O(1) and
+// eviction pops the least recently used entries without walking the
+// filesystem. Each cache rule keeps its own LRU list as well, so enforcing a
+// rule's max_size_share doesn't walk the other rules' entries.
+//
+// Log records are tab-separated lines:
+//
+//	P <key> <size> <stored unix> <rule> <path>    entry written
+//	A <key> <accessed unix>                       entry read
+//	D <key>                                       entry removed
+//
+// The rule is the name of the cache rule the entry was stored under (see
+// cacherules.go); it is empty for entries found in the store before any
+// request named their rule. The path is the upstream path the entry was
+// fetched from, for purging by prefix; it is empty when unknown.
+//
+// The log is compacted into a snapshot of P/A records when it grows well past
+// the number of live entries. A lock file keeps a second process (another
+// server or an offline prewarm) from writing the same log.
+
+const (
+	cacheIndexFile          = "index.log"
+	cacheIndexLockFile      = "index.lock"
+	cacheIndexFlushInterval = 2 * time.Second
+	cacheIndexAccessGrain   = time.Minute // Access records are logged at most this often per entry
+)
+
+// cacheIndexEntry describes one cached tile (data + metadata)
+type cacheIndexEntry struct {
+	key          string
+	rule         string
+	path         string
+	size         int64
+	stored       time.Time
+	accessed     time.Time
+	loggedAccess time.Time
+	ruleElement  *list.Element // In the rule's LRU list
+}
+
+// cacheIndex is the in-memory LRU view of the tile store backed by an append-only log
+type cacheIndex struct {
+	mutex     sync.Mutex
+	path      string
+	file      *os.File
+	writer    *bufio.Writer
+	entries   map[string]*list.Element
+	lru       *list.List // Front = most recently used
+	totalSize int64
+	ruleSizes map[string]int64      // Per cache rule, for max_size_share
+	ruleLRU   map[string]*list.List // Per cache rule, front = most recently used
+	records   int                   // Records in the log file, for compaction decisions
+	closed    bool
+	stop      chan struct{} // Closed by Close to stop the background flush
+	lock      *os.File
+	unlock    func()
+}
+
+// cacheRuleUsage is the share of the index one cache rule holds
+type cacheRuleUsage struct {
+	Size    int64
+	Entries int
+}
+
+// openCacheIndex loads the index from dir, rebuilding it from the tile store
+// when no log exists yet (first start after upgrading or switching backends).
+// It fails if another process has the index open.
+func openCacheIndex(dir string, store TileStore) (*cacheIndex, error) {
+	lockPath := filepath.Join(dir, cacheIndexLockFile)
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile(lock)
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("%s is in use by another process: %v", lockPath, err)
+	}
+
+	idx := &cacheIndex{
+		path:      filepath.Join(dir, cacheIndexFile),
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+		ruleSizes: make(map[string]int64),
+		ruleLRU:   make(map[string]*list.List),
+		stop:      make(chan struct{}),
+		lock:      lock,
+		unlock:    unlock,
+	}
+
+	if err := idx.replay(); err != nil {
+		if !os.IsNotExist(err) {
+			logWarn("Failed to read cache index, rebuilding: %v", err)
+		}
+		idx.rebuildFromStore(store)
+	}
+
+	// Start from a compact snapshot
+	if err := idx.compactLocked(); err != nil {
+		logError("Failed to write cache index: %v", err)
+	}
+
+	go idx.flushPeriodically()
+
+	return idx, nil
+}
+
+// flushPeriodically flushes buffered log records until Close
+func (idx *cacheIndex) flushPeriodically() {
+	ticker := time.NewTicker(cacheIndexFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-idx.stop:
+			return
+		case <-ticker.C:
+			idx.Flush()
+		}
+	}
+}
+
+// Close stops the background flush, writes buffered records, closes the log
+// and releases the lock. The in-memory index stays readable; nothing is logged
+// afterwards.
+func (idx *cacheIndex) Close() error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if idx.closed {
+		return nil
+	}
+	idx.closed = true
+	close(idx.stop)
+	defer func() {
+		idx.unlock()
+		idx.lock.Close()
+	}()
+
+	if idx.writer == nil {
+		return nil
+	}
+	err := idx.writer.Flush()
+	if closeErr := idx.file.Close(); err == nil {
+		err = closeErr
+	}
+	idx.writer = nil
+	idx.file = nil
+	return err
+}
+
+// replay rebuilds the in-memory state from the log file
+func (idx *cacheIndex) replay() error {
+	file, err := os.Open(idx.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		idx.records++
+		fields := strings.Split(scanner.Text(), "\t")
+		switch {
+		case len(fields) >= 4 && len(fields) <= 6 && fields[0] == "P":
+			size, err1 := strconv.ParseInt(fields[2], 10, 64)
+			stored, err2 := strconv.ParseInt(fields[3], 10, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			rule, path := "", ""
+			if len(fields) >= 5 {
+				rule = fields[4]
+			}
+			if len(fields) == 6 {
+				path = fields[5]
+			}
+			idx.putLocked(fields[1], rule, path, size, time.Unix(stored, 0))
+		case len(fields) == 3 && fields[0] == "A":
+			accessed, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				continue
+			}
+			if el, ok := idx.entries[fields[1]]; ok {
+				entry := el.Value.(*cacheIndexEntry)
+				entry.accessed = time.Unix(accessed, 0)
+				entry.loggedAccess = entry.accessed
+				idx.moveToFrontLocked(el)
+			}
+		case len(fields) == 2 && fields[0] == "D":
+			idx.removeLocked(fields[1])
+		}
+		// Anything else is a torn write from a crash - skip it
+	}
+
+	return scanner.Err()
+}
+
+// rebuildFromStore indexes the entries in the tile store, oldest first
+func (idx *cacheIndex) rebuildFromStore(store TileStore) {
+	type storedEntry struct {
+		key  string
+		info tileInfo
+	}
+	var sorted []storedEntry
+	err := store.Iterate(func(key string, info tileInfo) error {
+		sorted = append(sorted, storedEntry{key, info})
+		return nil
+	})
+	if err != nil {
+		logWarn("⚠️  Failed to list the tile store, starting with an empty index: %v", err)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].info.Stored.Before(sorted[j].info.Stored)
+	})
+	for _, e := range sorted {
+		idx.putLocked(e.key, "", "", e.info.Size, e.info.Stored)
+	}
+
+	logWith("entries", len(sorted)).Info("📇 Rebuilt cache index from the tile store")
+}
+
+// Put records a newly written entry as most recently used
+func (idx *cacheIndex) Put(key, rule, path string, size int64, stored time.Time) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	idx.putLocked(key, rule, path, size, stored)
+	idx.logPutLocked(idx.entries[key].Value.(*cacheIndexEntry))
+}
+
+// Touch marks an entry as recently used. Unknown entries found in the store are
+// added when their size is given, and entries indexed without a rule get one.
+func (idx *cacheIndex) Touch(key, rule string, size int64, stored time.Time) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	el, ok := idx.entries[key]
+	if !ok {
+		if size > 0 {
+			idx.putLocked(key, rule, "", size, stored)
+			idx.logPutLocked(idx.entries[key].Value.(*cacheIndexEntry))
+		}
+		return
+	}
+
+	now := time.Now()
+	entry := el.Value.(*cacheIndexEntry)
+	entry.accessed = now
+	idx.moveToFrontLocked(el)
+
+	if entry.rule == "" && rule != "" {
+		idx.setRuleLocked(entry, rule)
+		idx.logPutLocked(entry)
+	}
+
+	if now.Sub(entry.loggedAccess) >= cacheIndexAccessGrain {
+		entry.loggedAccess = now
+		idx.appendLocked(fmt.Sprintf("A\t%s\t%d", key, now.Unix()))
+	}
+}
+
+// AddMissing indexes an entry found in the store unless it is indexed already.
+// Unlike Touch it leaves known entries' last access alone.
+func (idx *cacheIndex) AddMissing(key string, size int64, stored time.Time) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if _, ok := idx.entries[key]; ok {
+		return
+	}
+	idx.putLocked(key, "", "", size, stored)
+	idx.logPutLocked(idx.entries[key].Value.(*cacheIndexEntry))
+}
+
+// Refresh restarts an entry's TTL without changing its size
+func (idx *cacheIndex) Refresh(key string, stored time.Time) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	el, ok := idx.entries[key]
+	if !ok {
+		return
+	}
+	entry := el.Value.(*cacheIndexEntry)
+	idx.putLocked(key, entry.rule, entry.path, entry.size, stored)
+	idx.logPutLocked(entry)
+}
+
+// Remove drops an entry from the index and returns its indexed size
+func (idx *cacheIndex) Remove(key string) int64 {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	el, ok := idx.entries[key]
+	if !ok {
+		return 0
+	}
+	size := el.Value.(*cacheIndexEntry).size
+	idx.removeLocked(key)
+	idx.appendLocked("D\t" + key)
+	return size
+}
+
+// Stats returns the total size and number of indexed entries
+func (idx *cacheIndex) Stats() (int64, int) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	return idx.totalSize, len(idx.entries)
+}
+
+// Keys returns the keys of all indexed entries
+func (idx *cacheIndex) Keys() []string {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	keys := make([]string, 0, len(idx.entries))
+	for key := range idx.entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// MatchPaths returns the keys of entries whose upstream path matches, and the
+// keys of entries whose path isn't known
+func (idx *cacheIndex) MatchPaths(match func(path string) bool) ([]string, []string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	var keys, unknown []string
+	for key, el := range idx.entries {
+		path := el.Value.(*cacheIndexEntry).path
+		if path == "" {
+			unknown = append(unknown, key)
+		} else if match(path) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, unknown
+}
+
+// SetPath records the upstream path of an entry indexed without one
+func (idx *cacheIndex) SetPath(key, path string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	el, ok := idx.entries[key]
+	if !ok || path == "" || strings.ContainsAny(path, "\t\r\n") {
+		return
+	}
+	entry := el.Value.(*cacheIndexEntry)
+	if entry.path == "" {
+		entry.path = path
+		idx.logPutLocked(entry)
+		// Replaying the P record resets the last access; keep it
+		if entry.loggedAccess.After(entry.stored) {
+			idx.appendLocked(fmt.Sprintf("A\t%s\t%d", key, entry.loggedAccess.Unix()))
+		}
+	}
+}
+
+// cacheIndexInfo is a copy of one index entry
+type cacheIndexInfo struct {
+	Rule     string
+	Path     string
+	Size     int64
+	Stored   time.Time
+	Accessed time.Time
+}
+
+// Lookup returns the index entry for a key
+func (idx *cacheIndex) Lookup(key string) (cacheIndexInfo, bool) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	el, ok := idx.entries[key]
+	if !ok {
+		return cacheIndexInfo{}, false
+	}
+	entry := el.Value.(*cacheIndexEntry)
+	return cacheIndexInfo{
+		Rule:     entry.rule,
+		Path:     entry.path,
+		Size:     entry.size,
+		Stored:   entry.stored,
+		Accessed: entry.accessed,
+	}, true
+}
+
+// RuleUsage returns size and entry count per cache rule
+func (idx *cacheIndex) RuleUsage() map[string]cacheRuleUsage {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	usage := make(map[string]cacheRuleUsage, len(idx.ruleLRU))
+	for rule, entries := range idx.ruleLRU {
+		usage[rule] = cacheRuleUsage{Size: idx.ruleSizes[rule], Entries: entries.Len()}
+	}
+	return usage
+}
+
+// ExpiredKeys returns entries stored longer ago than their rule's maximum age
+func (idx *cacheIndex) ExpiredKeys(maxAge func(rule string) time.Duration) []string {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	now := time.Now()
+	var expired []string
+	for key, el := range idx.entries {
+		entry := el.Value.(*cacheIndexEntry)
+		if now.Sub(entry.stored) > maxAge(entry.rule) {
+			expired = append(expired, key)
+		}
+	}
+
+	return expired
+}
+
+// TakeLRU removes and returns least recently used entries until the total
+// size is within maxSize
+func (idx *cacheIndex) TakeLRU(maxSize int64) ([]string, int64) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	var evicted []string
+	var freed int64
+	for idx.totalSize > maxSize && idx.lru.Len() > 0 {
+		entry := idx.lru.Back().Value.(*cacheIndexEntry)
+		evicted = append(evicted, entry.key)
+		freed += entry.size
+		idx.removeLocked(entry.key)
+		idx.appendLocked("D\t" + entry.key)
+	}
+
+	return evicted, freed
+}
+
+// TakeRuleLRU removes and returns least recently used entries of one rule until
+// the rule's size is within maxSize
+func (idx *cacheIndex) TakeRuleLRU(rule string, maxSize int64) ([]string, int64) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	var evicted []string
+	var freed int64
+	for idx.ruleSizes[rule] > maxSize && idx.ruleLRU[rule] != nil {
+		entry := idx.ruleLRU[rule].Back().Value.(*cacheIndexEntry)
+		evicted = append(evicted, entry.key)
+		freed += entry.size
+		idx.removeLocked(entry.key)
+		idx.appendLocked("D\t" + entry.key)
+	}
+
+	return evicted, freed
+}
+
+// Reset forgets every entry and starts an empty log (after the cache dir was wiped)
+func (idx *cacheIndex) Reset() error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	idx.entries = make(map[string]*list.Element)
+	idx.lru.Init()
+	idx.totalSize = 0
+	idx.ruleSizes = make(map[string]int64)
+	idx.ruleLRU = make(map[string]*list.List)
+	return idx.compactLocked()
+}
+
+// Flush writes buffered log records to disk
+func (idx *cacheIndex) Flush() {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if idx.writer != nil {
+		if err := idx.writer.Flush(); err != nil {
+			logWarn("Failed to flush cache index: %v", err)
+		}
+	}
+}
+
+// Compact rewrites the log as a snapshot if it has grown well past the live entries
+func (idx *cacheIndex) Compact() {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if idx.records < 2*len(idx.entries)+10000 {
+		return
+	}
+	if err := idx.compactLocked(); err != nil {
+		logError("Failed to compact cache index: %v", err)
+	}
+}
+
+// putLocked inserts or replaces an entry; the caller holds the mutex
+func (idx *cacheIndex) putLocked(key, rule, path string, size int64, stored time.Time) {
+	// Paths are logged as a tab-separated field
+	if strings.ContainsAny(path, "\t\r\n") {
+		path = ""
+	}
+	if el, ok := idx.entries[key]; ok {
+		entry := el.Value.(*cacheIndexEntry)
+		idx.totalSize += size - entry.size
+		idx.ruleSizes[entry.rule] += size - entry.size
+		entry.size = size
+		if rule != "" {
+			idx.setRuleLocked(entry, rule)
+		}
+		if path != "" {
+			entry.path = path
+		}
+		entry.stored = stored
+		entry.accessed = stored
+		entry.loggedAccess = stored
+		idx.moveToFrontLocked(el)
+		return
+	}
+
+	entry := &cacheIndexEntry{
+		key:          key,
+		path:         path,
+		size:         size,
+		stored:       stored,
+		accessed:     stored,
+		loggedAccess: stored,
+	}
+	idx.entries[key] = idx.lru.PushFront(entry)
+	idx.totalSize += size
+	idx.addToRuleLocked(entry, rule)
+}
+
+// moveToFrontLocked marks an entry as most recently used overall and within
+// its rule; the caller holds the mutex
+func (idx *cacheIndex) moveToFrontLocked(el *list.Element) {
+	entry := el.Value.(*cacheIndexEntry)
+	idx.lru.MoveToFront(el)
+	idx.ruleLRU[entry.rule].MoveToFront(entry.ruleElement)
+}
+
+// setRuleLocked moves an entry to another rule as its most recently used
+// entry; the caller holds the mutex
+func (idx *cacheIndex) setRuleLocked(entry *cacheIndexEntry, rule string) {
+	if entry.rule == rule {
+		return
+	}
+	idx.removeFromRuleLocked(entry)
+	idx.addToRuleLocked(entry, rule)
+}
+
+// addToRuleLocked adds an entry to the front of a rule's LRU list; the caller holds the mutex
+func (idx *cacheIndex) addToRuleLocked(entry *cacheIndexEntry, rule string) {
+	entries := idx.ruleLRU[rule]
+	if entries == nil {
+		entries = list.New()
+		idx.ruleLRU[rule] = entries
+	}
+	entry.rule = rule
+	entry.ruleElement = entries.PushFront(entry)
+	idx.ruleSizes[rule] += entry.size
+}
+
+// removeFromRuleLocked takes an entry out of its rule, forgetting the rule's
+// totals once it has no entries; the caller holds the mutex
+func (idx *cacheIndex) removeFromRuleLocked(entry *cacheIndexEntry) {
+	entries := idx.ruleLRU[entry.rule]
+	entries.Remove(entry.ruleElement)
+	idx.ruleSizes[entry.rule] -= entry.size
+	if entries.Len() == 0 {
+		delete(idx.ruleLRU, entry.rule)
+		delete(idx.ruleSizes, entry.rule)
+	}
+	entry.ruleElement = nil
+}
+
+// removeLocked drops an entry; the caller holds the mutex
+func (idx *cacheIndex) removeLocked(key string) bool {
+	el, ok := idx.entries[key]
+	if !ok {
+		return false
+	}
+	entry := el.Value.(*cacheIndexEntry)
+	idx.totalSize -= entry.size
+	idx.removeFromRuleLocked(entry)
+	idx.lru.Remove(el)
+	delete(idx.entries, key)
+	return true
+}
+
+// logPutLocked buffers a P record for an entry; the caller holds the mutex
+func (idx *cacheIndex) logPutLocked(entry *cacheIndexEntry) {
+	idx.appendLocked(fmt.Sprintf("P\t%s\t%d\t%d\t%s\t%s", entry.key, entry.size, entry.stored.Unix(), entry.rule, entry.path))
+}
+
+// appendLocked buffers a log record; the caller holds the mutex
+func (idx *cacheIndex) appendLocked(record string) {
+	if idx.writer == nil {
+		return
+	}
+	idx.writer.WriteString(record + "\n")
+	idx.records++
+}
+
+// compactLocked writes a snapshot (least recently used first, so replay restores
+// the LRU order) to a temp file and swaps it in; the caller holds the mutex
+func (idx *cacheIndex) compactLocked() error {
+	if idx.closed {
+		return fmt.Errorf("cache index is closed")
+	}
+	if idx.writer != nil {
+		idx.writer.Flush()
+		idx.file.Close()
+		idx.writer = nil
+		idx.file = nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(idx.path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(idx.path), cacheIndexFile+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	records := 0
+	for el := idx.lru.Back(); el != nil; el = el.Prev() {
+		entry := el.Value.(*cacheIndexEntry)
+		fmt.Fprintf(w, "P\t%s\t%d\t%d\t%s\t%s\n", entry.key, entry.size, entry.stored.Unix(), entry.rule, entry.path)
+		records++
+		if entry.loggedAccess.After(entry.stored) {
+			fmt.Fprintf(w, "A\t%s\t%d\n", entry.key, entry.loggedAccess.Unix())
+			records++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), idx.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	file, err := os.OpenFile(idx.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	idx.file = file
+	idx.writer = bufio.NewWriter(file)
+	idx.records = records
+	return nil
+}
+
+// ==================== END CACHE INDEX ====================
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCacheIndexRuleLRU(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := openCacheIndex(dir, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interleave two rules, oldest first
+	stored := time.Now().Add(-time.Hour)
+	for i := 0; i < 4; i++ {
+		idx.Put(fmt.Sprintf("tile%d", i), "tiles", "", 100, stored)
+		idx.Put(fmt.Sprintf("search%d", i), "search", "", 10, stored)
+	}
+	idx.Touch("tile0", "", 0, time.Time{}) // tile1 is now the oldest tile
+
+	evicted, freed := idx.TakeRuleLRU("tiles", 200)
+	if want := []string{"tile1", "tile2"}; !reflect.DeepEqual(evicted, want) || freed != 200 {
+		t.Errorf("TakeRuleLRU = %v, %d, want %v, 200", evicted, freed, want)
+	}
+	usage := idx.RuleUsage()
+	if got := usage["tiles"]; got.Size != 200 || got.Entries != 2 {
+		t.Errorf("tiles usage = %+v, want 200 bytes in 2 entries", got)
+	}
+	if got := usage["search"]; got.Size != 40 || got.Entries != 4 {
+		t.Errorf("search usage = %+v, want 40 bytes in 4 entries", got)
+	}
+
+	// Moving an entry to another rule moves its size too
+	idx.Put("search0", "tiles", "", 10, stored)
+	if got := idx.RuleUsage()["tiles"]; got.Size != 210 || got.Entries != 3 {
+		t.Errorf("tiles usage after moving search0 = %+v, want 210 bytes in 3 entries", got)
+	}
+	evicted, _ = idx.TakeRuleLRU("tiles", 0)
+	if want := []string{"tile3", "tile0", "search0"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("TakeRuleLRU(tiles, 0) = %v, want %v", evicted, want)
+	}
+	if _, ok := idx.RuleUsage()["tiles"]; ok {
+		t.Error("empty rule still has usage")
+	}
+
+	// Only one user at a time holds the index, and the per-rule order survives a restart
+	idx.Touch("search1", "", 0, time.Time{})
+	if _, err := openCacheIndex(dir, store); err == nil {
+		t.Fatal("opened an index another user holds")
+	}
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err = openCacheIndex(dir, store); err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	evicted, _ = idx.TakeRuleLRU("search", 10)
+	if want := []string{"search2", "search3"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("after reopening TakeRuleLRU = %v, want %v", evicted, want)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ==================== CACHE INSPECTION ====================
+//
+// Every entry's metadata records the request it was fetched for: @source holds
+// the upstream path and normalized query its key is derived from (see
+// cacheKeySource), and the index keeps the path part. That lets the admin API
+// look entries up by URL and purge them by path prefix. Entries indexed without
+// a path have it read from their metadata on demand; entries written before
+// the source was recorded can only be found by URL.
+
+const cacheMetaSource = "@source"
+
+// cacheSourcePath returns the path part of a cache key source
+func cacheSourcePath(source string) string {
+	path, _, _ := strings.Cut(source, "?")
+	return path
+}
+
+// resolveCacheURL returns the cache key of an upstream URL such as
+// "v1/maptiles/basic/256/12/2214/1399?lang=cs" (a leading /api/mapy/ is allowed)
+func (c *tileCache) resolveCacheURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %q: %v", raw, err)
+	}
+	apiPath := strings.TrimPrefix(strings.TrimPrefix(u.Path, "/"), "api/mapy/")
+	rule := c.matchCacheRule(apiPath)
+	if rule == nil {
+		return "", fmt.Errorf("no cache rule matches %q", apiPath)
+	}
+	return getCacheKey(apiPath, u.Query(), rule), nil
+}
+
+// matchCachePaths returns the keys of entries whose upstream path matches.
+// Paths the index doesn't know are read from the entry metadata and recorded;
+// unknown counts the entries that have none.
+func (c *tileCache) matchCachePaths(match func(path string) bool) ([]string, int) {
+	keys, unresolved := c.idx.MatchPaths(match)
+
+	unknown := 0
+	for _, key := range unresolved {
+		internal, ok := c.readCacheInternal(key)
+		path := cacheSourcePath(internal[cacheMetaSource])
+		if !ok || path == "" {
+			unknown++
+			continue
+		}
+		c.idx.SetPath(key, path)
+		if match(path) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, unknown
+}
+
+// cacheEntryInfo describes one cache entry for the admin API
+type cacheEntryInfo struct {
+	Key        string            `json:"key"`
+	Source     string            `json:"source,omitempty"`
+	Path       string            `json:"path,omitempty"`
+	Rule       string            `json:"rule,omitempty"`
+	SizeBytes  int64             `json:"size_bytes"`
+	Stored     time.Time         `json:"stored"`
+	Accessed   *time.Time        `json:"accessed,omitempty"`
+	AgeSeconds int64             `json:"age_seconds"`
+	Fresh      bool              `json:"fresh"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Internal   map[string]string `json:"internal,omitempty"`
+}
+
+// indexedCacheEntryInfo describes an entry from the index alone
+func (c *tileCache) indexedCacheEntryInfo(key string) (cacheEntryInfo, bool) {
+	indexed, ok := c.idx.Lookup(key)
+	if !ok {
+		return cacheEntryInfo{}, false
+	}
+	accessed := indexed.Accessed
+	age := time.Since(indexed.Stored)
+	return cacheEntryInfo{
+		Key:        key,
+		Path:       indexed.Path,
+		Rule:       indexed.Rule,
+		SizeBytes:  indexed.Size,
+		Stored:     indexed.Stored,
+		Accessed:   &accessed,
+		AgeSeconds: int64(age.Seconds()),
+		Fresh:      age <= c.cacheRuleMaxAge(indexed.Rule),
+	}, true
+}
+
+// inspectCacheEntry reads an entry and its metadata from the store
+func (c *tileCache) inspectCacheEntry(key string) (cacheEntryInfo, error) {
+	entry, err := c.store.Get(key)
+	if err != nil {
+		return cacheEntryInfo{}, err
+	}
+	headers, internal := parseCacheMeta(entry.Meta)
+
+	info, ok := c.indexedCacheEntryInfo(key)
+	if !ok {
+		info = cacheEntryInfo{Key: key}
+	}
+	age := time.Since(entry.Stored)
+	info.Source = internal[cacheMetaSource]
+	info.Path = cacheSourcePath(info.Source)
+	info.SizeBytes = entry.Size()
+	info.Stored = entry.Stored
+	info.AgeSeconds = int64(age.Seconds())
+	info.Fresh = age <= c.cacheRuleMaxAge(info.Rule)
+	info.Headers = headers
+	info.Internal = internal
+	return info, nil
+}
+
+// ==================== END CACHE INSPECTION ====================
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== CACHE INTEGRITY ====================
+//
+// Every entry is stored as data plus metadata, and the metadata carries a SHA-256
+// of the data, verified on every store read. Entries that fail verification, and
+// orphans left behind by a crash, are quarantined instead of being served (see
+// diskstore.go for how the disk store writes entries atomically).
+
+const (
+	cacheQuarantineDir      = "quarantine"
+	cacheQuarantineKeepDays = 7
+	cacheMetaChecksum       = "@checksum" // Metadata lines starting with "@" are internal, not response headers
+	cacheScanGracePeriod    = time.Minute // Younger orphans may belong to a write in progress
+)
+
+// Startup scan modes (cache.startup_scan)
+const (
+	CacheScanOff   = "off"   // No scan
+	CacheScanQuick = "quick" // Remove temp files, quarantine orphans, sync the index
+	CacheScanFull  = "full"  // Quick, plus verify every checksum (reads the whole cache)
+)
+
+// checksumData returns the checksum stored in metadata for data
+func checksumData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// parseCacheMeta splits metadata into response headers and internal fields
+func parseCacheMeta(metaData []byte) (map[string]string, map[string]string) {
+	headers := make(map[string]string)
+	internal := make(map[string]string)
+	for _, line := range strings.Split(string(metaData), "\n") {
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if strings.HasPrefix(parts[0], "@") {
+			internal[parts[0]] = parts[1]
+		} else {
+			headers[parts[0]] = parts[1]
+		}
+	}
+	return headers, internal
+}
+
+// formatCacheMeta serializes response headers and internal fields
+func formatCacheMeta(headers, internal map[string]string) []byte {
+	var metaLines []string
+	for k, v := range headers {
+		metaLines = append(metaLines, k+": "+v)
+	}
+	for k, v := range internal {
+		metaLines = append(metaLines, k+": "+v)
+	}
+	sort.Strings(metaLines)
+	return []byte(strings.Join(metaLines, "\n"))
+}
+
+// verifyCacheData checks data against the checksum in its metadata.
+// Entries written before checksums were introduced have none and pass.
+func verifyCacheData(data []byte, internal map[string]string) bool {
+	expected, ok := internal[cacheMetaChecksum]
+	if !ok {
+		return true
+	}
+	return checksumData(data) == expected
+}
+
+// writeFileAtomic writes data to a temp file next to path, fsyncs it and renames it into place
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath, err := writeTempFile(path, data, perm)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// writeTempFile writes data to a fsynced temp file next to path and returns
+// its name, for the caller to rename into place
+func writeTempFile(path string, data []byte, perm os.FileMode) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// quarantineCacheEntry takes an entry out of the cache so it is refetched. The
+// disk store keeps its files in the quarantine dir, other stores delete it.
+func (c *tileCache) quarantineCacheEntry(cacheKey, reason string) {
+	var err error
+	if q, ok := c.store.(tileStoreQuarantiner); ok {
+		err = q.Quarantine(cacheKey)
+	} else {
+		err = c.store.Delete(cacheKey)
+	}
+	if err != nil {
+		logWith("key", cacheKey).Error("Failed to quarantine cache entry: %v", err)
+	}
+
+	if c.idx != nil {
+		c.idx.Remove(cacheKey)
+	}
+	if c.mem != nil {
+		c.mem.Remove(cacheKey)
+	}
+
+	atomic.AddUint64(&c.stats.quarantined, 1)
+	logWith("key", cacheKey, "reason", reason).Warn("☣️ Quarantined cache entry")
+}
+
+// scanCache checks the store for crash leftovers and corrupt entries and
+// brings the index in line with what is stored
+func (c *tileCache) scanCache(mode string) {
+	if mode == CacheScanOff {
+		return
+	}
+
+	start := time.Now()
+	logWith("mode", mode).Info("🔍 Cache scan started")
+
+	// Partial writes and orphans (data or metadata missing)
+	var tempRemoved, quarantined, verified int
+	if r, ok := c.store.(tileStoreRepairer); ok {
+		var orphans []string
+		tempRemoved, orphans = r.Repair()
+		for _, key := range orphans {
+			c.quarantineCacheEntry(key, "orphaned file (data or metadata missing)")
+			quarantined++
+		}
+	}
+
+	seen := make(map[string]bool)
+	err := c.store.Iterate(func(key string, info tileInfo) error {
+		seen[key] = true
+
+		var path string
+		if mode == CacheScanFull {
+			entry, err := c.store.Get(key)
+			if err != nil {
+				return nil
+			}
+			_, internal := parseCacheMeta(entry.Meta)
+			if !verifyCacheData(entry.Data, internal) {
+				c.quarantineCacheEntry(key, "checksum mismatch")
+				quarantined++
+				return nil
+			}
+			verified++
+			path = cacheSourcePath(internal[cacheMetaSource])
+		}
+
+		// Index entries that were written but never logged (e.g. crash before flush)
+		if c.idx != nil {
+			c.idx.AddMissing(key, info.Size, info.Stored)
+			c.idx.SetPath(key, path)
+		}
+		return nil
+	})
+	if err != nil {
+		logWarn("⚠️  Cache scan could not list the tile store: %v", err)
+		return
+	}
+
+	// Drop index entries that are gone from the store
+	var dropped int
+	if c.idx != nil {
+		for _, key := range c.idx.Keys() {
+			if seen[key] {
+				continue
+			}
+			if _, err := c.store.Stat(key); err == errTileNotFound {
+				c.idx.Remove(key)
+				dropped++
+			}
+		}
+	}
+
+	logWith("duration", time.Since(start).Round(time.Millisecond), "entries", len(seen), "verified", verified,
+		"quarantined", quarantined, "temp_removed", tempRemoved, "stale_dropped", dropped).Info("🔍 Cache scan finished")
+}
+
+// ==================== END CACHE INTEGRITY ====================
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== CACHE RULES ====================
+//
+// Cache rules (cache.rules) decide which upstream paths are cached and how: the
+// first rule whose regex matches the path after /api/mapy/ applies. Each rule
+// has its own TTL, an optional cap on its share of max_size_mb, and decides
+// whether query params are part of the cache key. Paths no rule matches are
+// proxied without caching.
+
+// CacheRule is one cache policy from YAML
+type CacheRule struct {
+	Name         string  `yaml:"name"`
+	Path         string  `yaml:"path"`           // Regex matched against the path after /api/mapy/
+	TTLDays      int     `yaml:"ttl_days"`       // 0 uses cache.ttl_days
+	MaxSizeShare float64 `yaml:"max_size_share"` // Fraction of max_size_mb the rule's entries may use, 0 = no cap
+	IncludeQuery *bool   `yaml:"include_query"`  // Query params (except apikey) are part of the key (default: true)
+}
+
+// Default cache rules - the tile endpoints the game loads in bulk
+var DefaultCacheRules = []CacheRule{
+	{Name: "maptiles", Path: `^v1/maptiles/`},                         // Map tiles
+	{Name: "panorama-tiles", Path: `^v1/panorama/tiles/`},             // Panorama tiles (actual format!)
+	{Name: "panorama-thumbnails", Path: `^v1/panorama/\d+/thumbnail`}, // Panorama thumbnails
+}
+
+// cacheRule is a compiled cache rule with its counters
+type cacheRule struct {
+	CacheRule
+	pattern    *regexp.Regexp
+	defaultTTL int // cache.ttl_days, for rules without their own TTL
+
+	hits   uint64
+	misses uint64
+}
+
+// compileCacheRules validates and compiles rules from the config. Rules
+// without a TTL of their own use ttlDays.
+func compileCacheRules(rules []CacheRule, ttlDays int) ([]*cacheRule, error) {
+	compiled := make([]*cacheRule, 0, len(rules))
+	names := make(map[string]bool)
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate cache rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+
+		pattern, err := regexp.Compile(rule.Path)
+		if err != nil || rule.Path == "" {
+			return nil, fmt.Errorf("cache rule %q: invalid path regex %q", rule.Name, rule.Path)
+		}
+		if rule.TTLDays < 0 {
+			return nil, fmt.Errorf("cache rule %q: ttl_days must not be negative", rule.Name)
+		}
+		if rule.MaxSizeShare < 0 || rule.MaxSizeShare > 1 {
+			return nil, fmt.Errorf("cache rule %q: max_size_share must be between 0 and 1", rule.Name)
+		}
+		compiled = append(compiled, &cacheRule{CacheRule: rule, pattern: pattern, defaultTTL: ttlDays})
+	}
+	return compiled, nil
+}
+
+// mustCompileCacheRules compiles the built-in defaults
+func mustCompileCacheRules(rules []CacheRule, ttlDays int) []*cacheRule {
+	compiled, err := compileCacheRules(rules, ttlDays)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+// cacheRuleList returns the cache's current rules
+func (c *tileCache) cacheRuleList() []*cacheRule {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.rules
+}
+
+// matchCacheRule returns the rule caching a request path, or nil if it isn't cacheable
+func (c *tileCache) matchCacheRule(path string) *cacheRule {
+	for _, rule := range c.cacheRuleList() {
+		if rule.pattern.MatchString(path) {
+			logDebug("✅ Cacheable (%s): %s", rule.Name, path)
+			return rule
+		}
+	}
+	logDebug("❌ Not cacheable: %s", path)
+	return nil
+}
+
+// findCacheRule looks a rule up by name
+func (c *tileCache) findCacheRule(name string) *cacheRule {
+	for _, rule := range c.cacheRuleList() {
+		if rule.Name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+// ttlDays returns the rule's TTL, falling back to cache.ttl_days
+func (r *cacheRule) ttlDays() int {
+	if r.TTLDays == 0 {
+		return r.defaultTTL
+	}
+	return r.TTLDays
+}
+
+// maxAge returns how long the rule's entries stay fresh
+func (r *cacheRule) maxAge() time.Duration {
+	return time.Duration(r.ttlDays()) * 24 * time.Hour
+}
+
+// includeQuery reports whether query params are part of the rule's cache keys
+func (r *cacheRule) includeQuery() bool {
+	return r == nil || r.IncludeQuery == nil || *r.IncludeQuery
+}
+
+// name returns the rule name recorded in the index
+func (r *cacheRule) name() string {
+	if r == nil {
+		return ""
+	}
+	return r.Name
+}
+
+// cacheRuleMaxAge returns the maximum age of entries indexed under a rule name.
+// Entries of unknown or removed rules use the global TTL.
+func (c *tileCache) cacheRuleMaxAge(name string) time.Duration {
+	if rule := c.findCacheRule(name); rule != nil {
+		return rule.maxAge()
+	}
+	return time.Duration(c.settings().TTLDays) * 24 * time.Hour
+}
+
+// countHit records a cache hit for the rule
+func (r *cacheRule) countHit() {
+	if r != nil {
+		atomic.AddUint64(&r.hits, 1)
+	}
+}
+
+// countMiss records a cache miss for the rule
+func (r *cacheRule) countMiss() {
+	if r != nil {
+		atomic.AddUint64(&r.misses, 1)
+	}
+}
+
+// enforceCacheRuleShares evicts least recently used entries of rules over
+// their max_size_share
+func (c *tileCache) enforceCacheRuleShares() (int, int64) {
+	maxSizeMB := c.settings().MaxSizeMB
+	var count int
+	var freed int64
+	for _, rule := range c.cacheRuleList() {
+		if rule.MaxSizeShare <= 0 {
+			continue
+		}
+		limit := int64(rule.MaxSizeShare * float64(maxSizeMB) * 1024 * 1024)
+		evicted, size := c.idx.TakeRuleLRU(rule.Name, limit)
+		for _, key := range evicted {
+			c.removeCacheEntry(key)
+		}
+		count += len(evicted)
+		freed += size
+	}
+	return count, freed
+}
+
+// cacheRuleStats describes a rule for /api/cache
+type cacheRuleStats struct {
+	Name         string  `json:"name"`
+	Path         string  `json:"path"`
+	TTLDays      int     `json:"ttl_days"`
+	MaxSizeShare float64 `json:"max_size_share"`
+	IncludeQuery bool    `json:"include_query"`
+	Hits         uint64  `json:"hits"`
+	Misses       uint64  `json:"misses"`
+	Entries      int     `json:"entries"`
+	SizeBytes    int64   `json:"size_bytes"`
+}
+
+// getCacheRuleStats returns counters and index usage per rule
+func (c *tileCache) getCacheRuleStats() []cacheRuleStats {
+	var usage map[string]cacheRuleUsage
+	if c.idx != nil {
+		usage = c.idx.RuleUsage()
+	}
+
+	rules := c.cacheRuleList()
+	stats := make([]cacheRuleStats, 0, len(rules))
+	for _, rule := range rules {
+		stats = append(stats, cacheRuleStats{
+			Name:         rule.Name,
+			Path:         rule.Path,
+			TTLDays:      rule.ttlDays(),
+			MaxSizeShare: rule.MaxSizeShare,
+			IncludeQuery: rule.includeQuery(),
+			Hits:         atomic.LoadUint64(&rule.hits),
+			Misses:       atomic.LoadUint64(&rule.misses),
+			Entries:      usage[rule.Name].Entries,
+			SizeBytes:    usage[rule.Name].Size,
+		})
+	}
+	return stats
+}
+
+// resetCacheRuleCounters zeroes the per-rule hit/miss counters
+func (c *tileCache) resetCacheRuleCounters() {
+	for _, rule := range c.cacheRuleList() {
+		atomic.StoreUint64(&rule.hits, 0)
+		atomic.StoreUint64(&rule.misses, 0)
+	}
+}
+
+// ==================== END CACHE RULES ====================
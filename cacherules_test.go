@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCacheRulesMatchPathsAndTTLs(t *testing.T) {
+	noQuery := false
+	rules, err := compileCacheRules([]CacheRule{
+		{Name: "tiles", Path: `^v1/maptiles/`, TTLDays: 30},
+		{Name: "search", Path: `^v1/suggest$`, TTLDays: 1, IncludeQuery: &noQuery},
+		{Path: `^v1/panorama/`}, // Unnamed, default TTL
+	}, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTileCache(CacheConfig{TTLDays: 90}, rules)
+
+	tests := []struct {
+		path   string
+		rule   string
+		maxAge time.Duration
+	}{
+		{"v1/maptiles/basic/256/10/550/300", "tiles", 30 * 24 * time.Hour},
+		{"v1/suggest", "search", 24 * time.Hour},
+		{"v1/panorama/tiles/1/2", "rule-3", 90 * 24 * time.Hour},
+		{"v1/suggest/more", "", 0},
+		{"x/v1/maptiles/basic", "", 0},
+	}
+	for _, tt := range tests {
+		rule := c.matchCacheRule(tt.path)
+		if rule.name() != tt.rule {
+			t.Errorf("%s: rule = %q, want %q", tt.path, rule.name(), tt.rule)
+			continue
+		}
+		if rule != nil && rule.maxAge() != tt.maxAge {
+			t.Errorf("%s: max age = %v, want %v", tt.path, rule.maxAge(), tt.maxAge)
+		}
+	}
+
+	// Entries indexed under removed rules expire with the global TTL
+	if got := c.cacheRuleMaxAge("gone"); got != 90*24*time.Hour {
+		t.Errorf("max age of an unknown rule = %v, want 90 days", got)
+	}
+
+	// include_query: false shares one entry between queries
+	search := c.findCacheRule("search")
+	if getCacheKey("v1/suggest", url.Values{"query": {"a"}}, search) != getCacheKey("v1/suggest", url.Values{"query": {"b"}}, search) {
+		t.Error("rule without include_query keys queries apart")
+	}
+	tiles := c.findCacheRule("tiles")
+	if getCacheKey("v1/maptiles/x", url.Values{"lang": {"cs"}}, tiles) == getCacheKey("v1/maptiles/x", url.Values{"lang": {"en"}}, tiles) {
+		t.Error("rule with include_query shares entries between queries")
+	}
+	if getCacheKey("v1/maptiles/x", url.Values{"apikey": {"a"}}, tiles) != getCacheKey("v1/maptiles/x", nil, tiles) {
+		t.Error("the API key is part of the cache key")
+	}
+}
+
+func TestCacheRulesRejectInvalidRules(t *testing.T) {
+	for name, rules := range map[string][]CacheRule{
+		"duplicate name": {{Name: "a", Path: "^x"}, {Name: "a", Path: "^y"}},
+		"empty path":     {{Name: "a"}},
+		"bad regex":      {{Name: "a", Path: "("}},
+		"negative TTL":   {{Name: "a", Path: "^x", TTLDays: -1}},
+		"share over 1":   {{Name: "a", Path: "^x", MaxSizeShare: 1.5}},
+	} {
+		if _, err := compileCacheRules(rules, 90); err == nil {
+			t.Errorf("%s: compiled", name)
+		}
+	}
+}
+
+func TestCacheRuleTTLSetsMaxAge(t *testing.T) {
+	_, upstreamURL := newMockUpstreamServer(t, nil)
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Proxy.UpstreamURL = upstreamURL
+		cfg.APIKeys = []map[string]string{{"good": "good"}}
+		cfg.Cache.Rules = []CacheRule{{Name: "tiles", Path: `^v1/maptiles/`, TTLDays: 2}}
+	})
+
+	const tile = "/api/mapy/v1/maptiles/basic/256/10/590/300"
+	get(s, tile, nil)
+	rec := get(s, tile, nil)
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Cache-Control") != "public, max-age=172800" {
+		t.Errorf("X-Cache = %q, Cache-Control = %q, want a HIT with max-age=172800", rec.Header().Get("X-Cache"), rec.Header().Get("Cache-Control"))
+	}
+
+	// Older than the rule's TTL: refetched, not served
+	key := getCacheKey("v1/maptiles/basic/256/10/590/300", url.Values{}, s.cache.matchCacheRule("v1/maptiles/basic/256/10/590/300"))
+	if err := s.cache.store.Touch(key, time.Now().Add(-3*24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(s, tile, nil); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") == "HIT" {
+		t.Errorf("expired entry: status = %d, X-Cache = %q, want it refetched", rec.Code, rec.Header().Get("X-Cache"))
+	}
+}
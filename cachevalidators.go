@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ==================== CACHE VALIDATORS ====================
+//
+// Cached entries carry an ETag (upstream's, or a hash of the content) and a
+// Last-Modified header, so browsers can revalidate with If-None-Match /
+// If-Modified-Since and get a 304 instead of the whole tile. When upstream sent
+// its own validators they are also kept as internal metadata; expired entries
+// that have them are revalidated upstream instead of being dropped at TTL.
+
+const (
+	cacheMetaRevalidateETag         = "@revalidate-etag"
+	cacheMetaRevalidateLastModified = "@revalidate-last-modified"
+)
+
+// hasRevalidators reports whether an entry can be revalidated upstream
+func hasRevalidators(internal map[string]string) bool {
+	return internal[cacheMetaRevalidateETag] != "" || internal[cacheMetaRevalidateLastModified] != ""
+}
+
+// readCacheInternal returns the internal metadata fields of an entry
+func (c *tileCache) readCacheInternal(cacheKey string) (map[string]string, bool) {
+	entry, err := c.store.Get(cacheKey)
+	if err != nil {
+		return nil, false
+	}
+	_, internal := parseCacheMeta(entry.Meta)
+	return internal, true
+}
+
+// staleCacheValidators returns conditional request headers for revalidating an
+// expired entry upstream, or an empty header when there is nothing to revalidate
+func (c *tileCache) staleCacheValidators(cacheKey string) http.Header {
+	conditional := http.Header{}
+	internal, ok := c.readCacheInternal(cacheKey)
+	if !ok {
+		return conditional
+	}
+	if etag := internal[cacheMetaRevalidateETag]; etag != "" {
+		conditional.Set("If-None-Match", etag)
+	}
+	if lastModified := internal[cacheMetaRevalidateLastModified]; lastModified != "" {
+		conditional.Set("If-Modified-Since", lastModified)
+	}
+	return conditional
+}
+
+// refreshCacheEntry restarts an entry's TTL after upstream confirmed it is unchanged
+func (c *tileCache) refreshCacheEntry(cacheKey string) error {
+	now := time.Now()
+	if err := c.store.Touch(cacheKey, now); err != nil {
+		return err
+	}
+	if c.idx != nil {
+		c.idx.Refresh(cacheKey, now)
+	}
+	if c.mem != nil {
+		c.mem.Remove(cacheKey)
+	}
+	return nil
+}
+
+// etagMatches implements the weak comparison used for If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// isNotModified checks a request's conditional headers against a cached entry's validators
+func isNotModified(r *http.Request, headers map[string]string) bool {
+	// If-None-Match takes precedence over If-Modified-Since (RFC 9110 13.2.2)
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, headers["ETag"])
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || headers["Last-Modified"] == "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(headers["Last-Modified"])
+	if err != nil {
+		return false
+	}
+	return !modified.After(since)
+}
+
+// ==================== END CACHE VALIDATORS ====================
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ==================== CONFIGURATION ====================
+//
+// Every setting has one place in the Config schema and is taken, from lowest
+// to highest precedence, from its default, the YAML config file, an env var and
+// a command-line flag. Env var and flag names derive from the YAML path:
+// cache.ttl_days is GDE_CACHE_TTL_DAYS and -cache.ttl_days. Lists take
+// comma-separated values. API keys, cache rules and object store headers are
+// YAML-only, except MAPY_API_KEYS (comma-separated keys used when the YAML
+// has none). PORT, LOG_LEVEL, LOG_FORMAT and SHUTDOWN_TIMEOUT still work as aliases.
+//
+//	server [flags]                   run the server
+//	server config validate [flags]   report config problems, exit 1 if there are any
+//	server config print [flags]      print the effective config with secrets redacted
+
+// Server, multiplayer and logging defaults
+const (
+	DefaultServerPort         = 8000
+	DefaultShutdownTimeoutSec = 30   // Drain time for running rounds
+	DefaultMaxSessions        = 1000 // Open multiplayer sessions
+	DefaultMaxPlayers         = 16   // Players per session
+	DefaultGuessTimerSec      = 10   // Time left for the others after the first guess
+	DefaultMaxMessageKB       = 1024 // Custom region polygons make setup messages large
+	DefaultLogLevel           = "INFO"
+)
+
+// ServerConfig holds HTTP server settings
+type ServerConfig struct {
+	Host                   string          `yaml:"host"` // Listen address, empty for all interfaces
+	Port                   int             `yaml:"port"`
+	ShutdownTimeoutSeconds *int            `yaml:"shutdown_timeout_seconds"` // 0 stops without waiting for rounds (see shutdown.go)
+	TLS                    ServerTLSConfig `yaml:"tls"`
+	CORSOrigins            []string        `yaml:"cors_origins"` // Origins allowed to call the API, "*" for any, none by default (see middleware.go)
+	StaticDir              string          `yaml:"static_dir"`   // Serve the frontend from here instead of the embedded copy (see static.go)
+}
+
+// ServerTLSConfig holds HTTPS settings (see tls.go)
+type ServerTLSConfig struct {
+	CertFile     string `yaml:"cert_file"`     // PEM certificate chain; HTTPS is on when set
+	KeyFile      string `yaml:"key_file"`      // PEM private key
+	RedirectPort int    `yaml:"redirect_port"` // Plain HTTP port redirecting to HTTPS, 0 disables
+}
+
+// MultiplayerConfig holds multiplayer limits
+type MultiplayerConfig struct {
+	MaxSessions       int `yaml:"max_sessions"` // Negative for no limit
+	MaxPlayers        int `yaml:"max_players"`  // Per session, negative for no limit
+	GuessTimerSeconds int `yaml:"guess_timer_seconds"`
+	MaxMessageKB      int `yaml:"max_message_kb"` // Larger WebSocket messages close the connection
+}
+
+// LoggingConfig holds log settings (see logging.go)
+type LoggingConfig struct {
+	Level  string `yaml:"level"`  // DEBUG, INFO, WARN or ERROR
+	Format string `yaml:"format"` // text or json
+}
+
+// Legacy env var names and the settings they set. The GDE_ names win.
+var configEnvAliases = []struct{ env, path string }{
+	{"PORT", "server.port"},
+	{"SHUTDOWN_TIMEOUT", "server.shutdown_timeout_seconds"},
+	{"LOG_LEVEL", "logging.level"},
+	{"LOG_FORMAT", "logging.format"},
+}
+
+// configEnvName returns the env var of a setting
+func configEnvName(path string) string {
+	return "GDE_" + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// configField is a setting env vars and flags can set
+type configField struct {
+	path  string
+	value reflect.Value // Settable field of a Config
+}
+
+// configFields lists the settings of config that env vars and flags can set:
+// scalars and string lists, in schema order
+func configFields(config *Config) []configField {
+	var fields []configField
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if !field.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			kind := field.Type.Kind()
+			if kind == reflect.Pointer {
+				kind = field.Type.Elem().Kind()
+			}
+			switch kind {
+			case reflect.Struct:
+				walk(name, v.Field(i))
+			case reflect.String, reflect.Int, reflect.Float64, reflect.Bool:
+				fields = append(fields, configField{name, v.Field(i)})
+			case reflect.Slice:
+				if field.Type.Elem().Kind() == reflect.String {
+					fields = append(fields, configField{name, v.Field(i)})
+				}
+			}
+		}
+	}
+	walk("", reflect.ValueOf(config).Elem())
+	return fields
+}
+
+// set parses raw into the setting
+func (f configField) set(raw string) error {
+	v := f.value
+	if v.Kind() == reflect.Pointer {
+		v.Set(reflect.New(v.Type().Elem()))
+		v = v.Elem()
+	}
+	raw = strings.TrimSpace(raw)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", raw)
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", raw)
+		}
+		v.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", raw)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	}
+	return nil
+}
+
+// configFlags registers -config and a flag per setting. The returned map
+// collects the settings given on the command line, by path.
+func configFlags(fs *flag.FlagSet) (*string, map[string]string) {
+	file := fs.String("config", "", "config file (default: settings.yaml, falling back to api_keys.yaml)")
+	values := make(map[string]string)
+	for _, field := range configFields(&Config{}) {
+		path := field.path
+		usage := "sets " + path + " (env " + configEnvName(path) + ")"
+		set := func(value string) error {
+			values[path] = value
+			return nil
+		}
+		if field.value.Kind() == reflect.Bool {
+			fs.BoolFunc(path, usage, set) // -path alone means true
+		} else {
+			fs.Func(path, usage, set)
+		}
+	}
+	return file, values
+}
+
+// readConfigFile reads the config file. Without an explicit file it tries
+// settings.yaml, then api_keys.yaml; having neither is fine when the keys come
+// from the environment.
+func readConfigFile(file string) ([]byte, string, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		return data, file, err
+	}
+	for _, name := range []string{"settings.yaml", "api_keys.yaml"} {
+		data, err := os.ReadFile(name)
+		if err == nil {
+			return data, name, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, name, err
+		}
+	}
+	return nil, "", nil
+}
+
+// loadConfig reads the config file and applies env var and flag overrides.
+// flags maps setting paths to command-line values; both are kept in the
+// Config so a reload applies them again.
+func loadConfig(file string, flags map[string]string) (Config, error) {
+	config := Config{file: file, flags: flags}
+	data, source, err := readConfigFile(file)
+	if err != nil {
+		return config, err
+	}
+	if data != nil {
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return config, fmt.Errorf("%s: %v", source, err)
+		}
+		config.source = source
+	}
+
+	fields := make(map[string]configField)
+	for _, field := range configFields(&config) {
+		fields[field.path] = field
+	}
+	override := func(path, value, from string) error {
+		if err := fields[path].set(value); err != nil {
+			return fmt.Errorf("%s: %v", from, err)
+		}
+		// Only the winning source is listed
+		for i, o := range config.overrides {
+			if strings.HasPrefix(o, path+" (") {
+				config.overrides = append(config.overrides[:i], config.overrides[i+1:]...)
+				break
+			}
+		}
+		config.overrides = append(config.overrides, path+" ("+from+")")
+		return nil
+	}
+
+	// Env vars, legacy aliases first so the GDE_ names win
+	for _, alias := range configEnvAliases {
+		if value := os.Getenv(alias.env); value != "" {
+			if err := override(alias.path, value, alias.env); err != nil {
+				return config, err
+			}
+		}
+	}
+	for _, field := range configFields(&config) {
+		env := configEnvName(field.path)
+		if value := os.Getenv(env); value != "" {
+			if err := override(field.path, value, env); err != nil {
+				return config, err
+			}
+		}
+	}
+	if keysEnv := os.Getenv("MAPY_API_KEYS"); keysEnv != "" && len(config.APIKeys) == 0 {
+		for i, key := range strings.Split(keysEnv, ",") {
+			config.APIKeys = append(config.APIKeys, map[string]string{
+				fmt.Sprintf("env-%d", i+1): strings.TrimSpace(key),
+			})
+		}
+		config.overrides = append(config.overrides, "api_keys (MAPY_API_KEYS)")
+	}
+
+	// Flags
+	paths := make([]string, 0, len(flags))
+	for path := range flags {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if _, ok := fields[path]; !ok {
+			return config, fmt.Errorf("unknown setting -%s", path)
+		}
+		if err := override(path, flags[path], "-"+path); err != nil {
+			return config, err
+		}
+	}
+
+	return config, nil
+}
+
+// keyList returns the configured API keys in pool order
+func (config Config) keyList() []APIKey {
+	var keys []APIKey
+	for _, keyMap := range config.APIKeys {
+		for id, value := range keyMap {
+			keys = append(keys, APIKey{
+				ID:    id,
+				Value: value,
+			})
+		}
+	}
+	return keys
+}
+
+// configIssues collects problems found in a config
+type configIssues []string
+
+func (issues *configIssues) add(format string, args ...interface{}) {
+	*issues = append(*issues, fmt.Sprintf(format, args...))
+}
+
+// resolvedConfig is a Config with defaults applied, invalid values replaced by
+// their defaults, and rules and allowlist compiled
+type resolvedConfig struct {
+	Config
+	cacheRules    []*cacheRule
+	allowPatterns []*regexp.Regexp
+	issues        configIssues // What was invalid, for logging or `config validate`
+}
+
+// resolve applies the defaults to every section of config
+func (config Config) resolve() resolvedConfig {
+	rc := resolvedConfig{Config: config}
+	rc.Server = resolveServerConfig(config, &rc.issues)
+	rc.Logging = resolveLoggingConfig(config, &rc.issues)
+	rc.Cache, rc.cacheRules = resolveCacheConfig(config, &rc.issues)
+	rc.Proxy, rc.allowPatterns = resolveProxyConfig(config, &rc.issues)
+	rc.Multiplayer = resolveMultiplayerConfig(config, &rc.issues)
+	return rc
+}
+
+// setPositive applies a setting that must be positive over its default
+func setPositive(issues *configIssues, path string, value int, target *int) {
+	if value > 0 {
+		*target = value
+	} else if value < 0 {
+		issues.add("%s must not be negative, using %d", path, *target)
+	}
+}
+
+// resolveServerConfig applies the server settings over the defaults
+func resolveServerConfig(config Config, issues *configIssues) ServerConfig {
+	serverConfig := ServerConfig{Host: config.Server.Host, Port: DefaultServerPort}
+	if port := config.Server.Port; port != 0 {
+		if port < 1 || port > 65535 {
+			issues.add("server.port %d is out of range, using %d", port, serverConfig.Port)
+		} else {
+			serverConfig.Port = port
+		}
+	}
+	timeout := DefaultShutdownTimeoutSec
+	if t := config.Server.ShutdownTimeoutSeconds; t != nil {
+		if *t < 0 {
+			issues.add("server.shutdown_timeout_seconds must not be negative, using %d", timeout)
+		} else {
+			timeout = *t
+		}
+	}
+	serverConfig.ShutdownTimeoutSeconds = &timeout
+
+	// Same-origin only unless origins (or "*") are listed
+	serverConfig.CORSOrigins = config.Server.CORSOrigins
+	for _, origin := range serverConfig.CORSOrigins {
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+			issues.add("server.cors_origins entry %q is not an origin like https://example.com", origin)
+		}
+	}
+
+	if dir := config.Server.StaticDir; dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			issues.add("server.static_dir %s is not a directory, serving the embedded frontend", dir)
+		} else {
+			serverConfig.StaticDir = dir
+		}
+	}
+
+	serverConfig.TLS = config.Server.TLS
+	if (serverConfig.TLS.CertFile == "") != (serverConfig.TLS.KeyFile == "") {
+		issues.add("server.tls.cert_file and server.tls.key_file must be set together")
+	}
+	if port := serverConfig.TLS.RedirectPort; port != 0 {
+		if !serverConfig.TLS.enabled() {
+			issues.add("server.tls.redirect_port needs HTTPS, not redirecting")
+			serverConfig.TLS.RedirectPort = 0
+		} else if port < 0 || port > 65535 || port == serverConfig.Port {
+			issues.add("server.tls.redirect_port %d is out of range or the HTTPS port, not redirecting", port)
+			serverConfig.TLS.RedirectPort = 0
+		}
+	}
+	return serverConfig
+}
+
+// resolveLoggingConfig applies the logging settings over the defaults
+func resolveLoggingConfig(config Config, issues *configIssues) LoggingConfig {
+	loggingConfig := LoggingConfig{Level: DefaultLogLevel, Format: LogFormatText}
+	switch level := strings.ToUpper(config.Logging.Level); level {
+	case "":
+	case "DEBUG", "INFO", "WARN", "ERROR":
+		loggingConfig.Level = level
+	case "WARNING":
+		loggingConfig.Level = "WARN"
+	default:
+		issues.add("Unknown logging.level '%s', using %s", config.Logging.Level, loggingConfig.Level)
+	}
+	switch format := strings.ToLower(config.Logging.Format); format {
+	case "":
+	case LogFormatText, LogFormatJSON:
+		loggingConfig.Format = format
+	default:
+		issues.add("Unknown logging.format '%s', using %s", config.Logging.Format, loggingConfig.Format)
+	}
+	return loggingConfig
+}
+
+// resolveCacheConfig applies the cache settings over the defaults and compiles
+// the cache rules
+func resolveCacheConfig(config Config, issues *configIssues) (CacheConfig, []*cacheRule) {
+	cacheConfig := defaultCacheConfig
+
+	setPositive(issues, "cache.ttl_days", config.Cache.TTLDays, &cacheConfig.TTLDays)
+	setPositive(issues, "cache.max_size_mb", config.Cache.MaxSizeMB, &cacheConfig.MaxSizeMB)
+	if config.Cache.Dir != "" {
+		cacheConfig.Dir = config.Cache.Dir
+	}
+	setPositive(issues, "cache.cleanup_hours", config.Cache.CleanupHours, &cacheConfig.CleanupHours)
+	if config.Cache.MemoryMB != 0 {
+		cacheConfig.MemoryMB = config.Cache.MemoryMB
+	}
+	switch config.Cache.StartupScan {
+	case "":
+	case CacheScanOff, CacheScanQuick, CacheScanFull:
+		cacheConfig.StartupScan = config.Cache.StartupScan
+	default:
+		issues.add("Unknown cache.startup_scan '%s', using %s", config.Cache.StartupScan, cacheConfig.StartupScan)
+	}
+	switch config.Cache.Compression {
+	case "":
+	case CacheCompressionGzip, CacheCompressionOff:
+		cacheConfig.Compression = config.Cache.Compression
+	case "zstd":
+		issues.add("cache.compression 'zstd' is not supported (use gzip or off), using %s", cacheConfig.Compression)
+	default:
+		issues.add("Unknown cache.compression '%s', using %s", config.Cache.Compression, cacheConfig.Compression)
+	}
+	switch config.Cache.Backend {
+	case "":
+	case CacheBackendDisk, CacheBackendKV, CacheBackendObject:
+		cacheConfig.Backend = config.Cache.Backend
+	default:
+		issues.add("Unknown cache.backend '%s', using %s", config.Cache.Backend, cacheConfig.Backend)
+	}
+	rules := mustCompileCacheRules(DefaultCacheRules, cacheConfig.TTLDays)
+	if len(config.Cache.Rules) > 0 {
+		if compiled, err := compileCacheRules(config.Cache.Rules, cacheConfig.TTLDays); err != nil {
+			issues.add("Invalid cache.rules, using defaults: %v", err)
+		} else {
+			cacheConfig.Rules = config.Cache.Rules
+			rules = compiled
+		}
+	}
+	cacheConfig.KV = config.Cache.KV
+	cacheConfig.ObjectStore = config.Cache.ObjectStore
+
+	return cacheConfig, rules
+}
+
+// resolveProxyConfig applies the proxy settings over the defaults and compiles
+// the path allowlist
+func resolveProxyConfig(config Config, issues *configIssues) (ProxyConfig, []*regexp.Regexp) {
+	proxyConfig := defaultProxyConfig
+
+	if config.Proxy.UpstreamURL != "" {
+		if u, err := url.Parse(config.Proxy.UpstreamURL); err != nil || u.Scheme == "" || u.Host == "" {
+			issues.add("Invalid proxy.upstream_url %q, using %s", config.Proxy.UpstreamURL, proxyConfig.UpstreamURL)
+		} else {
+			proxyConfig.UpstreamURL = config.Proxy.UpstreamURL
+		}
+	}
+	setPositive(issues, "proxy.timeout_seconds", config.Proxy.TimeoutSeconds, &proxyConfig.TimeoutSeconds)
+	setPositive(issues, "proxy.idle_timeout_seconds", config.Proxy.IdleTimeoutSeconds, &proxyConfig.IdleTimeoutSeconds)
+	setPositive(issues, "proxy.max_response_mb", config.Proxy.MaxResponseMB, &proxyConfig.MaxResponseMB)
+	proxyConfig.TLS = config.Proxy.TLS
+	if len(config.Proxy.AllowedPaths) > 0 {
+		proxyConfig.AllowedPaths = config.Proxy.AllowedPaths
+	}
+	allowPatterns := compilePathPatterns(proxyConfig.AllowedPaths, issues)
+	if len(config.Proxy.AllowedMethods) > 0 {
+		proxyConfig.AllowedMethods = config.Proxy.AllowedMethods
+	}
+	if config.Proxy.RateLimit.RequestsPerSecond != 0 {
+		// Negative disables the limiter
+		proxyConfig.RateLimit.RequestsPerSecond = config.Proxy.RateLimit.RequestsPerSecond
+	}
+	setPositive(issues, "proxy.rate_limit.burst", config.Proxy.RateLimit.Burst, &proxyConfig.RateLimit.Burst)
+	proxyConfig.RateLimit.TrustProxyHeaders = config.Proxy.RateLimit.TrustProxyHeaders
+
+	return proxyConfig, allowPatterns
+}
+
+// resolveMultiplayerConfig applies the multiplayer limits over the defaults
+func resolveMultiplayerConfig(config Config, issues *configIssues) MultiplayerConfig {
+	multiplayerConfig := MultiplayerConfig{
+		MaxSessions:       DefaultMaxSessions,
+		MaxPlayers:        DefaultMaxPlayers,
+		GuessTimerSeconds: DefaultGuessTimerSec,
+		MaxMessageKB:      DefaultMaxMessageKB,
+	}
+	if config.Multiplayer.MaxSessions != 0 {
+		multiplayerConfig.MaxSessions = config.Multiplayer.MaxSessions
+	}
+	if config.Multiplayer.MaxPlayers != 0 {
+		multiplayerConfig.MaxPlayers = config.Multiplayer.MaxPlayers
+	}
+	setPositive(issues, "multiplayer.guess_timer_seconds", config.Multiplayer.GuessTimerSeconds, &multiplayerConfig.GuessTimerSeconds)
+	setPositive(issues, "multiplayer.max_message_kb", config.Multiplayer.MaxMessageKB, &multiplayerConfig.MaxMessageKB)
+	return multiplayerConfig
+}
+
+// logSummary logs where the config came from, its problems and the main settings
+func (rc resolvedConfig) logSummary() {
+	source := rc.source
+	if source == "" {
+		source = "no config file"
+	}
+	logInfo("📄 Config: %s", source)
+	if len(rc.overrides) > 0 {
+		logInfo("📄 Overridden: %s", strings.Join(rc.overrides, ", "))
+	}
+	for _, issue := range rc.issues {
+		logWarn("⚠️  %s", issue)
+	}
+	if keys := len(rc.keyList()); keys > 0 {
+		logWith("keys", keys).Info("🔑 API keys configured")
+	} else {
+		logWarn("No API keys found. Set MAPY_API_KEYS or api_keys in settings.yaml")
+	}
+	logInfo("📦 Cache config: TTL=%d days, MaxSize=%dMB, Dir=%s, Cleanup=%dh, Memory=%dMB, Backend=%s, Compression=%s",
+		rc.Cache.TTLDays, rc.Cache.MaxSizeMB, rc.Cache.Dir, rc.Cache.CleanupHours, rc.Cache.MemoryMB, rc.Cache.Backend, rc.Cache.Compression)
+	logInfo("🌐 Proxy config: Upstream=%s, Timeout=%ds, VerifyTLS=%t, AllowedPaths=%d, Methods=%s, RateLimit=%.1f/s",
+		rc.Proxy.UpstreamURL, rc.Proxy.TimeoutSeconds, !rc.Proxy.TLS.InsecureSkipVerify,
+		len(rc.allowPatterns), strings.Join(rc.Proxy.AllowedMethods, ","), rc.Proxy.RateLimit.RequestsPerSecond)
+	logInfo("🎮 Multiplayer config: MaxSessions=%d, MaxPlayers=%d, GuessTimer=%ds",
+		rc.Multiplayer.MaxSessions, rc.Multiplayer.MaxPlayers, rc.Multiplayer.GuessTimerSeconds)
+}
+
+// validate lists every problem with the config: invalid values, unknown YAML
+// keys and missing settings
+func (rc resolvedConfig) validate() []string {
+	problems := append([]string{}, rc.issues...)
+
+	// Unknown keys are ignored at runtime, which hides typos
+	if data, source, err := readConfigFile(rc.file); err == nil && data != nil {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&Config{}); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", source, err))
+		}
+	}
+
+	if len(rc.keyList()) == 0 {
+		problems = append(problems, "No API keys configured (api_keys or MAPY_API_KEYS)")
+	}
+	for _, key := range rc.keyList() {
+		if strings.TrimSpace(key.Value) == "" {
+			problems = append(problems, fmt.Sprintf("API key %s is empty", key.ID))
+		}
+	}
+	if (rc.Admin.Username == "") != (rc.Admin.Password == "") {
+		problems = append(problems, "admin.username and admin.password must be set together")
+	}
+	if tlsConfig := rc.Server.TLS; tlsConfig.CertFile != "" && tlsConfig.KeyFile != "" {
+		if _, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile); err != nil {
+			problems = append(problems, fmt.Sprintf("server.tls: %v", err))
+		}
+	}
+	if rc.Proxy.TLS.CAFile != "" {
+		if _, err := os.Stat(rc.Proxy.TLS.CAFile); err != nil {
+			problems = append(problems, fmt.Sprintf("proxy.tls.ca_file: %v", err))
+		}
+	}
+	return problems
+}
+
+// redacted returns the config with secrets replaced, for printing
+func (config Config) redacted() Config {
+	const mask = "<redacted>"
+	redact := func(value string) string {
+		if value == "" {
+			return ""
+		}
+		return mask
+	}
+
+	keys := make([]map[string]string, 0, len(config.APIKeys))
+	for _, keyMap := range config.APIKeys {
+		masked := make(map[string]string, len(keyMap))
+		for id, value := range keyMap {
+			masked[id] = redact(value)
+		}
+		keys = append(keys, masked)
+	}
+	config.APIKeys = keys
+
+	config.Admin.Token = redact(config.Admin.Token)
+	config.Admin.Password = redact(config.Admin.Password)
+	config.Cache.ObjectStore.SecretAccessKey = redact(config.Cache.ObjectStore.SecretAccessKey)
+	if headers := config.Cache.ObjectStore.Headers; headers != nil {
+		masked := make(map[string]string, len(headers))
+		for name, value := range headers {
+			masked[name] = redact(value)
+		}
+		config.Cache.ObjectStore.Headers = masked
+	}
+	return config
+}
+
+// mustLoadConfig loads the config and sets up logging from it, exiting on
+// errors. They go to stderr directly since logging isn't set up yet.
+func mustLoadConfig(file string, flags map[string]string) Config {
+	config, err := loadConfig(file, flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	setupLogging(config.resolve().Logging)
+	return config
+}
+
+// runConfigCommand implements `server config validate|print [flags]`
+func runConfigCommand(args []string) {
+	usage := "usage: server config validate|print [-config file] [-<setting> value ...]"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command := args[0]
+
+	fs := flag.NewFlagSet("config "+command, flag.ExitOnError)
+	file, flags := configFlags(fs)
+	fs.Parse(args[1:])
+
+	config, err := loadConfig(*file, flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	rc := config.resolve()
+
+	switch command {
+	case "validate":
+		problems := rc.validate()
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "❌ %s\n", problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		source := rc.source
+		if source == "" {
+			source = "environment"
+		}
+		fmt.Printf("✅ Config OK (%s)\n", source)
+
+	case "print":
+		for _, issue := range rc.issues {
+			fmt.Fprintf(os.Stderr, "⚠️  %s\n", issue)
+		}
+		if rc.source != "" {
+			fmt.Printf("# Read from %s\n", rc.source)
+		}
+		if len(rc.overrides) > 0 {
+			fmt.Printf("# Overridden: %s\n", strings.Join(rc.overrides, ", "))
+		}
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(rc.Config.redacted()); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to print config: %v\n", err)
+			os.Exit(1)
+		}
+		enc.Close()
+
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// ==================== END CONFIGURATION ====================
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeConfig writes a YAML config file into a temp dir
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "settings.yaml")
+	if err := os.WriteFile(file, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := writeConfig(t, `
+multiplayer:
+  max_sessions: 50
+  max_players: 4
+  guess_timer_seconds: 20
+api_keys:
+  - yaml: "yaml-key"
+`)
+	t.Setenv("PORT", "")
+	t.Setenv("MAPY_API_KEYS", "")
+	t.Setenv("GDE_MULTIPLAYER_MAX_PLAYERS", "8")
+	t.Setenv("GDE_MULTIPLAYER_GUESS_TIMER_SECONDS", "30")
+	t.Setenv("GDE_SERVER_PORT", "9000")
+
+	config, err := loadConfig(file, map[string]string{"multiplayer.guess_timer_seconds": "40"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := config.resolve()
+
+	tests := []struct {
+		name      string
+		got, want int
+	}{
+		{"default", rc.Multiplayer.MaxMessageKB, DefaultMaxMessageKB},
+		{"YAML over default", rc.Multiplayer.MaxSessions, 50},
+		{"env over YAML", rc.Multiplayer.MaxPlayers, 8},
+		{"env over default", rc.Server.Port, 9000},
+		{"flag over env and YAML", rc.Multiplayer.GuessTimerSeconds, 40},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+
+	// Only the winning source of each setting is reported
+	want := []string{
+		"server.port (GDE_SERVER_PORT)",
+		"multiplayer.max_players (GDE_MULTIPLAYER_MAX_PLAYERS)",
+		"multiplayer.guess_timer_seconds (-multiplayer.guess_timer_seconds)",
+	}
+	if !reflect.DeepEqual(rc.overrides, want) {
+		t.Errorf("overrides = %q, want %q", rc.overrides, want)
+	}
+
+	if _, err := loadConfig(file, map[string]string{"multiplayer.no_such_setting": "1"}); err == nil {
+		t.Error("unknown flag accepted")
+	}
+	t.Setenv("GDE_MULTIPLAYER_MAX_PLAYERS", "many")
+	if _, err := loadConfig(file, nil); err == nil {
+		t.Error("non-numeric env value accepted")
+	}
+}
+
+func TestConfigAPIKeysEnvFallback(t *testing.T) {
+	t.Setenv("MAPY_API_KEYS", "env-a, env-b")
+
+	// YAML keys win over MAPY_API_KEYS
+	config, err := loadConfig(writeConfig(t, "api_keys:\n  - yaml: \"yaml-key\"\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := config.keyList(), []APIKey{{ID: "yaml", Value: "yaml-key"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys with YAML keys = %+v, want %+v", got, want)
+	}
+
+	// Without YAML keys MAPY_API_KEYS supplies them
+	config, err = loadConfig(writeConfig(t, "multiplayer:\n  max_players: 4\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []APIKey{{ID: "env-1", Value: "env-a"}, {ID: "env-2", Value: "env-b"}}
+	if got := config.keyList(); !reflect.DeepEqual(got, want) {
+		t.Errorf("keys without YAML keys = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== DISK STORE ====================
+//
+// diskStore keeps each entry as a data file plus a .meta file under
+// <dir>/<first two key chars>/. Both are written to a temp file, fsynced and
+// renamed into place - data first, metadata last - while holding the entry's
+// lock, so readers in this process never see an entry half replaced. A crash
+// in between leaves data without metadata, or with the previous metadata whose
+// checksum no longer matches; both are quarantined when read or scanned. The
+// data file's modification time is the entry's store time.
+
+// diskStore is the default TileStore
+type diskStore struct {
+	dir   string
+	locks [256]sync.RWMutex // By the first key byte, taken by Get and Commit
+}
+
+// newDiskStore creates the cache directory
+func newDiskStore(dir string) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &diskStore{dir: dir}, nil
+}
+
+func (s *diskStore) String() string {
+	return "disk (" + s.dir + ")"
+}
+
+// dataPath returns the data file path of an entry. Keys that could name a
+// path outside the cache dir are refused.
+func (s *diskStore) dataPath(key string) (string, error) {
+	if !validTileKey(key) {
+		return "", errInvalidTileKey
+	}
+	// Use first 2 chars as subdirectory to avoid too many files in one dir
+	return filepath.Join(s.dir, key[:2], key), nil
+}
+
+// lock returns the lock of a valid key
+func (s *diskStore) lock(key string) *sync.RWMutex {
+	n, _ := strconv.ParseUint(key[:2], 16, 8)
+	return &s.locks[n]
+}
+
+// metaPath returns the metadata file path of an entry's data file
+func metaPath(dataPath string) string {
+	return dataPath + ".meta"
+}
+
+func (s *diskStore) Get(key string) (*tileEntry, error) {
+	path, err := s.dataPath(key)
+	if err != nil {
+		return nil, err
+	}
+	lock := s.lock(key)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, errTileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errTileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit holds the lock until the metadata is in place, so a data file
+	// without it is a crash leftover
+	meta, err := os.ReadFile(metaPath(path))
+	if os.IsNotExist(err) {
+		return nil, errTileIncomplete
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &tileEntry{Data: data, Meta: meta, Stored: info.ModTime()}, nil
+}
+
+func (s *diskStore) Put(key string, data, meta []byte) error {
+	w, err := s.Create(key)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit(meta)
+}
+
+// Create starts an entry in a temp file in the entry's directory
+func (s *diskStore) Create(key string) (tileWriter, error) {
+	path, err := s.dataPath(key)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(dir, key+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &diskTileWriter{path: path, file: file, lock: s.lock(key)}, nil
+}
+
+func (s *diskStore) Delete(key string) error {
+	path, err := s.dataPath(key)
+	if err != nil {
+		return err
+	}
+	err1 := os.Remove(path)
+	err2 := os.Remove(metaPath(path))
+	if err1 != nil && !os.IsNotExist(err1) {
+		return err1
+	}
+	if err2 != nil && !os.IsNotExist(err2) {
+		return err2
+	}
+	return nil
+}
+
+func (s *diskStore) Stat(key string) (tileInfo, error) {
+	path, err := s.dataPath(key)
+	if err != nil {
+		return tileInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return tileInfo{}, errTileNotFound
+	}
+	metaInfo, err := os.Stat(metaPath(path))
+	if err != nil {
+		return tileInfo{}, errTileNotFound
+	}
+	return tileInfo{Size: info.Size() + metaInfo.Size(), Stored: info.ModTime()}, nil
+}
+
+func (s *diskStore) Touch(key string, stored time.Time) error {
+	path, err := s.dataPath(key)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, stored, stored)
+}
+
+// Iterate walks complete entries; temp files, orphans and quarantined files are skipped
+func (s *diskStore) Iterate(fn func(key string, info tileInfo) error) error {
+	entries, err := s.walk()
+	if err != nil {
+		return err
+	}
+	for key, e := range entries {
+		if !e.hasData || !e.hasMeta {
+			continue
+		}
+		if err := fn(key, tileInfo{Size: e.dataSize + e.metaSize, Stored: e.dataModTime}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clear removes everything in the cache dir but the index lock, which the
+// process clearing the cache holds
+func (s *diskStore) Clear() error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range files {
+		if f.Name() == cacheIndexLockFile {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.dir, f.Name())); err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(s.dir, 0755)
+}
+
+func (s *diskStore) Close() error {
+	return nil
+}
+
+// Quarantine moves an entry's files into the quarantine dir
+func (s *diskStore) Quarantine(key string) error {
+	dataPath, err := s.dataPath(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(s.dir, cacheQuarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	suffix := "." + time.Now().Format("20060102T150405")
+	for _, path := range []string{dataPath, metaPath(dataPath)} {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := os.Rename(path, filepath.Join(dir, filepath.Base(path)+suffix)); err != nil {
+			// Can't move it aside - make sure it is at least never served again
+			os.Remove(path)
+		}
+	}
+	return nil
+}
+
+// Repair removes temp files no writer can still own, expires old quarantined
+// files and returns entries that lost their data or metadata file
+func (s *diskStore) Repair() (int, []string) {
+	var removed int
+	filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.Contains(info.Name(), ".tmp-") &&
+			!strings.HasPrefix(info.Name(), cacheIndexFile) && time.Since(info.ModTime()) > cacheScanGracePeriod {
+			os.Remove(path)
+			removed++
+		}
+		return nil
+	})
+
+	var orphans []string
+	if entries, err := s.walk(); err == nil {
+		for key, e := range entries {
+			if (!e.hasData || !e.hasMeta) && time.Since(e.modTime) > cacheScanGracePeriod {
+				orphans = append(orphans, key)
+			}
+		}
+	}
+
+	quarantinePath := filepath.Join(s.dir, cacheQuarantineDir)
+	if files, err := os.ReadDir(quarantinePath); err == nil {
+		for _, f := range files {
+			if info, err := f.Info(); err == nil && time.Since(info.ModTime()) > cacheQuarantineKeepDays*24*time.Hour {
+				os.Remove(filepath.Join(quarantinePath, f.Name()))
+			}
+		}
+	}
+
+	return removed, orphans
+}
+
+// diskEntryFiles collects the files of one entry found on disk
+type diskEntryFiles struct {
+	dataSize    int64
+	metaSize    int64
+	hasData     bool
+	hasMeta     bool
+	dataModTime time.Time
+	modTime     time.Time // Newest of both files
+}
+
+// walk lists the entries in the cache dir
+func (s *diskStore) walk() (map[string]*diskEntryFiles, error) {
+	entries := make(map[string]*diskEntryFiles)
+	quarantinePath := filepath.Join(s.dir, cacheQuarantineDir)
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path == quarantinePath {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		name := info.Name()
+		if strings.HasPrefix(name, cacheIndexFile) || strings.Contains(name, ".tmp-") || path == filepath.Join(s.dir, name) {
+			return nil // Index, partial writes and files that aren't in a key subdirectory
+		}
+
+		key := strings.TrimSuffix(name, ".meta")
+		e, ok := entries[key]
+		if !ok {
+			e = &diskEntryFiles{}
+			entries[key] = e
+		}
+		if strings.HasSuffix(name, ".meta") {
+			e.hasMeta = true
+			e.metaSize = info.Size()
+		} else {
+			e.hasData = true
+			e.dataSize = info.Size()
+			e.dataModTime = info.ModTime()
+		}
+		if info.ModTime().After(e.modTime) {
+			e.modTime = info.ModTime()
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// diskTileWriter fills an entry through a temp file, so readers never see a
+// partially written tile
+type diskTileWriter struct {
+	path string // Data file path of the entry
+	file *os.File
+	lock *sync.RWMutex
+}
+
+func (w *diskTileWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+// Commit writes the metadata and atomically renames the data into place
+func (w *diskTileWriter) Commit(meta []byte) error {
+	tmpPath := w.file.Name()
+	if err := w.file.Sync(); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	metaTmpPath, err := writeTempFile(metaPath(w.path), meta, 0644)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := os.Rename(tmpPath, w.path); err != nil {
+		os.Remove(tmpPath)
+		os.Remove(metaTmpPath)
+		return err
+	}
+	if err := os.Rename(metaTmpPath, metaPath(w.path)); err != nil {
+		// Don't leave the new data next to the old entry's metadata
+		os.Remove(metaTmpPath)
+		os.Remove(w.path)
+		os.Remove(metaPath(w.path))
+		return err
+	}
+	return nil
+}
+
+// Abort discards a partially written entry
+func (w *diskTileWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// ==================== END DISK STORE ====================
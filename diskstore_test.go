@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStoreRefusesInvalidKeys(t *testing.T) {
+	root := t.TempDir()
+	victim := filepath.Join(root, "victim")
+	if err := os.WriteFile(victim, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newDiskStore(filepath.Join(root, "cache", "tiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", "a", "../victim", "../../../etc/hostname"} {
+		if _, err := store.Get(key); err != errInvalidTileKey {
+			t.Errorf("Get(%q) = %v, want errInvalidTileKey", key, err)
+		}
+		if _, err := store.Stat(key); err != errInvalidTileKey {
+			t.Errorf("Stat(%q) = %v, want errInvalidTileKey", key, err)
+		}
+		if err := store.Put(key, []byte("data"), []byte("meta")); err != errInvalidTileKey {
+			t.Errorf("Put(%q) = %v, want errInvalidTileKey", key, err)
+		}
+		if err := store.Touch(key, time.Now()); err != errInvalidTileKey {
+			t.Errorf("Touch(%q) = %v, want errInvalidTileKey", key, err)
+		}
+		if err := store.Delete(key); err != errInvalidTileKey {
+			t.Errorf("Delete(%q) = %v, want errInvalidTileKey", key, err)
+		}
+		if err := store.Quarantine(key); err != errInvalidTileKey {
+			t.Errorf("Quarantine(%q) = %v, want errInvalidTileKey", key, err)
+		}
+	}
+
+	if data, err := os.ReadFile(victim); err != nil || string(data) != "keep me" {
+		t.Errorf("file outside the cache dir was touched: %q, %v", data, err)
+	}
+}
+
+func TestDiskStoreClearKeepsIndexLock(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := openCacheIndex(dir, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if err := store.Put("0123456789abcdef0123456789abcdef", []byte("data"), []byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat("0123456789abcdef0123456789abcdef"); err != errTileNotFound {
+		t.Errorf("Stat after Clear = %v, want errTileNotFound", err)
+	}
+	if _, err := openCacheIndex(dir, store); err == nil {
+		t.Error("a second index opened after Clear removed the lock")
+	}
+}
+
+func TestDiskStoreReadersNeverSeeHalfReplacedEntries(t *testing.T) {
+	store, err := newDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "0123456789abcdef0123456789abcdef"
+	if err := store.Put(key, []byte("data 0"), []byte("meta 0")); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 200; i++ {
+			if err := store.Put(key, []byte(fmt.Sprintf("data %d", i)), []byte(fmt.Sprintf("meta %d", i))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for reads := 0; ; reads++ {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		entry, err := store.Get(key)
+		if err != nil {
+			t.Fatalf("read %d: %v", reads, err)
+		}
+		if data, meta := string(entry.Data), string(entry.Meta); data[len("data "):] != meta[len("meta "):] {
+			t.Fatalf("read %d: %q with %q", reads, data, meta)
+		}
+	}
+}
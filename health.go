@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== HEALTH CHECKS ====================
+//
+// /healthz answers 200 while the process can serve HTTP at all. /readyz says
+// whether the instance should receive traffic: it needs a usable API key, a
+// writable cache dir, the region boundaries the game loads, and no shutdown in
+// progress. Both answer JSON; /readyz answers 503 with the failing checks when
+// degraded, so orchestrators stop routing to it.
+
+// healthCheck is the result of one readiness check
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthJSON(w, http.StatusOK, map[string]interface{}{
+		"status":         "ok",
+		"uptime_seconds": int64(time.Since(s.started).Seconds()),
+	})
+}
+
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]healthCheck{
+		"api_keys":   s.checkAPIKeys(),
+		"cache_dir":  s.checkCacheDir(),
+		"boundaries": checkBoundaries(s.assets.boundaries()),
+		"shutdown":   s.checkShutdown(),
+	}
+
+	status, code := "ready", http.StatusOK
+	for name, check := range checks {
+		if !check.OK {
+			status, code = "not_ready", http.StatusServiceUnavailable
+			logWith("check", name, "error", check.Error).Debug("🩺 Readiness check failed")
+		}
+	}
+
+	writeHealthJSON(w, code, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// writeHealthJSON writes an uncacheable JSON health response
+func writeHealthJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// checkAPIKeys passes while at least one key isn't known to be rejected.
+// Keys are judged by their last upstream answer: a 401/403 marks a key bad,
+// while network errors say nothing about the key. Unused keys count as good.
+func (s *Server) checkAPIKeys() healthCheck {
+	keys := s.keys.list()
+
+	healthy := 0
+	for _, key := range keys {
+		if stats, ok := s.keys.keyStats(key.ID); ok {
+			status := atomic.LoadInt64(&stats.lastStatus)
+			if status == http.StatusUnauthorized || status == http.StatusForbidden {
+				continue
+			}
+		}
+		healthy++
+	}
+
+	check := healthCheck{OK: healthy > 0, Detail: fmt.Sprintf("%d of %d keys healthy", healthy, len(keys))}
+	if len(keys) == 0 {
+		check.Error = "no API keys configured"
+	} else if healthy == 0 {
+		check.Error = "all API keys were rejected upstream"
+	}
+	return check
+}
+
+// checkCacheDir passes if a file can be created in the cache dir
+func (s *Server) checkCacheDir() healthCheck {
+	dir := s.cache.settings().Dir
+
+	check := healthCheck{Detail: dir}
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	f.Close()
+	os.Remove(f.Name())
+	check.OK = true
+	return check
+}
+
+// checkBoundaries passes if the boundaries index lists regions whose files exist
+func checkBoundaries(boundaries fs.FS) healthCheck {
+	index, err := readBoundaryIndex(boundaries)
+	if err != nil {
+		return healthCheck{Error: err.Error()}
+	}
+
+	regions := 0
+	for _, group := range index {
+		for _, entry := range group {
+			if _, err := fs.Stat(boundaries, entry.File); err != nil {
+				return healthCheck{Error: fmt.Sprintf("region %s: %v", entry.Key, err)}
+			}
+			regions++
+		}
+	}
+	if regions == 0 {
+		return healthCheck{Error: "no regions in boundaries index"}
+	}
+	return healthCheck{OK: true, Detail: fmt.Sprintf("%d regions", regions)}
+}
+
+// checkShutdown fails once the server has begun shutting down
+func (s *Server) checkShutdown() healthCheck {
+	if s.isShuttingDown() {
+		return healthCheck{Error: "shutdown in progress"}
+	}
+	return healthCheck{OK: true}
+}
+
+// ==================== END HEALTH CHECKS ====================
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// readyz fetches /readyz and decodes its checks
+func readyz(t *testing.T, s *Server) (int, map[string]healthCheck) {
+	t.Helper()
+	rec := get(s, "/readyz", nil)
+	var body struct {
+		Status string                 `json:"status"`
+		Checks map[string]healthCheck `json:"checks"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid /readyz body %q: %v", rec.Body.String(), err)
+	}
+	wantStatus := "ready"
+	if rec.Code != http.StatusOK {
+		wantStatus = "not_ready"
+	}
+	if body.Status != wantStatus {
+		t.Errorf("/readyz status = %q with HTTP %d", body.Status, rec.Code)
+	}
+	return rec.Code, body.Checks
+}
+
+// expectNotReady checks that /readyz fails on exactly the named check
+func expectNotReady(t *testing.T, s *Server, failing string) {
+	t.Helper()
+	code, checks := readyz(t, s)
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz = %d, want 503", code)
+	}
+	for name, check := range checks {
+		if check.OK == (name == failing) {
+			t.Errorf("check %s = %+v", name, check)
+		}
+	}
+	if checks[failing].Error == "" {
+		t.Errorf("check %s has no error", failing)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	mock, upstreamURL := newMockUpstreamServer(t, nil)
+
+	t.Run("ready", func(t *testing.T) {
+		s := newProxyTestServer(t, upstreamURL, "good")
+		if code, checks := readyz(t, s); code != http.StatusOK {
+			t.Fatalf("/readyz = %d: %+v", code, checks)
+		}
+		if rec := get(s, "/healthz", nil); rec.Code != http.StatusOK {
+			t.Errorf("/healthz = %d", rec.Code)
+		}
+	})
+
+	t.Run("no keys", func(t *testing.T) {
+		s := newProxyTestServer(t, upstreamURL)
+		expectNotReady(t, s, "api_keys")
+	})
+
+	t.Run("all keys rejected", func(t *testing.T) {
+		mock.mutex.Lock()
+		mock.keyStatus["bad1"] = http.StatusUnauthorized
+		mock.keyStatus["bad2"] = http.StatusForbidden
+		mock.mutex.Unlock()
+		s := newProxyTestServer(t, upstreamURL, "bad1", "bad2")
+
+		// Unused keys count as healthy until upstream rejects them
+		if code, _ := readyz(t, s); code != http.StatusOK {
+			t.Fatalf("/readyz with unused keys = %d, want 200", code)
+		}
+		get(s, "/api/mapy/v1/maptiles/basic/256/10/550/300", nil)
+		expectNotReady(t, s, "api_keys")
+	})
+
+	t.Run("unwritable cache dir", func(t *testing.T) {
+		s := newProxyTestServer(t, upstreamURL, "good")
+		// Permissions don't stop root, so replace the dir with a file
+		dir := s.cache.settings().Dir
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dir, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		expectNotReady(t, s, "cache_dir")
+	})
+
+	t.Run("shutting down", func(t *testing.T) {
+		s := newProxyTestServer(t, upstreamURL, "good")
+		s.shutdown(nil, time.Second)
+		expectNotReady(t, s, "shutdown")
+		// Liveness is unaffected
+		if rec := get(s, "/healthz", nil); rec.Code != http.StatusOK {
+			t.Errorf("/healthz during shutdown = %d", rec.Code)
+		}
+	})
+}
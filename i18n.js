@@ -290,6 +290,8 @@ const translations = {
         'mp.codecopied': 'Session code copied to clipboard!',
         'mp.connectionerror': 'Connection error. Please try again.',
         'mp.connectionlost': 'Connection lost. Returning to menu.',
+        'mp.reloadrequired': 'The game was updated. Reload the page to play multiplayer?',
+        'mp.servershutdown': 'Server is restarting - the game ends within {seconds} seconds.',
         'mp.submitted': 'submitted their guess!',
         'mp.wins': '{player} wins!',
         'mp.withpoints': 'with {score} points',
@@ -606,6 +608,8 @@ const translations = {
         'mp.codecopied': 'Kód hry zkopírován do schránky!',
         'mp.connectionerror': 'Chyba připojení. Zkus to znovu.',
         'mp.connectionlost': 'Spojení ztraceno. Návrat do menu.',
+        'mp.reloadrequired': 'Hra byla aktualizována. Načíst stránku znovu a hrát multiplayer?',
+        'mp.servershutdown': 'Server se restartuje - hra skončí nejpozději za {seconds} s.',
         'mp.submitted': 'odeslal svůj tip!',
         'mp.wins': '{player} vyhrává!',
         'mp.withpoints': 's {score} body',
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ==================== KV STORE ====================
+//
+// kvStore keeps the whole cache in one append-only file, which is easier to
+// move, back up and mount than hundreds of thousands of small files. An
+// in-memory map points at the latest record of each key; deletions and TTL
+// refreshes are appended as records too, and the file is compacted once most
+// of it is dead.
+//
+// The file starts with kvStoreMagic, followed by records:
+//
+//	op      1 byte    'P' put, 'T' touch, 'D' delete
+//	stored  8 bytes   unix seconds
+//	keyLen  2 bytes
+//	metaLen 4 bytes
+//	dataLen 4 bytes
+//	crc     4 bytes   CRC-32 of the fields above and the payload
+//	key, meta, data
+//
+// A record that is truncated or fails its CRC ends the log; it can only be a
+// torn write from a crash, and the file is truncated there on open.
+
+const (
+	DefaultKVStoreFile     = "tiles.db"
+	kvStoreMagic           = "GDEKV1\n"
+	kvRecordHeaderSize     = 1 + 8 + 2 + 4 + 4 + 4
+	kvStoreCompactMinBytes = 64 * 1024 * 1024 // Dead bytes before compaction is worth it
+)
+
+// KVStoreConfig holds settings of the single-file store from YAML
+type KVStoreConfig struct {
+	Path string `yaml:"path"` // Defaults to tiles.db in cache.dir
+}
+
+// kvRecord locates the payload of a live entry in the file
+type kvRecord struct {
+	offset  int64 // Start of the metadata
+	metaLen uint32
+	dataLen uint32
+	stored  time.Time
+	size    int64 // Whole record, for dead space accounting
+}
+
+// kvStore is a TileStore backed by a single append-only file
+type kvStore struct {
+	mutex   sync.RWMutex
+	path    string
+	file    *os.File
+	unlock  func()
+	end     int64 // Append offset
+	records map[string]*kvRecord
+	live    int64 // Bytes of records still referenced
+	clears  int   // Clear calls, so a running compaction notices its snapshot is gone
+
+	compactMutex sync.Mutex // One compaction at a time
+}
+
+// openKVStore opens or creates the store file and replays it. The file is
+// locked, so a second process (e.g. prewarm next to a running server) fails
+// instead of corrupting it.
+func openKVStore(path string) (*kvStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s is in use by another process: %v", path, err)
+	}
+
+	s := &kvStore{path: path, file: file, unlock: unlock, records: make(map[string]*kvRecord)}
+	if err := s.replay(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *kvStore) String() string {
+	return "kv (" + s.path + ")"
+}
+
+// replay rebuilds the key map, truncating a torn tail
+func (s *kvStore) replay() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := s.file.WriteAt([]byte(kvStoreMagic), 0); err != nil {
+			return err
+		}
+		s.end = int64(len(kvStoreMagic))
+		return s.file.Sync()
+	}
+
+	r := bufio.NewReaderSize(io.NewSectionReader(s.file, 0, info.Size()), 1<<20)
+	magic := make([]byte, len(kvStoreMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != kvStoreMagic {
+		return fmt.Errorf("%s is not a tile store file", s.path)
+	}
+
+	offset := int64(len(kvStoreMagic))
+	header := make([]byte, kvRecordHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		op, stored, keyLen, metaLen, dataLen, crc := decodeKVHeader(header)
+		payload := make([]byte, int(keyLen)+int(metaLen)+int(dataLen))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if kvChecksum(header, payload) != crc {
+			break
+		}
+
+		size := int64(kvRecordHeaderSize + len(payload))
+		key := string(payload[:keyLen])
+		s.applyLocked(op, key, &kvRecord{
+			offset:  offset + kvRecordHeaderSize + int64(keyLen),
+			metaLen: metaLen,
+			dataLen: dataLen,
+			stored:  time.Unix(stored, 0),
+			size:    size,
+		})
+		offset += size
+	}
+
+	if offset < info.Size() {
+		logWith("file", s.path, "bytes", info.Size()-offset).Warn("⚠️  Truncating torn writes at the end of the store")
+		if err := s.file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	s.end = offset
+	return nil
+}
+
+// applyLocked updates the key map for one record; the caller holds the mutex
+func (s *kvStore) applyLocked(op byte, key string, rec *kvRecord) {
+	switch op {
+	case 'P':
+		if old, ok := s.records[key]; ok {
+			s.live -= old.size
+		}
+		s.records[key] = rec
+		s.live += rec.size
+	case 'T':
+		if old, ok := s.records[key]; ok {
+			old.stored = rec.stored
+		}
+	case 'D':
+		if old, ok := s.records[key]; ok {
+			s.live -= old.size
+			delete(s.records, key)
+		}
+	}
+}
+
+// appendLocked writes a record at the end of the file; the caller holds the mutex
+func (s *kvStore) appendLocked(op byte, key string, stored time.Time, meta, data []byte) (*kvRecord, error) {
+	if len(key) > 0xffff {
+		return nil, errors.New("key too long")
+	}
+	buf := make([]byte, kvRecordHeaderSize, kvRecordHeaderSize+len(key)+len(meta)+len(data))
+	buf[0] = op
+	binary.BigEndian.PutUint64(buf[1:], uint64(stored.Unix()))
+	binary.BigEndian.PutUint16(buf[9:], uint16(len(key)))
+	binary.BigEndian.PutUint32(buf[11:], uint32(len(meta)))
+	binary.BigEndian.PutUint32(buf[15:], uint32(len(data)))
+	buf = append(buf, key...)
+	buf = append(buf, meta...)
+	buf = append(buf, data...)
+	binary.BigEndian.PutUint32(buf[19:], kvChecksum(buf[:kvRecordHeaderSize], buf[kvRecordHeaderSize:]))
+
+	if _, err := s.file.WriteAt(buf, s.end); err != nil {
+		// Drop whatever made it to the file so the next record starts clean
+		s.file.Truncate(s.end)
+		return nil, err
+	}
+	rec := &kvRecord{
+		offset:  s.end + kvRecordHeaderSize + int64(len(key)),
+		metaLen: uint32(len(meta)),
+		dataLen: uint32(len(data)),
+		stored:  stored,
+		size:    int64(len(buf)),
+	}
+	s.end += int64(len(buf))
+	return rec, nil
+}
+
+func (s *kvStore) Get(key string) (*tileEntry, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rec, ok := s.records[key]
+	if !ok {
+		return nil, errTileNotFound
+	}
+	buf := make([]byte, int(rec.metaLen)+int(rec.dataLen))
+	if _, err := s.file.ReadAt(buf, rec.offset); err != nil {
+		return nil, err
+	}
+	return &tileEntry{Data: buf[rec.metaLen:], Meta: buf[:rec.metaLen], Stored: rec.stored}, nil
+}
+
+func (s *kvStore) Put(key string, data, meta []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rec, err := s.appendLocked('P', key, time.Now(), meta, data)
+	if err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.applyLocked('P', key, rec)
+	return nil
+}
+
+func (s *kvStore) Create(key string) (tileWriter, error) {
+	return &bufferedTileWriter{store: s, key: key}, nil
+}
+
+func (s *kvStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.records[key]; !ok {
+		return nil
+	}
+	if _, err := s.appendLocked('D', key, time.Now(), nil, nil); err != nil {
+		return err
+	}
+	s.applyLocked('D', key, nil)
+	return nil
+}
+
+func (s *kvStore) Stat(key string) (tileInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rec, ok := s.records[key]
+	if !ok {
+		return tileInfo{}, errTileNotFound
+	}
+	return tileInfo{Size: int64(rec.metaLen) + int64(rec.dataLen), Stored: rec.stored}, nil
+}
+
+func (s *kvStore) Touch(key string, stored time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.records[key]; !ok {
+		return errTileNotFound
+	}
+	rec, err := s.appendLocked('T', key, stored, nil, nil)
+	if err != nil {
+		return err
+	}
+	s.applyLocked('T', key, rec)
+	return nil
+}
+
+// Iterate visits a snapshot of the entries, so fn may modify the store
+func (s *kvStore) Iterate(fn func(key string, info tileInfo) error) error {
+	s.mutex.RLock()
+	infos := make(map[string]tileInfo, len(s.records))
+	for key, rec := range s.records {
+		infos[key] = tileInfo{Size: int64(rec.metaLen) + int64(rec.dataLen), Stored: rec.stored}
+	}
+	s.mutex.RUnlock()
+
+	for key, info := range infos {
+		if err := fn(key, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *kvStore) Clear() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.file.Truncate(int64(len(kvStoreMagic))); err != nil {
+		return err
+	}
+	s.end = int64(len(kvStoreMagic))
+	s.records = make(map[string]*kvRecord)
+	s.live = 0
+	s.clears++
+	return s.file.Sync()
+}
+
+func (s *kvStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	s.file.Sync()
+	s.unlock()
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Compact rewrites the file with only live entries once dead records take up
+// more than half of it. Live entries are copied from a snapshot without
+// holding the lock; records appended meanwhile are copied over under the lock
+// right before the files are swapped.
+func (s *kvStore) Compact() error {
+	s.compactMutex.Lock()
+	defer s.compactMutex.Unlock()
+
+	s.mutex.RLock()
+	dead := s.end - int64(len(kvStoreMagic)) - s.live
+	if s.file == nil || dead < kvStoreCompactMinBytes || dead < s.live {
+		s.mutex.RUnlock()
+		return nil
+	}
+	file, snapshotEnd, clears := s.file, s.end, s.clears
+	snapshot := make(map[string]kvRecord, len(s.records))
+	for key, rec := range s.records {
+		snapshot[key] = *rec // Touch updates records in place
+	}
+	s.mutex.RUnlock()
+
+	start := time.Now()
+	tmpPath := s.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	abort := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	compacted := &kvStore{path: tmpPath, file: tmp, end: int64(len(kvStoreMagic)), records: make(map[string]*kvRecord)}
+	if _, err := tmp.WriteAt([]byte(kvStoreMagic), 0); err != nil {
+		return abort(err)
+	}
+
+	// The file only grows at its end, so the snapshot's records stay readable
+	for key, rec := range snapshot {
+		buf := make([]byte, int(rec.metaLen)+int(rec.dataLen))
+		if _, err := file.ReadAt(buf, rec.offset); err != nil {
+			return abort(err)
+		}
+		newRec, err := compacted.appendLocked('P', key, rec.stored, buf[:rec.metaLen], buf[rec.metaLen:])
+		if err != nil {
+			return abort(err)
+		}
+		compacted.applyLocked('P', key, newRec)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file != file || s.clears != clears {
+		return abort(nil) // Closed or cleared meanwhile
+	}
+	if err := s.copyRecordsLocked(compacted, snapshotEnd); err != nil {
+		return abort(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return abort(err)
+	}
+
+	// Move the lock over to the new file before it replaces the old one
+	unlock, err := lockFile(tmp)
+	if err != nil {
+		return abort(err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		unlock()
+		return abort(err)
+	}
+	s.unlock()
+	s.file.Close()
+
+	reclaimed := s.end - compacted.end
+	s.file = tmp
+	s.unlock = unlock
+	s.end = compacted.end
+	s.records = compacted.records
+	s.live = compacted.live
+
+	logWith("file", s.path, "reclaimed_bytes", reclaimed, "duration", time.Since(start).Round(time.Millisecond)).Info("🗜️ Compacted kv store")
+	return nil
+}
+
+// copyRecordsLocked appends the records written since offset to dst; the
+// caller holds the mutex
+func (s *kvStore) copyRecordsLocked(dst *kvStore, offset int64) error {
+	header := make([]byte, kvRecordHeaderSize)
+	for offset < s.end {
+		if _, err := s.file.ReadAt(header, offset); err != nil {
+			return err
+		}
+		op, stored, keyLen, metaLen, dataLen, _ := decodeKVHeader(header)
+		payload := make([]byte, int(keyLen)+int(metaLen)+int(dataLen))
+		if _, err := s.file.ReadAt(payload, offset+kvRecordHeaderSize); err != nil {
+			return err
+		}
+		key := string(payload[:keyLen])
+		meta := payload[keyLen : int(keyLen)+int(metaLen)]
+		rec, err := dst.appendLocked(op, key, time.Unix(stored, 0), meta, payload[int(keyLen)+int(metaLen):])
+		if err != nil {
+			return err
+		}
+		dst.applyLocked(op, key, rec)
+		offset += kvRecordHeaderSize + int64(len(payload))
+	}
+	return nil
+}
+
+// decodeKVHeader splits a record header into its fields
+func decodeKVHeader(h []byte) (op byte, stored int64, keyLen uint16, metaLen, dataLen, crc uint32) {
+	return h[0],
+		int64(binary.BigEndian.Uint64(h[1:])),
+		binary.BigEndian.Uint16(h[9:]),
+		binary.BigEndian.Uint32(h[11:]),
+		binary.BigEndian.Uint32(h[15:]),
+		binary.BigEndian.Uint32(h[19:])
+}
+
+// kvChecksum covers a record's header (without the CRC field) and payload
+func kvChecksum(header, payload []byte) uint32 {
+	crc := crc32.ChecksumIEEE(header[:kvRecordHeaderSize-4])
+	return crc32.Update(crc, crc32.IEEETable, payload)
+}
+
+// ==================== END KV STORE ====================
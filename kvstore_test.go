@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestKVStore(t *testing.T, path string) *kvStore {
+	t.Helper()
+	s, err := openKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// kvKey returns a valid tile key for n
+func kvKey(n int) string {
+	return fmt.Sprintf("%032x", n)
+}
+
+func TestKVStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiles.db")
+	s := openTestKVStore(t, path)
+
+	for i := 0; i < 3; i++ {
+		if err := s.Put(kvKey(i), []byte(fmt.Sprintf("data %d", i)), []byte(fmt.Sprintf("meta %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry, err := s.Get(kvKey(1))
+	if err != nil || string(entry.Data) != "data 1" || string(entry.Meta) != "meta 1" {
+		t.Fatalf("Get = %+v, %v, want data 1 and meta 1", entry, err)
+	}
+	if info, err := s.Stat(kvKey(1)); err != nil || info.Size != entry.Size() {
+		t.Errorf("Stat = %+v, %v, want size %d", info, err, entry.Size())
+	}
+
+	stored := time.Unix(1700000000, 0)
+	if err := s.Touch(kvKey(0), stored); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(kvKey(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(kvKey(1), []byte("data 1b"), []byte("meta 1b")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything survives reopening
+	if _, err := openKVStore(path); err == nil {
+		t.Fatal("opened a store file another user holds")
+	}
+	s.Close()
+	s = openTestKVStore(t, path)
+	if info, err := s.Stat(kvKey(0)); err != nil || !info.Stored.Equal(stored) {
+		t.Errorf("touched entry: Stat = %+v, %v, want stored %v", info, err, stored)
+	}
+	if entry, err := s.Get(kvKey(1)); err != nil || string(entry.Data) != "data 1b" {
+		t.Errorf("replaced entry: Get = %+v, %v, want data 1b", entry, err)
+	}
+	if _, err := s.Get(kvKey(2)); err != errTileNotFound {
+		t.Errorf("deleted entry: Get error = %v, want errTileNotFound", err)
+	}
+	count := 0
+	s.Iterate(func(string, tileInfo) error { count++; return nil })
+	if count != 2 {
+		t.Errorf("Iterate visited %d entries, want 2", count)
+	}
+}
+
+func TestKVStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiles.db")
+	s := openTestKVStore(t, path)
+
+	// Overwrite two entries until the dead records pass the compaction threshold
+	data := bytes.Repeat([]byte{'x'}, 1024*1024)
+	for i := 0; i < kvStoreCompactMinBytes/len(data)+4; i++ {
+		if err := s.Put(kvKey(i%2), data, []byte(fmt.Sprintf("meta %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put(kvKey(2), []byte("small"), []byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.Stat(path)
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size()/10 {
+		t.Errorf("file is %d bytes after compaction, was %d", after.Size(), before.Size())
+	}
+
+	// The store keeps working on the new file, and reopens from it
+	if err := s.Put(kvKey(3), []byte("after"), []byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	s = openTestKVStore(t, path)
+	for key, want := range map[string]int{kvKey(0): len(data), kvKey(1): len(data), kvKey(2): 5, kvKey(3): 5} {
+		if entry, err := s.Get(key); err != nil || len(entry.Data) != want {
+			t.Errorf("Get(%s) after compaction: %v, want %d bytes", key, err, want)
+		}
+	}
+}
+
+func TestKVStoreTruncatesCorruptTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiles.db")
+	s := openTestKVStore(t, path)
+	for i := 0; i < 3; i++ {
+		if err := s.Put(kvKey(i), []byte(fmt.Sprintf("data %d", i)), []byte("meta")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	// Flip the last byte of the last record and append half a header
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file[len(file)-1] ^= 0xff
+	file = append(file, 'P', 0, 0)
+	if err := os.WriteFile(path, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestKVStore(t, path)
+	for i := 0; i < 2; i++ {
+		if entry, err := s.Get(kvKey(i)); err != nil || string(entry.Data) != fmt.Sprintf("data %d", i) {
+			t.Errorf("Get(%d) = %v, want the intact entry", i, err)
+		}
+	}
+	if _, err := s.Get(kvKey(2)); err != errTileNotFound {
+		t.Errorf("corrupt entry: Get error = %v, want errTileNotFound", err)
+	}
+
+	// New records go after the last good one
+	if err := s.Put(kvKey(3), []byte("data 3"), []byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	s = openTestKVStore(t, path)
+	if entry, err := s.Get(kvKey(3)); err != nil || string(entry.Data) != "data 3" {
+		t.Errorf("entry written after the repair: %v", err)
+	}
+
+	if err := os.WriteFile(path+"2", []byte("not a store"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := openKVStore(path + "2"); err == nil {
+		s.Close()
+		t.Error("opened a file without the store header")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile is a no-op where flock is unavailable; don't run two processes on one store file
+func lockFile(f *os.File) (func(), error) {
+	return func() {}, nil
+}
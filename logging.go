@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+)
+
+// ==================== LOGGING ====================
+//
+// All logs go through log/slog. logging.format selects text (key=value lines,
+// the default) or json, and logging.level the minimum level (DEBUG, INFO, WARN,
+// ERROR); see config.go for setting them.
+// The printf-style helpers (logInfo, ...) keep call sites short; requestLog and
+// sessionLog return loggers that attach a request ID or session code and player
+// ID as separate fields. Values worth filtering on (rounds, counts,
+// coordinates) go in fields via With rather than into the message text.
+// The standard log package is routed through slog too.
+
+// Log output formats (logging.format)
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// logLevel is INFO unless logging.level says otherwise. The logger itself is
+// slog.Default(), which setupLogging replaces atomically, so a config reload
+// can switch the format while requests are logging.
+var logLevel = new(slog.LevelVar)
+
+// setupLogging configures the level and format from resolved settings (see
+// resolveLoggingConfig)
+func setupLogging(cfg LoggingConfig) {
+	switch cfg.Level {
+	case "DEBUG":
+		logLevel.Set(slog.LevelDebug)
+	case "WARN":
+		logLevel.Set(slog.LevelWarn)
+	case "ERROR":
+		logLevel.Set(slog.LevelError)
+	default:
+		logLevel.Set(slog.LevelInfo)
+	}
+
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, cfg.Format)))
+}
+
+// newLogHandler creates a handler for a log format
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if format == LogFormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// fieldLogger logs printf-style messages with structured fields attached
+type fieldLogger struct {
+	fields []any // Alternating keys and values, as for slog
+}
+
+// With returns a copy of the logger with more fields attached
+func (l fieldLogger) With(args ...any) fieldLogger {
+	fields := make([]any, 0, len(l.fields)+len(args))
+	fields = append(fields, l.fields...)
+	return fieldLogger{fields: append(fields, args...)}
+}
+
+func (l fieldLogger) log(level slog.Level, format string, v ...interface{}) {
+	ctx := context.Background()
+	logger := slog.Default()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	logger.Log(ctx, level, fmt.Sprintf(format, v...), l.fields...)
+}
+
+func (l fieldLogger) Debug(format string, v ...interface{}) { l.log(slog.LevelDebug, format, v...) }
+func (l fieldLogger) Info(format string, v ...interface{})  { l.log(slog.LevelInfo, format, v...) }
+func (l fieldLogger) Warn(format string, v ...interface{})  { l.log(slog.LevelWarn, format, v...) }
+func (l fieldLogger) Error(format string, v ...interface{}) { l.log(slog.LevelError, format, v...) }
+
+func logDebug(format string, v ...interface{}) { fieldLogger{}.log(slog.LevelDebug, format, v...) }
+func logInfo(format string, v ...interface{})  { fieldLogger{}.log(slog.LevelInfo, format, v...) }
+func logWarn(format string, v ...interface{})  { fieldLogger{}.log(slog.LevelWarn, format, v...) }
+func logError(format string, v ...interface{}) { fieldLogger{}.log(slog.LevelError, format, v...) }
+
+// logWith returns a logger with the given fields attached
+func logWith(args ...any) fieldLogger {
+	return fieldLogger{}.With(args...)
+}
+
+// sessionLog returns a logger for WebSocket events; empty fields are left out
+func sessionLog(sessionCode, playerID string) fieldLogger {
+	var fields []any
+	if sessionCode != "" {
+		fields = append(fields, "session", sessionCode)
+	}
+	if playerID != "" {
+		fields = append(fields, "player", playerID)
+	}
+	return fieldLogger{fields: fields}
+}
+
+// requestIDContextKey stores a request's ID in its context
+type requestIDContextKey struct{}
+
+// Incoming X-Request-ID values are kept when they look like an ID
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// withRequestID assigns a request ID - the client's X-Request-ID if it is
+// sane, a random one otherwise - and echoes it in the response
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-ID")
+	if !requestIDPattern.MatchString(id) {
+		var b [8]byte
+		rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+	}
+	w.Header().Set("X-Request-ID", id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id))
+}
+
+// requestLog returns a logger carrying the request's ID
+func requestLog(r *http.Request) fieldLogger {
+	if id, ok := r.Context().Value(requestIDContextKey{}).(string); ok {
+		return fieldLogger{fields: []any{"request_id", id}}
+	}
+	return fieldLogger{}
+}
+
+// ==================== END LOGGING ====================
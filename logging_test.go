@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestFieldLoggerWith(t *testing.T) {
+	var buf bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(newLogHandler(&buf, LogFormatJSON)))
+	defer slog.SetDefault(saved)
+
+	base := sessionLog("abcd", "p1")
+	base.With("round", 3).Error("Starting round")
+	base.Error("Plain")
+
+	var lines []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var rec map[string]any
+		if err := json.Unmarshal(line, &rec); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		lines = append(lines, rec)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2", len(lines))
+	}
+	if lines[0]["msg"] != "Starting round" || lines[0]["round"] != 3.0 || lines[0]["session"] != "abcd" || lines[0]["player"] != "p1" {
+		t.Errorf("first line = %v", lines[0])
+	}
+	// With must not leak fields into the logger it was called on
+	if _, ok := lines[1]["round"]; ok {
+		t.Errorf("second line has a round field: %v", lines[1])
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ==================== MEMORY CACHE ====================
+
+// memoryEntry is a cached response held in memory
+type memoryEntry struct {
+	key     string
+	data    []byte
+	headers map[string]string
+	modTime time.Time // When the entry was written to disk, for TTL checks
+}
+
+// size approximates the memory an entry occupies
+func (e *memoryEntry) size() int64 {
+	n := int64(len(e.key) + len(e.data))
+	for k, v := range e.headers {
+		n += int64(len(k) + len(v))
+	}
+	return n
+}
+
+// memoryCache is a size-bounded LRU of hot tiles in front of the disk cache,
+// keyed by the same hash as getCacheKey
+type memoryCache struct {
+	mutex    sync.Mutex
+	maxBytes int64
+	size     int64
+	ll       *list.List // Front = most recently used
+	items    map[string]*list.Element
+
+	hits   uint64
+	misses uint64
+}
+
+// newMemoryCache creates an LRU holding up to maxBytes of tile data
+func newMemoryCache(maxBytes int64) *memoryCache {
+	return &memoryCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns an entry and marks it as recently used
+func (c *memoryCache) Get(key string) (*memoryEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	c.ll.MoveToFront(el)
+	return el.Value.(*memoryEntry), true
+}
+
+// Add stores an entry, evicting least recently used ones to stay within maxBytes.
+// Entries larger than an eighth of the budget are skipped so one huge tile can't
+// flush the whole tier.
+func (c *memoryCache) Add(key string, data []byte, headers map[string]string, modTime time.Time) {
+	entry := &memoryEntry{key: key, data: data, headers: headers, modTime: modTime}
+	entrySize := entry.size()
+	if entrySize > c.maxBytes/8 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.size -= el.Value.(*memoryEntry).size()
+		el.Value = entry
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(entry)
+	}
+	c.size += entrySize
+
+	for c.size > c.maxBytes {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Remove drops a single entry
+func (c *memoryCache) Remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// Clear drops every entry and resets the counters
+func (c *memoryCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.size = 0
+	c.hits = 0
+	c.misses = 0
+}
+
+// Stats returns hit/miss counters, entry count and bytes held
+func (c *memoryCache) Stats() (hits, misses uint64, entries int, size int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.hits, c.misses, len(c.items), c.size
+}
+
+// removeElement unlinks an entry; the caller holds the mutex
+func (c *memoryCache) removeElement(el *list.Element) {
+	entry := el.Value.(*memoryEntry)
+	c.ll.Remove(el)
+	delete(c.items, entry.key)
+	c.size -= entry.size()
+}
+
+// ==================== END MEMORY CACHE ====================
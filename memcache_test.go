@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	// Each entry is a 1 byte key plus 99 bytes of data, the largest size an
+	// 800 byte cache accepts
+	c := newMemoryCache(800)
+	data := bytes.Repeat([]byte{'x'}, 99)
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		c.Add(key, data, nil, time.Now())
+	}
+	if _, _, entries, size := c.Stats(); entries != 8 || size != 800 {
+		t.Fatalf("entries = %d, size = %d, want 8 and 800", entries, size)
+	}
+
+	c.Get("a") // Now the most recently used, "b" is the oldest
+	c.Add("i", data, nil, time.Now())
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("least recently used entry b survived")
+	}
+	for _, key := range []string{"a", "c", "i"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("entry %s was evicted", key)
+		}
+	}
+	if _, _, entries, size := c.Stats(); entries != 8 || size != 800 {
+		t.Errorf("after eviction entries = %d, size = %d, want 8 and 800", entries, size)
+	}
+
+	// Replacing an entry accounts for the size difference
+	c.Add("a", data[:49], nil, time.Now())
+	if _, _, _, size := c.Stats(); size != 750 {
+		t.Errorf("after replacing a size = %d, want 750", size)
+	}
+}
+
+func TestMemoryCacheSkipsOversizeEntries(t *testing.T) {
+	c := newMemoryCache(800)
+	c.Add("a", bytes.Repeat([]byte{'x'}, 99), nil, time.Now())
+
+	// One byte over an eighth of the budget
+	c.Add("b", bytes.Repeat([]byte{'x'}, 100), nil, time.Now())
+	if _, ok := c.Get("b"); ok {
+		t.Error("oversize entry was cached")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("oversize entry evicted a smaller one")
+	}
+	if hits, misses, entries, size := c.Stats(); hits != 1 || misses != 1 || entries != 1 || size != 100 {
+		t.Errorf("stats = %d hits, %d misses, %d entries, %d bytes, want 1, 1, 1, 100", hits, misses, entries, size)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== METRICS ====================
+//
+// /metrics serves Prometheus text exposition format (version 0.0.4), written by
+// hand to stay free of client library dependencies. Request counters and
+// latency histograms are collected as requests happen; cache, key pool and
+// multiplayer figures are read from their existing counters at scrape time.
+
+// Latency buckets in seconds - cache hits are sub-millisecond, upstream fetches
+// take tens to hundreds of milliseconds
+var proxyLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// WebSocket message types the game sends; anything else is counted as "unknown"
+// so clients can't create unbounded label values
+var wsClientMessageTypes = map[string]bool{
+	"hello":           true,
+	"createSession":   true,
+	"joinSession":     true,
+	"toggleReady":     true,
+	"updateSettings":  true,
+	"kickPlayer":      true,
+	"startGame":       true,
+	"submitGuess":     true,
+	"requestLocation": true,
+	"nextRound":       true,
+	"locationFailed":  true,
+}
+
+// initMetrics creates the server's request metrics
+func (s *Server) initMetrics() {
+	s.proxyRequests = newCounterVec("gde_proxy_requests_total",
+		"Proxied requests by upstream path class, response status and cache result.", "class", "status", "cache")
+	s.proxyLatency = newHistogramVec("gde_proxy_request_duration_seconds",
+		"Proxied request latency by upstream path class and response status.", proxyLatencyBuckets, "class", "status")
+}
+
+// newWSMessageCounter creates the WebSocket message counter of a session registry
+func newWSMessageCounter() *counterVec {
+	return newCounterVec("gde_websocket_messages_total",
+		"WebSocket messages by direction (in = from clients) and type.", "direction", "type")
+}
+
+// counterVec is a counter with labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]*uint64 // Joined label values -> count
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]*uint64)}
+}
+
+// Inc adds one for the given label values
+func (c *counterVec) Inc(labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mutex.Lock()
+	value, ok := c.values[key]
+	if !ok {
+		value = new(uint64)
+		c.values[key] = value
+	}
+	c.mutex.Unlock()
+	atomic.AddUint64(value, 1)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	writeMetricHeader(w, c.name, c.help, "counter")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, strings.Split(key, "\xff")), atomic.LoadUint64(c.values[key]))
+	}
+}
+
+// histogramSeries is one label combination of a histogram
+type histogramSeries struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a histogram with labels
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+// Observe records one value for the given label values
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		values := strings.Split(key, "\xff")
+		bucketLabels := func(le string) string {
+			return formatLabels(labels, append(append([]string{}, values...), le))
+		}
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, bucketLabels(formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, bucketLabels("+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), s.count)
+	}
+}
+
+// sortedKeys returns map keys in order, for stable output
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders {name="value",...}
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + escapeLabelValue(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeLabelValue escapes backslashes, quotes and newlines
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeMetric writes a metric without labels
+func writeMetric(w io.Writer, name, help, kind string, value float64) {
+	writeMetricHeader(w, name, help, kind)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+// proxyPathClass groups upstream paths for metric labels: the endpoint after
+// v1/ for allowlisted paths ("maptiles", "panorama", "suggest", ...), "blocked"
+// for everything else so arbitrary paths can't create label values
+func (s *Server) proxyPathClass(apiPath string) string {
+	if !s.isPathAllowed(apiPath) {
+		return "blocked"
+	}
+	class := strings.TrimPrefix(apiPath, "v1/")
+	if i := strings.Index(class, "/"); i >= 0 {
+		class = class[:i]
+	}
+	if class == "" {
+		return "other"
+	}
+	return class
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// observeProxyRequest records a finished proxy request
+func (s *Server) observeProxyRequest(apiPath string, status int, cacheStatus string, elapsed time.Duration) {
+	class := s.proxyPathClass(apiPath)
+	statusLabel := strconv.Itoa(status)
+	if cacheStatus == "" {
+		cacheStatus = "none"
+	}
+	s.proxyRequests.Inc(class, statusLabel, strings.ToLower(cacheStatus))
+	s.proxyLatency.Observe(elapsed.Seconds(), class, statusLabel)
+}
+
+// countWSMessage records a WebSocket message; direction is "in" or "out"
+func (reg *sessionRegistry) countMessage(direction, msgType string) {
+	if direction == "in" && !wsClientMessageTypes[msgType] {
+		msgType = "unknown"
+	}
+	reg.messages.Inc(direction, msgType)
+}
+
+// metricsHandler serves all metrics
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	// Proxy
+	s.proxyRequests.write(w)
+	s.proxyLatency.write(w)
+
+	// Upstream key pool (IDs only)
+	s.keys.writeMetrics(w)
+
+	// Tile cache
+	cache := s.cache
+	writeMetric(w, "gde_cache_hits_total", "Cacheable requests served from the cache.", "counter", float64(atomic.LoadUint64(&cache.stats.hits)))
+	writeMetric(w, "gde_cache_misses_total", "Cacheable requests not found in the cache.", "counter", float64(atomic.LoadUint64(&cache.stats.misses)))
+	writeMetric(w, "gde_cache_saved_bytes_total", "Bytes served from the cache instead of upstream.", "counter", float64(atomic.LoadUint64(&cache.stats.savedBytes)))
+	writeMetric(w, "gde_cache_coalesced_total", "Requests that shared another request's upstream fetch.", "counter", float64(atomic.LoadUint64(&cache.stats.coalesced)))
+	writeMetric(w, "gde_cache_not_modified_total", "304 responses answered from cache validators.", "counter", float64(atomic.LoadUint64(&cache.stats.notModified)))
+	writeMetric(w, "gde_cache_revalidated_total", "Stale entries upstream confirmed unchanged.", "counter", float64(atomic.LoadUint64(&cache.stats.revalidated)))
+	writeMetric(w, "gde_cache_quarantined_total", "Corrupt or orphaned entries moved out of the cache.", "counter", float64(atomic.LoadUint64(&cache.stats.quarantined)))
+	writeMetricHeader(w, "gde_cache_evictions_total", "Entries removed by cleanup, by reason.", "counter")
+	fmt.Fprintf(w, "gde_cache_evictions_total{reason=\"expired\"} %d\n", atomic.LoadUint64(&cache.stats.expired))
+	fmt.Fprintf(w, "gde_cache_evictions_total{reason=\"size\"} %d\n", atomic.LoadUint64(&cache.stats.evicted))
+	size, count := cache.getCacheSize()
+	writeMetric(w, "gde_cache_size_bytes", "Size of the tile cache.", "gauge", float64(size))
+	writeMetric(w, "gde_cache_entries", "Entries in the tile cache.", "gauge", float64(count))
+	writeMetric(w, "gde_cache_max_size_bytes", "Configured tile cache size limit.", "gauge", float64(cache.settings().MaxSizeMB)*1024*1024)
+	cache.writeRuleMetrics(w)
+	if cache.mem != nil {
+		memHits, memMisses, memEntries, memSize := cache.mem.Stats()
+		writeMetric(w, "gde_cache_memory_hits_total", "Reads served from the in-memory tier.", "counter", float64(memHits))
+		writeMetric(w, "gde_cache_memory_misses_total", "Reads the in-memory tier couldn't serve.", "counter", float64(memMisses))
+		writeMetric(w, "gde_cache_memory_entries", "Entries in the in-memory tier.", "gauge", float64(memEntries))
+		writeMetric(w, "gde_cache_memory_size_bytes", "Size of the in-memory tier.", "gauge", float64(memSize))
+	}
+	writeMetric(w, "gde_cache_compression_original_bytes_total", "Size of compressed entries as received.", "counter", float64(atomic.LoadUint64(&cache.stats.originalBytes)))
+	writeMetric(w, "gde_cache_compression_stored_bytes_total", "Size of compressed entries as stored.", "counter", float64(atomic.LoadUint64(&cache.stats.storedBytes)))
+
+	// Multiplayer
+	sessions := s.sessions
+	sessionCount, playerCount := sessions.counts()
+	writeMetric(w, "gde_multiplayer_sessions", "Active multiplayer sessions.", "gauge", float64(sessionCount))
+	writeMetric(w, "gde_multiplayer_players", "Players in active multiplayer sessions.", "gauge", float64(playerCount))
+	writeMetric(w, "gde_multiplayer_games_started_total", "Multiplayer games started.", "counter", float64(atomic.LoadUint64(&sessions.gamesStarted)))
+	writeMetric(w, "gde_multiplayer_games_finished_total", "Multiplayer games that played all rounds.", "counter", float64(atomic.LoadUint64(&sessions.gamesFinished)))
+	writeMetric(w, "gde_websocket_connections", "Open WebSocket connections.", "gauge", float64(atomic.LoadInt64(&sessions.connections)))
+	sessions.messages.write(w)
+
+	// Process
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeMetric(w, "gde_process_start_time_seconds", "Start time of the process since the Unix epoch.", "gauge", float64(s.started.Unix()))
+	writeMetric(w, "go_goroutines", "Number of goroutines that currently exist.", "gauge", float64(runtime.NumGoroutine()))
+	writeMetric(w, "go_memstats_heap_alloc_bytes", "Heap bytes allocated and still in use.", "gauge", float64(mem.HeapAlloc))
+}
+
+// writeKeyMetrics writes upstream attempts and failures per API key ID
+func (p *keyPool) writeMetrics(w io.Writer) {
+	type keyCounts struct{ attempts, failures uint64 }
+	counts := make(map[string]keyCounts)
+	p.stats.Range(func(id, value interface{}) bool {
+		stats := value.(*apiKeyStats)
+		counts[id.(string)] = keyCounts{atomic.LoadUint64(&stats.requests), atomic.LoadUint64(&stats.failures)}
+		return true
+	})
+
+	ids := sortedKeys(counts)
+	writeMetricHeader(w, "gde_upstream_key_attempts_total", "Upstream requests per API key.", "counter")
+	for _, id := range ids {
+		fmt.Fprintf(w, "gde_upstream_key_attempts_total%s %d\n", formatLabels([]string{"key"}, []string{id}), counts[id].attempts)
+	}
+	writeMetricHeader(w, "gde_upstream_key_failures_total", "Upstream network errors and rejected keys (401/403) per API key.", "counter")
+	for _, id := range ids {
+		fmt.Fprintf(w, "gde_upstream_key_failures_total%s %d\n", formatLabels([]string{"key"}, []string{id}), counts[id].failures)
+	}
+}
+
+// writeCacheRuleMetrics writes hits, misses and usage per cache rule
+func (c *tileCache) writeRuleMetrics(w io.Writer) {
+	rules := c.getCacheRuleStats()
+	metrics := []struct {
+		name, help, kind string
+		value            func(cacheRuleStats) float64
+	}{
+		{"gde_cache_rule_hits_total", "Cache hits per cache rule.", "counter", func(s cacheRuleStats) float64 { return float64(s.Hits) }},
+		{"gde_cache_rule_misses_total", "Cache misses per cache rule.", "counter", func(s cacheRuleStats) float64 { return float64(s.Misses) }},
+		{"gde_cache_rule_size_bytes", "Cache size per cache rule.", "gauge", func(s cacheRuleStats) float64 { return float64(s.SizeBytes) }},
+		{"gde_cache_rule_entries", "Cache entries per cache rule.", "gauge", func(s cacheRuleStats) float64 { return float64(s.Entries) }},
+	}
+	for _, m := range metrics {
+		writeMetricHeader(w, m.name, m.help, m.kind)
+		for _, rule := range rules {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels([]string{"rule"}, []string{rule.Name}), formatFloat(m.value(rule)))
+		}
+	}
+}
+
+// counts returns the number of sessions and players
+func (reg *sessionRegistry) counts() (int, int) {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	players := 0
+	for _, session := range reg.sessions {
+		session.mutex.RLock()
+		players += len(session.Players)
+		session.mutex.RUnlock()
+	}
+	return len(reg.sessions), players
+}
+
+// ==================== END METRICS ====================
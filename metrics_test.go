@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// metricSample matches a sample line of the Prometheus text format
+var metricSample = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:\\.|[^"\\])*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:\\.|[^"\\])*")*\})? (\S+)$`)
+
+func TestMetricsFormat(t *testing.T) {
+	_, upstreamURL := newMockUpstreamServer(t, nil)
+	s := newProxyTestServer(t, upstreamURL, "good")
+	get(s, "/api/mapy/v1/maptiles/basic/256/10/600/300", nil)
+	get(s, "/api/mapy/v1/maptiles/basic/256/10/600/300", nil)
+	get(s, "/api/mapy/v1/routing/route", nil)
+
+	rec := get(s, "/metrics", nil)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("status = %d, Content-Type = %q, want 200 text/plain; version=0.0.4", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	types := make(map[string]string)
+	samples := make(map[string]string) // Name and labels -> value
+	var family string
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); len(fields) >= 4 && fields[0] == "#" {
+			switch fields[1] {
+			case "HELP":
+				family = fields[2]
+			case "TYPE":
+				if fields[2] != family {
+					t.Errorf("TYPE of %s follows HELP of %s", fields[2], family)
+				}
+				if _, dup := types[family]; dup {
+					t.Errorf("%s is declared twice", family)
+				}
+				types[family] = fields[3]
+			}
+			continue
+		}
+
+		m := metricSample.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("malformed line: %q", line)
+			continue
+		}
+		name := m[1]
+		if base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count"); types[base] == "histogram" {
+			name = base
+		}
+		if name != family {
+			t.Errorf("sample %s outside its family (in %s)", m[1], family)
+		}
+		if _, err := strconv.ParseFloat(m[3], 64); err != nil {
+			t.Errorf("%s: value %q isn't a number", m[1], m[3])
+		}
+		samples[m[1]+m[2]] = m[3]
+	}
+
+	for series, want := range map[string]string{
+		`gde_proxy_requests_total{class="maptiles",status="200",cache="miss"}`:               "1",
+		`gde_proxy_requests_total{class="maptiles",status="200",cache="hit"}`:                "1",
+		`gde_proxy_requests_total{class="blocked",status="403",cache="none"}`:                "1",
+		`gde_proxy_request_duration_seconds_bucket{class="maptiles",status="200",le="+Inf"}`: "2",
+		`gde_proxy_request_duration_seconds_count{class="maptiles",status="200"}`:            "2",
+		`gde_cache_hits_total`:     "1",
+		`gde_cache_misses_total`:   "1",
+		`gde_cache_entries`:        "1",
+		`gde_multiplayer_sessions`: "0",
+	} {
+		if got, ok := samples[series]; !ok || got != want {
+			t.Errorf("%s = %q (present %t), want %s", series, got, ok, want)
+		}
+	}
+	for family, kind := range map[string]string{
+		"gde_proxy_requests_total":           "counter",
+		"gde_proxy_request_duration_seconds": "histogram",
+		"gde_cache_size_bytes":               "gauge",
+		"go_goroutines":                      "gauge",
+	} {
+		if types[family] != kind {
+			t.Errorf("TYPE of %s = %q, want %s", family, types[family], kind)
+		}
+	}
+
+	// Histogram buckets are cumulative
+	var previous float64
+	for _, bound := range proxyLatencyBuckets {
+		value, _ := strconv.ParseFloat(samples[`gde_proxy_request_duration_seconds_bucket{class="maptiles",status="200",le="`+formatFloat(bound)+`"}`], 64)
+		if value < previous {
+			t.Errorf("bucket le=%s = %v, less than the one before", formatFloat(bound), value)
+		}
+		previous = value
+	}
+}
+
+func TestMetricsEscapeLabelValues(t *testing.T) {
+	got := formatLabels([]string{"a", "b"}, []string{`say "hi"\`, "two\nlines"})
+	if want := `{a="say \"hi\"\\",b="two\nlines"}`; got != want {
+		t.Errorf("formatLabels = %s, want %s", got, want)
+	}
+	if formatLabels(nil, nil) != "" {
+		t.Error("labels without names aren't empty")
+	}
+}
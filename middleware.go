@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// ==================== MIDDLEWARE ====================
+//
+// Every request passes through the same chain before reaching its route in
+// Server.routes: request ID, request logging, panic recovery and CORS. Routes
+// add their own middleware on top, like rate limiting for WebSocket
+// connections. The proxy applies the rate limit itself, after the cache
+// lookup, so cache hits stay free. Static assets are compressed ahead of time
+// (see static.go).
+
+// middleware wraps a handler with shared behaviour
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h so a request passes through mws in order, then h
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// requestID tags every request with an ID for its log lines (see logging.go)
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, withRequestID(w, r))
+	})
+}
+
+// recoverPanics turns a handler panic into a 500 and a logged stack trace
+// instead of a dropped connection
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err) // net/http's way of aborting a response
+				}
+				requestLog(r).With("method", r.Method, "path", r.URL.Path, "stack", string(debug.Stack())).Error("💥 Panic: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logRequests logs every request with its status and duration at DEBUG. It
+// runs outside recoverPanics, so requests that panicked are logged with their 500.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		requestLog(r).With("method", r.Method, "path", r.URL.Path, "status", recorder.status, "duration", time.Since(start).Round(time.Millisecond)).Debug("➡️ Request")
+	})
+}
+
+// CORS response headers; the game only sends simple GET/POST requests
+const (
+	corsAllowMethods = "GET, POST, OPTIONS"
+	corsAllowHeaders = "Content-Type"
+)
+
+// corsOrigin returns the Access-Control-Allow-Origin value for a request
+// Origin, empty when server.cors_origins doesn't allow it
+func (s *Server) corsOrigin(origin string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, allowed := range s.server.CORSOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// cors adds CORS headers for allowed origins and answers preflight requests
+func (s *Server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			allowOrigin := s.corsOrigin(origin)
+			if allowOrigin != "*" {
+				// Shared caches must keep answers for different origins apart
+				w.Header().Add("Vary", "Origin")
+			}
+			if allowOrigin != "" {
+				w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			}
+		}
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkWebSocketOrigin allows WebSocket connections from the server's own
+// host and from server.cors_origins
+func (s *Server) checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // Not a browser
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return s.corsOrigin(origin) != ""
+}
+
+// rateLimit applies the per-client rate limit (see ratelimit.go)
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.allowRequest(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Hijack lets WebSocket upgrades through writers wrapped by middleware
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer doesn't support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// ==================== END MIDDLEWARE ====================
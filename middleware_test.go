@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []string
+		origin  string
+		want    string // Access-Control-Allow-Origin, empty for none
+		vary    bool
+	}{
+		{"same-origin only by default", nil, "https://other.example", "", true},
+		{"listed origin", []string{"https://game.example"}, "https://game.example", "https://game.example", true},
+		{"origin case", []string{"https://game.example"}, "https://GAME.example", "https://GAME.example", true},
+		{"unlisted origin", []string{"https://game.example"}, "https://other.example", "", true},
+		{"any origin", []string{"*"}, "https://other.example", "*", false},
+		{"no origin header", nil, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(cfg *Config) { cfg.Server.CORSOrigins = tt.origins })
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+
+			rec := get(s, "/api/version", header)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.want)
+			}
+			if got := rec.Header().Get("Vary") == "Origin"; got != tt.vary {
+				t.Errorf("Vary = %q, want Origin: %t", rec.Header().Get("Vary"), tt.vary)
+			}
+
+			// Preflights are answered without reaching the route
+			req := httptest.NewRequest(http.MethodOptions, "/api/admin/cache/clear", nil)
+			req.Header = header.Clone()
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			rec = httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("preflight status = %d, want 204", rec.Code)
+			}
+			allowed := rec.Header().Get("Access-Control-Allow-Origin") != ""
+			if allowed != (tt.want != "") {
+				t.Errorf("preflight Access-Control-Allow-Origin = %q", rec.Header().Get("Access-Control-Allow-Origin"))
+			}
+			if allowed && rec.Header().Get("Access-Control-Allow-Methods") != corsAllowMethods {
+				t.Errorf("preflight Access-Control-Allow-Methods = %q", rec.Header().Get("Access-Control-Allow-Methods"))
+			}
+		})
+	}
+}
+
+func TestCheckWebSocketOrigin(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.Server.CORSOrigins = []string{"https://game.example"} })
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://example.com", true}, // httptest requests go to example.com
+		{"https://game.example", true},
+		{"https://other.example", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if got := s.checkWebSocketOrigin(req); got != tt.want {
+			t.Errorf("origin %q: allowed = %t, want %t", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.Server.CORSOrigins = []string{"*"} })
+	h := s.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", "https://game.example")
+	req.Header.Set("X-Request-ID", "panic-1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rec.Code)
+	}
+	// Headers set by outer middleware survive the panic
+	if got := rec.Header().Get("X-Request-ID"); got != "panic-1" {
+		t.Errorf("X-Request-ID = %q, want panic-1", got)
+	}
+
+	// http.ErrAbortHandler still aborts the connection
+	abort := s.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", err)
+		}
+	}()
+	abort.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	t.Error("ErrAbortHandler was swallowed")
+}
+
+func TestRequestID(t *testing.T) {
+	s := newTestServer(t, nil)
+	tests := []struct {
+		incoming string
+		keep     bool
+	}{
+		{"", false},
+		{"abc-123.x:y_z", true},
+		{"has space", false},
+		{"<script>", false},
+		{string(make([]byte, 65)), false},
+	}
+	seen := make(map[string]bool)
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.incoming != "" {
+			header.Set("X-Request-ID", tt.incoming)
+		}
+		id := get(s, "/healthz", header).Header().Get("X-Request-ID")
+		if tt.keep && id != tt.incoming {
+			t.Errorf("X-Request-ID %q replaced with %q", tt.incoming, id)
+		}
+		if !tt.keep && (id == tt.incoming || !requestIDPattern.MatchString(id)) {
+			t.Errorf("X-Request-ID %q answered with %q, want a new ID", tt.incoming, id)
+		}
+		if seen[id] {
+			t.Errorf("X-Request-ID %q reused", id)
+		}
+		seen[id] = true
+	}
+}
+
+// The proxy rate limit runs after the cache lookup and inside the shared chain
+func TestRateLimitOrdering(t *testing.T) {
+	mock, upstreamURL := newMockUpstreamServer(t, nil)
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Proxy.UpstreamURL = upstreamURL
+		cfg.APIKeys = []map[string]string{{"good": "good"}}
+		cfg.Proxy.RateLimit.RequestsPerSecond = 0.001
+		cfg.Proxy.RateLimit.Burst = 1
+		cfg.Server.CORSOrigins = []string{"*"}
+	})
+
+	const tile = "v1/maptiles/basic/256/10/550/300"
+	if rec := get(s, "/api/mapy/"+tile, nil); rec.Code != http.StatusOK {
+		t.Fatalf("first request: status = %d", rec.Code)
+	}
+
+	// Cache hits don't spend tokens
+	for i := 0; i < 5; i++ {
+		if rec := get(s, "/api/mapy/"+tile, nil); rec.Code != http.StatusOK {
+			t.Fatalf("cache hit %d: status = %d", i+1, rec.Code)
+		}
+	}
+	if n := mock.requestCount(tile, ""); n != 1 {
+		t.Errorf("upstream saw %d requests, want 1", n)
+	}
+
+	// A miss past the burst is refused before reaching the upstream, with the
+	// headers of the middleware around it
+	const other = "v1/maptiles/basic/256/10/551/300"
+	rec := get(s, "/api/mapy/"+other, http.Header{"Origin": {"https://game.example"}})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("miss past the burst: status = %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+	if rec.Header().Get("X-Request-ID") == "" || rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("429 headers = %v, want a request ID and CORS", rec.Header())
+	}
+	if n := mock.requestCount(other, ""); n != 0 {
+		t.Errorf("upstream saw %d requests for the limited path", n)
+	}
+
+	// WebSocket connections are limited before the upgrade
+	if rec := get(s, "/ws", nil); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("/ws past the burst: status = %d, want 429", rec.Code)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== MOCK UPSTREAM ====================
+//
+// A fake Mapy.cz API for offline development and tests. Point the proxy at it
+// with `proxy.upstream_url: "http://localhost:9000/"` in settings.yaml and run
+// `./server mock-upstream`.
+//
+// Map and panorama tiles are generated on the fly; everything else is served
+// from JSON fixture files under the fixtures dir, mirroring the API path
+// (e.g. `v1/panorama` -> `mockdata/v1/panorama.json`).
+
+// mockLastModified is the Last-Modified date of every generated tile
+const mockLastModified = "Mon, 02 Jan 2023 15:04:05 GMT"
+
+var (
+	mockMapTilePattern   = regexp.MustCompile(`^v1/maptiles/[^/]+/(\d+)/(\d+)/(\d+)/(\d+)`)
+	mockPanoTilePattern  = regexp.MustCompile(`^v1/panorama/tiles/`)
+	mockThumbnailPattern = regexp.MustCompile(`^v1/panorama/\d+/thumbnail`)
+)
+
+// mockUpstream holds the fake API state
+type mockUpstream struct {
+	fixturesDir string
+	latency     time.Duration
+
+	mutex     sync.RWMutex
+	keyStatus map[string]int            // API key value -> forced HTTP status
+	requests  map[string]map[string]int // API path -> key -> request count
+}
+
+// parseKeyStatuses parses "key=status,key=status" into a map
+func parseKeyStatuses(spec string) (map[string]int, error) {
+	statuses := make(map[string]int)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid key status %q, expected key=status", pair)
+		}
+		status, err := strconv.Atoi(parts[1])
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("invalid HTTP status in %q", pair)
+		}
+		statuses[parts[0]] = status
+	}
+	return statuses, nil
+}
+
+// runMockUpstream starts the fake Mapy.cz API (`server mock-upstream [flags]`)
+func runMockUpstream(args []string) {
+	fs := flag.NewFlagSet("mock-upstream", flag.ExitOnError)
+	addr := fs.String("addr", ":9000", "listen address")
+	fixtures := fs.String("fixtures", "mockdata", "directory with JSON fixture files")
+	keys := fs.String("keys", "", "per-key forced statuses, e.g. \"revoked=401,blocked=403,quota=429,flaky=503\"")
+	latency := fs.Duration("latency", 0, "artificial delay added to every response")
+	fs.Parse(args)
+
+	keyStatus, err := parseKeyStatuses(*keys)
+	if err != nil {
+		logError("%v", err)
+		os.Exit(2)
+	}
+
+	mock := &mockUpstream{
+		fixturesDir: *fixtures,
+		latency:     *latency,
+		keyStatus:   keyStatus,
+		requests:    make(map[string]map[string]int),
+	}
+
+	logInfo("🧪 Mock upstream running on http://localhost%s (fixtures: %s)", *addr, *fixtures)
+	for key, status := range keyStatus {
+		logInfo("🧪 Key %q will answer HTTP %d", key, status)
+	}
+
+	if err := http.ListenAndServe(*addr, mock); err != nil {
+		logError("Failed to start mock upstream: %v", err)
+		os.Exit(1)
+	}
+}
+
+// ServeHTTP dispatches control endpoints and fake API requests
+func (m *mockUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+
+	switch path {
+	case "_mock/stats":
+		m.handleStats(w, r)
+		return
+	case "_mock/keys":
+		m.handleKeys(w, r)
+		return
+	}
+
+	if m.latency > 0 {
+		time.Sleep(m.latency)
+	}
+
+	key := r.URL.Query().Get("apikey")
+	if key == "" {
+		key = r.URL.Query().Get("apiKey")
+	}
+	if key == "" {
+		key = r.Header.Get("X-Mapy-Api-Key")
+	}
+
+	m.mutex.Lock()
+	if m.requests[path] == nil {
+		m.requests[path] = make(map[string]int)
+	}
+	m.requests[path][key]++
+	status, forced := m.keyStatus[key]
+	m.mutex.Unlock()
+
+	logDebug("🧪 Mock %s %s [key=%s]", r.Method, path, key)
+
+	if key == "" {
+		mockError(w, http.StatusUnauthorized, "API key is missing")
+		return
+	}
+	if forced && status != http.StatusOK {
+		mockError(w, status, http.StatusText(status))
+		return
+	}
+
+	// Tiles never change, so they carry stable validators and honor conditional requests
+	if mockMapTilePattern.MatchString(path) || mockPanoTilePattern.MatchString(path) || mockThumbnailPattern.MatchString(path) {
+		etag := fmt.Sprintf(`"mock-%08x"`, mockSeed(path))
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", mockLastModified)
+		if r.Header.Get("If-None-Match") == etag || (r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == mockLastModified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	switch {
+	case mockMapTilePattern.MatchString(path):
+		m.serveMapTile(w, path)
+	case mockPanoTilePattern.MatchString(path), mockThumbnailPattern.MatchString(path):
+		m.servePanoramaTile(w, path)
+	default:
+		m.serveFixture(w, path)
+	}
+}
+
+// serveMapTile renders a PNG tile whose color depends on z/x/y
+func (m *mockUpstream) serveMapTile(w http.ResponseWriter, path string) {
+	match := mockMapTilePattern.FindStringSubmatch(path)
+	size, _ := strconv.Atoi(match[1])
+	z, _ := strconv.Atoi(match[2])
+	x, _ := strconv.Atoi(match[3])
+	y, _ := strconv.Atoi(match[4])
+	if size <= 0 || size > 1024 {
+		size = 256
+	}
+
+	img := mockImage(size, size, color.RGBA{uint8(z * 12), uint8(x % 256), uint8(y % 256), 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		mockError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// servePanoramaTile renders a JPEG tile seeded by the request path
+func (m *mockUpstream) servePanoramaTile(w http.ResponseWriter, path string) {
+	seed := mockSeed(path)
+	img := mockImage(512, 512, color.RGBA{uint8(seed), uint8(seed >> 8), uint8(seed >> 16), 255})
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 60}); err != nil {
+		mockError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// serveFixture returns `<fixtures>/<path>.json`, or 404 if there is none
+func (m *mockUpstream) serveFixture(w http.ResponseWriter, path string) {
+	clean := filepath.Clean("/" + path)
+	data, err := os.ReadFile(filepath.Join(m.fixturesDir, clean+".json"))
+	if err != nil {
+		mockError(w, http.StatusNotFound, "no fixture for "+path)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// handleStats reports how many requests each path/key received
+func (m *mockUpstream) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		m.mutex.Lock()
+		m.requests = make(map[string]map[string]int)
+		m.mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.requests)
+}
+
+// handleKeys shows or changes forced per-key statuses at runtime
+// (POST /_mock/keys?key=quota&status=429, status=200 clears the override)
+func (m *mockUpstream) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		key := r.URL.Query().Get("key")
+		status, err := strconv.Atoi(r.URL.Query().Get("status"))
+		if key == "" || err != nil || status < 100 || status > 599 {
+			mockError(w, http.StatusBadRequest, "key and a valid status are required")
+			return
+		}
+		m.mutex.Lock()
+		if status == http.StatusOK {
+			delete(m.keyStatus, key)
+		} else {
+			m.keyStatus[key] = status
+		}
+		m.mutex.Unlock()
+		logInfo("🧪 Key %q will answer HTTP %d", key, status)
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.keyStatus)
+}
+
+// mockSeed derives a stable number from a request path
+func mockSeed(path string) uint32 {
+	var seed uint32
+	for _, c := range path {
+		seed = seed*31 + uint32(c)
+	}
+	return seed
+}
+
+// mockImage returns a solid image with a diagonal stripe so tiles are distinguishable
+func mockImage(width, height int, fill color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x == y {
+				img.Set(x, y, color.Black)
+			} else {
+				img.Set(x, y, fill)
+			}
+		}
+	}
+	return img
+}
+
+// mockError writes an error body shaped like the Mapy.cz API's
+func mockError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  status,
+		"message": message,
+	})
+}
+
+// ==================== END MOCK UPSTREAM ====================
@@ -5,21 +5,15 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for development
-	},
-}
-
 type Player struct {
 	ID        string          `json:"id"`
 	Nick      string          `json:"nick"`
@@ -28,6 +22,8 @@ type Player struct {
 	IsOwner   bool            `json:"isOwner"`
 	Conn      *websocket.Conn `json:"-"`
 	Session   *GameSession    `json:"-"`
+	registry  *sessionRegistry
+	writeMutex sync.Mutex     // One writer at a time: handlers, timers and shutdown all send
 	HasGuess  bool            `json:"hasGuess"`
 	Score     int             `json:"score"`
 	GuessLat  float64         `json:"guessLat,omitempty"`
@@ -45,6 +41,8 @@ type GameSession struct {
 	Location    *Location          `json:"location,omitempty"`
 	StartTime   time.Time          `json:"startTime,omitempty"`
 	TimerCancel chan bool          `json:"-"` // Channel to cancel active timer
+	RoundActive bool               `json:"-"` // A round is being played (shutdown waits for it)
+	registry    *sessionRegistry
 	mutex       sync.RWMutex
 }
 
@@ -87,10 +85,44 @@ type WSMessage struct {
 	Payload interface{} `json:"payload"`
 }
 
-var (
-	sessions      = make(map[string]*GameSession)
-	sessionsMutex sync.RWMutex
-)
+// nextRoundDelay is the pause between a round's results and the next round
+var nextRoundDelay = 5 * time.Second
+
+// sessionRegistry holds a server's multiplayer sessions and their counters
+type sessionRegistry struct {
+	sessions map[string]*GameSession
+	mutex    sync.RWMutex
+	limits   MultiplayerConfig // Guarded by mutex, swapped on config reload
+	draining int32             // Set on shutdown: no new sessions, games or rounds (see shutdown.go)
+	
+	// Metrics (see metrics.go)
+	messages      *counterVec
+	connections   int64  // Open WebSocket connections
+	gamesStarted  uint64 // Games started
+	gamesFinished uint64 // Games that played all rounds
+}
+
+func newSessionRegistry(limits MultiplayerConfig) *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[string]*GameSession),
+		limits:   limits,
+		messages: newWSMessageCounter(),
+	}
+}
+
+// settings returns the current multiplayer limits
+func (reg *sessionRegistry) settings() MultiplayerConfig {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+	return reg.limits
+}
+
+// setLimits applies new limits; sessions already over them keep their players
+func (reg *sessionRegistry) setLimits(limits MultiplayerConfig) {
+	reg.mutex.Lock()
+	reg.limits = limits
+	reg.mutex.Unlock()
+}
 
 // Parse custom region from JSON map
 func parseCustomRegion(data map[string]interface{}) *CustomRegion {
@@ -166,7 +198,7 @@ func generateSessionCode() string {
 }
 
 // Create new session
-func createSession(owner *Player, initialSettings *GameSettings) *GameSession {
+func (reg *sessionRegistry) createSession(owner *Player, initialSettings *GameSettings) (*GameSession, error) {
 	code := generateSessionCode()
 	
 	// Default settings
@@ -207,39 +239,43 @@ func createSession(owner *Player, initialSettings *GameSettings) *GameSession {
 		Round:       0,
 		TimerCancel: make(chan bool, 1),
 		Settings:    settings,
+		registry:    reg,
 	}
 	
-	owner.Session = session
-	owner.IsOwner = true
 	session.Players[owner.ID] = owner
 	
-	sessionsMutex.Lock()
-	sessions[code] = session
-	sessionsMutex.Unlock()
+	reg.mutex.Lock()
+	if max := reg.limits.MaxSessions; max > 0 && len(reg.sessions) >= max {
+		reg.mutex.Unlock()
+		logWith("limit", max).Warn("Session limit reached")
+		return nil, fmt.Errorf("too many sessions on this server, try again later")
+	}
+	reg.sessions[code] = session
+	reg.mutex.Unlock()
 	
-	return session
+	owner.Session = session
+	owner.IsOwner = true
+	
+	return session, nil
 }
 
 // Join existing session
-func joinSession(code string, player *Player) (*GameSession, error) {
+func (reg *sessionRegistry) joinSession(code string, player *Player) (*GameSession, error) {
 	// Convert to lowercase for case-insensitive lookup
 	code = strings.ToLower(code)
 	
-	sessionsMutex.RLock()
-	log.Printf("Attempting to join session: %s", code)
-	log.Printf("Available sessions: %d total", len(sessions))
-	for k := range sessions {
-		log.Printf("  - Session: %s", k)
-	}
-	session, exists := sessions[code]
-	sessionsMutex.RUnlock()
+	reg.mutex.RLock()
+	sessionLog(code, player.ID).With("sessions", len(reg.sessions)).Debug("Attempting to join session")
+	session, exists := reg.sessions[code]
+	maxPlayers := reg.limits.MaxPlayers
+	reg.mutex.RUnlock()
 	
 	if !exists {
-		log.Printf("Session not found: %s", code)
+		sessionLog(code, player.ID).Info("Session not found")
 		return nil, fmt.Errorf("session not found")
 	}
 	
-	log.Printf("Session found: %s with %d players", code, len(session.Players))
+	sessionLog(code, player.ID).With("players", len(session.Players)).Debug("Session found")
 	
 	session.mutex.Lock()
 	defer session.mutex.Unlock()
@@ -247,6 +283,9 @@ func joinSession(code string, player *Player) (*GameSession, error) {
 	if session.State != "lobby" {
 		return nil, fmt.Errorf("game already started")
 	}
+	if maxPlayers > 0 && len(session.Players) >= maxPlayers {
+		return nil, fmt.Errorf("session is full")
+	}
 	
 	player.Session = session
 	session.Players[player.ID] = player
@@ -266,20 +305,36 @@ func (s *GameSession) broadcast(msgType string, payload interface{}) {
 	
 	data, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("Error marshaling message: %v", err)
+		sessionLog(s.Code, "").With("type", msgType).Error("Error marshaling message: %v", err)
 		return
 	}
 	
 	for _, player := range s.Players {
 		if player.Conn != nil {
-			err := player.Conn.WriteMessage(websocket.TextMessage, data)
+			s.registry.countMessage("out", msgType)
+			err := player.write(data)
 			if err != nil {
-				log.Printf("Error sending to player %s: %v", player.Nick, err)
+				sessionLog(s.Code, player.ID).With("type", msgType, "nick", player.Nick).Warn("Error sending message: %v", err)
 			}
 		}
 	}
 }
 
+// log returns a logger tagged with the player's session code and ID
+func (p *Player) log() fieldLogger {
+	if p.Session == nil {
+		return sessionLog("", p.ID)
+	}
+	return sessionLog(p.Session.Code, p.ID)
+}
+
+// write sends an encoded message to the player's connection
+func (p *Player) write(data []byte) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+	return p.Conn.WriteMessage(websocket.TextMessage, data)
+}
+
 // Send message to specific player
 func (p *Player) send(msgType string, payload interface{}) {
 	msg := WSMessage{
@@ -289,20 +344,21 @@ func (p *Player) send(msgType string, payload interface{}) {
 	
 	data, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("Error marshaling message: %v", err)
+		p.log().With("type", msgType).Error("Error marshaling message: %v", err)
 		return
 	}
 	
 	if p.Conn != nil {
-		err := p.Conn.WriteMessage(websocket.TextMessage, data)
+		p.registry.countMessage("out", msgType)
+		err := p.write(data)
 		if err != nil {
-			log.Printf("Error sending to player %s: %v", p.Nick, err)
+			p.log().With("type", msgType, "nick", p.Nick).Warn("Error sending message: %v", err)
 		}
 	}
 }
 
 // Send error message directly to a connection (before player is created)
-func sendErrorToConn(conn *websocket.Conn, message string) {
+func (reg *sessionRegistry) sendErrorToConn(conn *websocket.Conn, message string) {
 	msg := WSMessage{
 		Type:    "error",
 		Payload: map[string]string{"message": message},
@@ -310,11 +366,12 @@ func sendErrorToConn(conn *websocket.Conn, message string) {
 	
 	data, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("Error marshaling error message: %v", err)
+		logError("Error marshaling error message: %v", err)
 		return
 	}
 	
 	if conn != nil {
+		reg.countMessage("out", msg.Type)
 		conn.WriteMessage(websocket.TextMessage, data)
 	}
 }
@@ -352,14 +409,14 @@ func (s *GameSession) removePlayer(playerID string) {
 		default:
 		}
 		
-		sessionsMutex.Lock()
-		delete(sessions, s.Code)
-		sessionsMutex.Unlock()
+		s.registry.mutex.Lock()
+		delete(s.registry.sessions, s.Code)
+		s.registry.mutex.Unlock()
 		
-		log.Printf("Session %s deleted (no players left)", s.Code)
+		sessionLog(s.Code, playerID).Info("Session deleted (no players left)")
 	} else {
 		// Notify remaining players (mutex already unlocked)
-		log.Printf("Broadcasting playerLeft for %s to %d remaining players in session %s", playerID, len(s.Players), s.Code)
+		sessionLog(s.Code, playerID).With("players", len(s.Players)).Info("Player left")
 		s.broadcast("playerLeft", map[string]interface{}{
 			"playerId": playerID,
 			"players":  s.getPlayersList(),
@@ -422,13 +479,23 @@ func (s *GameSession) allPlayersReady() bool {
 }
 
 // Handle WebSocket connection
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+func (srv *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	reg := srv.sessions
+	upgrader := websocket.Upgrader{CheckOrigin: srv.checkWebSocketOrigin}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		logWarn("WebSocket upgrade error: %v", err)
 		return
 	}
 	defer conn.Close()
+	conn.SetReadLimit(int64(reg.settings().MaxMessageKB) * 1024)
+	
+	atomic.AddInt64(&reg.connections, 1)
+	defer atomic.AddInt64(&reg.connections, -1)
+	
+	// Versions first, so mismatched clients are stopped before any game message (see version.go)
+	reg.sendHello(conn)
+	greeted := false
 	
 	var player *Player
 	
@@ -442,16 +509,29 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 		
-		handleMessage(conn, &player, msg)
+		reg.countMessage("in", msg.Type)
+		if !greeted {
+			if !reg.checkHello(conn, msg) {
+				return
+			}
+			greeted = true
+			continue
+		}
+		reg.handleMessage(conn, &player, msg)
 	}
 }
 
-func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
+func (reg *sessionRegistry) handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 	switch msg.Type {
 	case "createSession":
+		if reg.isDraining() {
+			reg.sendErrorToConn(conn, "Server is shutting down")
+			return
+		}
+		
 		payload, ok := msg.Payload.(map[string]interface{})
 		if !ok {
-			log.Printf("Invalid createSession payload")
+			logWarn("Invalid createSession payload")
 			return
 		}
 		
@@ -471,6 +551,7 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 			IsReady: false,
 			Conn:    conn,
 			Score:   0,
+			registry: reg,
 		}
 		
 		// Parse initial settings if provided
@@ -506,9 +587,13 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 			}
 		}
 		
-		session := createSession(*player, initialSettings)
+		session, err := reg.createSession(*player, initialSettings)
+		if err != nil {
+			(*player).send("error", map[string]string{"message": err.Error()})
+			return
+		}
 	
-		log.Printf("Session created: %s", session.Code)
+		(*player).log().Info("Session created")
 	
 		(*player).send("sessionCreated", map[string]interface{}{
 			"code":     session.Code,
@@ -518,9 +603,14 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 		})
 		
 	case "joinSession":
+		if reg.isDraining() {
+			reg.sendErrorToConn(conn, "Server is shutting down")
+			return
+		}
+		
 		payload, ok := msg.Payload.(map[string]interface{})
 		if !ok {
-			log.Printf("Invalid joinSession payload")
+			logWarn("Invalid joinSession payload")
 			return
 		}
 		
@@ -535,7 +625,7 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 			icon = "😀"
 		}
 		if code == "" {
-			sendErrorToConn(conn, "Session code is required")
+			reg.sendErrorToConn(conn, "Session code is required")
 			return
 		}
 		
@@ -546,13 +636,15 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 			IsReady: false,
 			Conn:    conn,
 			Score:   0,
+			registry: reg,
 		}
 		
-		session, err := joinSession(code, *player)
+		session, err := reg.joinSession(code, *player)
 		if err != nil {
 			(*player).send("error", map[string]string{"message": err.Error()})
 			return
 		}
+		(*player).log().Info("Player joined")
 		
 		(*player).send("sessionJoined", map[string]interface{}{
 			"code":     session.Code,
@@ -640,7 +732,7 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 		session.mutex.RUnlock()
 		
 		if exists && targetPlayer.ID != (*player).ID {
-			log.Printf("Kicking player %s from session %s", targetID, session.Code)
+			sessionLog(session.Code, targetID).With("by", (*player).ID).Info("Kicking player")
 			
 			// Save connection reference before removing
 			targetConn := targetPlayer.Conn
@@ -667,10 +759,17 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 			(*player).send("error", map[string]string{"message": "Not all players are ready"})
 			return
 		}
+		if reg.isDraining() {
+			(*player).send("error", map[string]string{"message": "Server is shutting down"})
+			return
+		}
+		
+		atomic.AddUint64(&reg.gamesStarted, 1)
 		
 		session.mutex.Lock()
 		session.State = "playing"
 		session.Round = 1
+		session.RoundActive = true
 		// Reset all players' guess status
 		for _, p := range session.Players {
 			p.HasGuess = false
@@ -713,11 +812,14 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 				allSubmitted = false
 			}
 		}
+		if allSubmitted {
+			session.RoundActive = false
+		}
 		session.mutex.Unlock()
 		
 		// If all players submitted, end round immediately
 		if allSubmitted {
-			log.Printf("All players submitted in session %s", session.Code)
+			sessionLog(session.Code, "").Info("All players submitted")
 			
 			// Cancel any existing 60-second timer
 			select {
@@ -733,7 +835,7 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 			
 			// Start 5-second countdown for next round (with its own cancel channel)
 			go func(s *GameSession) {
-				timer := time.NewTimer(5 * time.Second)
+				timer := time.NewTimer(nextRoundDelay)
 				nextRoundCancel := make(chan bool, 1)
 				
 				// Replace the cancel channel so new cancellations don't affect this timer
@@ -749,13 +851,17 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 					
 					// Check if game is finished (5 rounds total)
 					if currentRound >= 5 {
-						log.Printf("Game finished for session %s", s.Code)
+						sessionLog(s.Code, "").Info("Game finished")
+						atomic.AddUint64(&reg.gamesFinished, 1)
 						s.broadcast("gameFinished", map[string]interface{}{
 							"players": s.getPlayerResults(),
 						})
+					} else if reg.isDraining() {
+						sessionLog(s.Code, "").With("round", currentRound+1).Info("Not starting round, server is shutting down")
 					} else {
 						s.mutex.Lock()
 						s.Round++
+						s.RoundActive = true
 						s.Location = nil
 						for _, p := range s.Players {
 							p.HasGuess = false
@@ -765,14 +871,14 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 						}
 						s.mutex.Unlock()
 						
-						log.Printf("Starting next round %d for session %s", s.Round, s.Code)
+						sessionLog(s.Code, "").With("round", s.Round).Info("Starting next round")
 						s.broadcast("startNextRound", map[string]interface{}{
 							"round": s.Round,
 						})
 					}
 				case <-nextRoundCancel:
 					timer.Stop()
-					log.Printf("Next round timer cancelled for session %s", s.Code)
+					sessionLog(s.Code, "").Debug("Next round timer cancelled")
 				}
 			}(session)
 			
@@ -792,21 +898,26 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 			session.TimerCancel = newTimerCancel
 			session.mutex.Unlock()
 			
-			log.Printf("Starting 10-second timer for session %s", session.Code)
+			guessTimer := reg.settings().GuessTimerSeconds
+			sessionLog(session.Code, "").With("seconds", guessTimer).Debug("Starting guess timer")
 			
 			session.broadcast("timerStarted", map[string]interface{}{
-				"duration": 10,
+				"duration": guessTimer,
 			})
 			
 			// Start timer goroutine with cancellation support
 			go func(s *GameSession, cancelChan chan bool) {
-				log.Printf("Timer goroutine started for session %s", s.Code)
-				timer := time.NewTimer(10 * time.Second)
+				sessionLog(s.Code, "").Debug("Timer goroutine started")
+				timer := time.NewTimer(time.Duration(guessTimer) * time.Second)
 				
 				select {
 				case <-timer.C:
 					// Timer completed normally
-					log.Printf("10-second timer expired for session %s", s.Code)
+					sessionLog(s.Code, "").With("seconds", guessTimer).Debug("Guess timer expired")
+					
+					s.mutex.Lock()
+					s.RoundActive = false
+					s.mutex.Unlock()
 					
 					// Broadcast round end with all player results
 					s.broadcast("roundEnd", map[string]interface{}{
@@ -815,7 +926,7 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 					})
 					
 					// Wait 5 seconds before next round (with new cancel channel)
-					nextRoundTimer := time.NewTimer(5 * time.Second)
+					nextRoundTimer := time.NewTimer(nextRoundDelay)
 					nextRoundCancel := make(chan bool, 1)
 					
 					// Replace the cancel channel so new cancellations don't affect this timer
@@ -831,14 +942,18 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 						
 						// Check if game is finished (5 rounds total)
 						if currentRound >= 5 {
-							log.Printf("Game finished for session %s", s.Code)
+							sessionLog(s.Code, "").Info("Game finished")
+							atomic.AddUint64(&reg.gamesFinished, 1)
 							s.broadcast("gameFinished", map[string]interface{}{
 								"players": s.getPlayerResults(),
 							})
+						} else if reg.isDraining() {
+							sessionLog(s.Code, "").With("round", currentRound+1).Info("Not starting round, server is shutting down")
 						} else {
 							// Auto-start next round
 							s.mutex.Lock()
 							s.Round++
+							s.RoundActive = true
 							s.Location = nil
 							for _, p := range s.Players {
 								p.HasGuess = false
@@ -848,7 +963,7 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 							}
 							s.mutex.Unlock()
 							
-							log.Printf("Starting next round %d for session %s", s.Round, s.Code)
+							sessionLog(s.Code, "").With("round", s.Round).Info("Starting next round")
 							s.broadcast("startNextRound", map[string]interface{}{
 								"round": s.Round,
 							})
@@ -856,13 +971,13 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 					case <-nextRoundCancel:
 						// Cancelled during 5-second wait
 						nextRoundTimer.Stop()
-						log.Printf("Next round timer cancelled for session %s", s.Code)
+						sessionLog(s.Code, "").Debug("Next round timer cancelled")
 					}
 					
 				case <-cancelChan:
 					// Timer was cancelled
 					timer.Stop()
-					log.Printf("Round timer cancelled for session %s", s.Code)
+					sessionLog(s.Code, "").Debug("Round timer cancelled")
 				}
 			}(session, newTimerCancel)
 		}
@@ -896,7 +1011,7 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 			if date, ok := payload["date"].(string); ok {
 				session.Location.Date = date
 			}
-			log.Printf("Location set for session %s: %.6f, %.6f", session.Code, session.Location.Lat, session.Location.Lon)
+			(*player).log().With("lat", session.Location.Lat, "lon", session.Location.Lon).Info("Location set")
 			
 			// Broadcast to all players
 			session.mutex.Unlock()
@@ -928,15 +1043,21 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 		
 		session := (*player).Session
 		
+		if reg.isDraining() {
+			(*player).send("error", map[string]string{"message": "Server is shutting down"})
+			return
+		}
+		
 		session.mutex.Lock()
 		session.Round++
+		session.RoundActive = true
 		session.Location = nil // Clear location for next round
 		for _, p := range session.Players {
 			p.HasGuess = false
 		}
 		session.mutex.Unlock()
 		
-		log.Printf("Session %s starting round %d", session.Code, session.Round)
+		(*player).log().With("round", session.Round).Info("Starting round")
 		
 		// Notify all players to start next round
 		session.broadcast("startNextRound", map[string]interface{}{
@@ -951,7 +1072,7 @@ func handleMessage(conn *websocket.Conn, player **Player, msg WSMessage) {
 		payload := msg.Payload.(map[string]interface{})
 		session := (*player).Session
 		
-		log.Printf("Location failed for session %s: %.6f, %.6f", session.Code, payload["lat"].(float64), payload["lon"].(float64))
+		(*player).log().With("lat", payload["lat"], "lon", payload["lon"]).Warn("Location failed")
 		
 		// Clear the failed location
 		session.mutex.Lock()
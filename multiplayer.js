@@ -1,5 +1,8 @@
 // Multiplayer WebSocket Client
 
+// Message protocol version; must match ProtocolVersion in version.go
+const PROTOCOL_VERSION = 1;
+
 let ws = null;
 let multiplayerState = {
     isMultiplayer: false,
@@ -98,6 +101,8 @@ function connectWebSocket() {
     
     ws.onopen = () => {
         console.log('WebSocket connected');
+        // The server expects the protocol version before any other message
+        sendWS('hello', { protocol: PROTOCOL_VERSION });
     };
     
     ws.onmessage = (event) => {
@@ -212,12 +217,36 @@ function handleWebSocketMessage(msg) {
             handleRetryLocation(msg.payload);
             break;
             
+        case 'serverShutdown':
+            showToast(t('mp.servershutdown').replace('{seconds}', msg.payload.seconds), 'error');
+            break;
+            
+        case 'hello':
+            if (msg.payload.protocol !== PROTOCOL_VERSION) {
+                console.warn(`Server protocol ${msg.payload.protocol}, client ${PROTOCOL_VERSION}`);
+            }
+            break;
+            
         case 'error':
+            if (msg.payload.code === 'protocolMismatch') {
+                handleProtocolMismatch();
+                break;
+            }
             showToast(msg.payload.message, 'error');
             break;
     }
 }
 
+// This page's scripts are older than the server - only a reload helps
+function handleProtocolMismatch() {
+    multiplayerState.isMultiplayer = false; // No "connection lost" when the server closes
+    if (confirm(t('mp.reloadrequired'))) {
+        location.reload();
+        return;
+    }
+    returnToModeSelection();
+}
+
 // Get the current region selection from UI (since gameState.selectedRegion may not be set for dropdowns)
 // Returns { region: string, customRegion: object|null }
 function getCurrentRegionSelection() {
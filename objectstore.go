@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==================== OBJECT STORE ====================
+//
+// objectStore keeps entries in an HTTP object store so several replicas behind
+// a load balancer share one cache. Any server that answers GET/PUT/DELETE on
+// <endpoint>/<bucket>/<prefix><key> works, and Range support makes Stat
+// cheaper; with access keys configured the requests are signed with AWS
+// Signature V4, which S3, MinIO, R2 and the like accept (path-style addressing). Listing - needed for rebuilding the index, the
+// startup scan and clearing the cache - uses S3 ListObjectsV2 and needs a bucket.
+//
+// Each object holds one entry:
+//
+//	GDEOBJ1\n<stored unix>\n<meta length>\n<meta><data>
+//
+// Every replica keeps its own index of the entries it has seen, so max_size_mb
+// is enforced per replica; bucket lifecycle rules are the better place for a
+// global limit.
+
+const (
+	objectStoreMagic          = "GDEOBJ1\n"
+	objectHeaderMaxLen        = len(objectStoreMagic) + 2*21 // Magic and two int64 lines
+	DefaultObjectStoreTimeout = 10
+	DefaultObjectStoreRegion  = "us-east-1"
+)
+
+// ObjectStoreConfig holds object store settings from YAML
+type ObjectStoreConfig struct {
+	Endpoint        string            `yaml:"endpoint"` // e.g. https://s3.eu-central-1.amazonaws.com or http://minio:9000
+	Bucket          string            `yaml:"bucket"`   // Empty for plain HTTP stores addressed by endpoint + prefix
+	Prefix          string            `yaml:"prefix"`
+	Region          string            `yaml:"region"`
+	AccessKeyID     string            `yaml:"access_key_id"` // Requests are signed (AWS Signature V4) when set
+	SecretAccessKey string            `yaml:"secret_access_key"`
+	Headers         map[string]string `yaml:"headers"` // Added to every request, e.g. Authorization for plain HTTP stores
+	TimeoutSeconds  int               `yaml:"timeout_seconds"`
+}
+
+// objectStore is a TileStore backed by an HTTP/S3-compatible object store
+type objectStore struct {
+	cfg      ObjectStoreConfig
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// newObjectStore validates the config; nothing is contacted until the first request
+func newObjectStore(cfg ObjectStoreConfig) (*objectStore, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid cache.object_store.endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = DefaultObjectStoreRegion
+	}
+	if cfg.TimeoutSeconds <= 0 {
+		cfg.TimeoutSeconds = DefaultObjectStoreTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 32
+	return &objectStore{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Transport: transport, Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second},
+	}, nil
+}
+
+func (s *objectStore) String() string {
+	return "object (" + s.endpoint.String() + "/" + strings.TrimPrefix(s.cfg.Bucket+"/"+s.cfg.Prefix, "/") + ")"
+}
+
+// objectPath returns the URL path of an entry's object. Keys that could name
+// another object path are refused.
+func (s *objectStore) objectPath(key string) (string, error) {
+	if !validTileKey(key) {
+		return "", errInvalidTileKey
+	}
+	path := s.endpoint.Path + "/"
+	if s.cfg.Bucket != "" {
+		path += s.cfg.Bucket + "/"
+	}
+	return path + s.cfg.Prefix + key, nil
+}
+
+// do sends a request to the store with extra headers (may be nil), signing it
+// when credentials are configured
+func (s *objectStore) do(method, path string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = path
+	u.RawPath = awsEscapePath(path)
+	u.RawQuery = awsCanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body = nil
+		req.ContentLength = 0
+	}
+	for k, v := range s.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if method == http.MethodPut {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if s.cfg.AccessKeyID != "" {
+		signAWSV4(req, body, s.cfg.AccessKeyID, s.cfg.SecretAccessKey, s.cfg.Region, "s3", time.Now())
+	}
+	return s.client.Do(req)
+}
+
+// checkObjectResponse turns unexpected statuses into errors
+func checkObjectResponse(resp *http.Response, method string) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return errTileNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("object store %s: HTTP %d %s", method, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (s *objectStore) Get(key string) (*tileEntry, error) {
+	path, err := s.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(http.MethodGet, path, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkObjectResponse(resp, "GET"); err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeObjectEntry(body)
+}
+
+func (s *objectStore) Put(key string, data, meta []byte) error {
+	return s.put(key, &tileEntry{Data: data, Meta: meta, Stored: time.Now()})
+}
+
+func (s *objectStore) put(key string, entry *tileEntry) error {
+	path, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPut, path, nil, nil, encodeObjectEntry(entry))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkObjectResponse(resp, "PUT")
+}
+
+func (s *objectStore) Create(key string) (tileWriter, error) {
+	return &bufferedTileWriter{store: s, key: key}, nil
+}
+
+func (s *objectStore) Delete(key string) error {
+	path, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, path, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkObjectResponse(resp, "DELETE"); err != nil && err != errTileNotFound {
+		return err
+	}
+	return nil
+}
+
+// Stat reads just the object's frame header with a ranged GET, which gives the
+// entry's store time and, from the object's total length, its unframed size.
+// Stores that ignore Range send the whole object.
+func (s *objectStore) Stat(key string) (tileInfo, error) {
+	path, err := s.objectPath(key)
+	if err != nil {
+		return tileInfo{}, err
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=0-%d", objectHeaderMaxLen-1)}}
+	resp, err := s.do(http.MethodGet, path, nil, header, nil)
+	if err != nil {
+		return tileInfo{}, err
+	}
+	defer resp.Body.Close()
+	if err := checkObjectResponse(resp, "GET"); err != nil {
+		return tileInfo{}, err
+	}
+
+	prefix, err := io.ReadAll(io.LimitReader(resp.Body, int64(objectHeaderMaxLen)))
+	if err != nil {
+		return tileInfo{}, err
+	}
+	total := int64(len(prefix))
+	if resp.StatusCode == http.StatusPartialContent {
+		// Content-Range: bytes 0-<end>/<total>
+		_, size, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return tileInfo{}, errTileIncomplete
+		}
+	} else {
+		rest, err := io.Copy(io.Discard, resp.Body)
+		if err != nil {
+			return tileInfo{}, err
+		}
+		total += rest
+	}
+
+	stored, metaLen, headerLen, err := parseObjectHeader(prefix)
+	if err != nil || int64(headerLen)+metaLen > total {
+		return tileInfo{}, errTileIncomplete
+	}
+	return tileInfo{Size: total - int64(headerLen), Stored: time.Unix(stored, 0)}, nil
+}
+
+// Touch rewrites the object, as object stores can't change a modification time in place
+func (s *objectStore) Touch(key string, stored time.Time) error {
+	entry, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	entry.Stored = stored
+	return s.put(key, entry)
+}
+
+// listBucketResult is the part of an S3 ListObjectsV2 response we use
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Iterate lists the bucket page by page
+func (s *objectStore) Iterate(fn func(key string, info tileInfo) error) error {
+	if s.cfg.Bucket == "" {
+		return fmt.Errorf("listing needs cache.object_store.bucket (S3 ListObjectsV2)")
+	}
+
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, s.endpoint.Path+"/"+s.cfg.Bucket, query, nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := checkObjectResponse(resp, "LIST"); err != nil {
+			resp.Body.Close()
+			return err
+		}
+		var page listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("object store LIST: %v", err)
+		}
+
+		for _, obj := range page.Contents {
+			key := strings.TrimPrefix(obj.Key, s.cfg.Prefix)
+			if key == "" || strings.Contains(key, "/") {
+				continue // Not one of ours
+			}
+			if err := fn(key, tileInfo{Size: obj.Size, Stored: obj.LastModified}); err != nil {
+				return err
+			}
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *objectStore) Clear() error {
+	var keys []string
+	if err := s.Iterate(func(key string, _ tileInfo) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *objectStore) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// encodeObjectEntry frames an entry as one object
+func encodeObjectEntry(entry *tileEntry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(objectStoreMagic)
+	buf.WriteString(strconv.FormatInt(entry.Stored.Unix(), 10) + "\n")
+	buf.WriteString(strconv.Itoa(len(entry.Meta)) + "\n")
+	buf.Write(entry.Meta)
+	buf.Write(entry.Data)
+	return buf.Bytes()
+}
+
+// decodeObjectEntry parses an object written by encodeObjectEntry
+func decodeObjectEntry(body []byte) (*tileEntry, error) {
+	stored, metaLen, headerLen, err := parseObjectHeader(body)
+	if err != nil {
+		return nil, err
+	}
+	rest := body[headerLen:]
+	if metaLen > int64(len(rest)) {
+		return nil, errTileIncomplete
+	}
+	return &tileEntry{Meta: rest[:metaLen], Data: rest[metaLen:], Stored: time.Unix(stored, 0)}, nil
+}
+
+// parseObjectHeader reads the store time and metadata length from the start
+// of an object and returns them with the header's length
+func parseObjectHeader(body []byte) (int64, int64, int, error) {
+	if !bytes.HasPrefix(body, []byte(objectStoreMagic)) {
+		return 0, 0, 0, errTileIncomplete
+	}
+	headerLen := len(objectStoreMagic)
+
+	fields := make([]int64, 2)
+	for i := range fields {
+		nl := bytes.IndexByte(body[headerLen:], '\n')
+		if nl < 0 {
+			return 0, 0, 0, errTileIncomplete
+		}
+		n, err := strconv.ParseInt(string(body[headerLen:headerLen+nl]), 10, 64)
+		if err != nil {
+			return 0, 0, 0, errTileIncomplete
+		}
+		fields[i] = n
+		headerLen += nl + 1
+	}
+
+	if fields[1] < 0 {
+		return 0, 0, 0, errTileIncomplete
+	}
+	return fields[0], fields[1], headerLen, nil
+}
+
+// ==================== AWS SIGNATURE V4 ====================
+
+// signAWSV4 signs a request with the host, x-amz-content-sha256 and x-amz-date headers
+func signAWSV4(req *http.Request, body []byte, accessKeyID, secretAccessKey, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscapePath(req.URL.Path),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// awsEscape percent-encodes everything except unreserved characters (RFC 3986)
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// awsEscapePath encodes each path segment, keeping the slashes
+func awsEscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		segments[i] = awsEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// awsCanonicalQuery encodes a query sorted by key, as signatures require
+func awsCanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// ==================== END OBJECT STORE ====================
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== CACHE PRE-WARMING ====================
+//
+// `server prewarm -region tabor -zoom 8-14` fetches every map tile covering a
+// boundary polygon from boundaries/ through the API key pool and stores it in
+// the tile cache, so the first rounds of a tournament are served locally.
+//
+// With -server the tiles are fetched by the running server through its admin
+// API (POST /api/admin/cache/prewarm), so they land in its cache index and
+// count against its size limits. Without it the command opens the tile store
+// and index itself, which the index lock only allows while no server uses the
+// cache dir.
+
+// boundaryIndexEntry is one region in boundaries/index.json
+type boundaryIndexEntry struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	File string `json:"file"`
+}
+
+// boundaryGeometry is a region polygon file ([lon, lat] coordinates)
+type boundaryGeometry struct {
+	Name        string          `json:"name"`
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// lonLatRing is a closed polygon ring of [lon, lat] points
+type lonLatRing [][2]float64
+
+// tileCoord identifies a web mercator map tile
+type tileCoord struct {
+	Z, X, Y int
+}
+
+// prewarmStats counts tile outcomes
+type prewarmStats struct {
+	done    int64
+	cached  int64 // Already in the cache
+	fetched int64
+	failed  int64
+	skipped int64 // Not fetched because the budget was spent
+}
+
+// readBoundaryIndex reads boundaries/index.json, regions grouped by kind
+func readBoundaryIndex(boundaries fs.FS) (map[string][]boundaryIndexEntry, error) {
+	data, err := fs.ReadFile(boundaries, "index.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var index map[string][]boundaryIndexEntry
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid boundaries index: %v", err)
+	}
+	return index, nil
+}
+
+// findBoundary looks up a region by key ("tabor") or file name ("district-tabor")
+func findBoundary(boundaries fs.FS, region string) (*boundaryIndexEntry, error) {
+	index, err := readBoundaryIndex(boundaries)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range index {
+		for i, entry := range group {
+			if entry.Key == region || strings.TrimSuffix(entry.File, ".json") == region {
+				return &group[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("region %q not found in boundaries/index.json", region)
+}
+
+// loadBoundaryRings reads all rings (outer and holes) of a Polygon or MultiPolygon file
+func loadBoundaryRings(boundaries fs.FS, file string) ([]lonLatRing, error) {
+	data, err := fs.ReadFile(boundaries, file)
+	if err != nil {
+		return nil, err
+	}
+
+	var geometry boundaryGeometry
+	if err := json.Unmarshal(data, &geometry); err != nil {
+		return nil, err
+	}
+
+	switch geometry.Type {
+	case "Polygon":
+		var rings []lonLatRing
+		if err := json.Unmarshal(geometry.Coordinates, &rings); err != nil {
+			return nil, err
+		}
+		return rings, nil
+	case "MultiPolygon":
+		var polygons [][]lonLatRing
+		if err := json.Unmarshal(geometry.Coordinates, &polygons); err != nil {
+			return nil, err
+		}
+		var rings []lonLatRing
+		for _, polygon := range polygons {
+			rings = append(rings, polygon...)
+		}
+		return rings, nil
+	}
+	return nil, fmt.Errorf("unsupported geometry type %q", geometry.Type)
+}
+
+// pointInRings tests a point with the even-odd rule, so holes are excluded
+func pointInRings(lon, lat float64, rings []lonLatRing) bool {
+	inside := false
+	for _, ring := range rings {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			xi, yi := ring[i][0], ring[i][1]
+			xj, yj := ring[j][0], ring[j][1]
+			if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// lonLatToTile returns the tile containing a point at zoom z
+func lonLatToTile(lon, lat float64, z int) (int, int) {
+	n := math.Exp2(float64(z))
+	x := int((lon + 180) / 360 * n)
+	latRad := lat * math.Pi / 180
+	y := int((1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * n)
+	return x, y
+}
+
+// tileToLonLat returns the north-west corner of a tile
+func tileToLonLat(x, y, z int) (float64, float64) {
+	n := math.Exp2(float64(z))
+	lon := float64(x)/n*360 - 180
+	lat := math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi
+	return lon, lat
+}
+
+// tilesCoveringRings lists the tiles at zoom z that overlap the polygon: a tile
+// counts when its center or a corner lies inside, or a polygon vertex lies in it
+func tilesCoveringRings(rings []lonLatRing, z int) []tileCoord {
+	minLon, minLat := math.Inf(1), math.Inf(1)
+	maxLon, maxLat := math.Inf(-1), math.Inf(-1)
+	for _, ring := range rings {
+		for _, p := range ring {
+			minLon, maxLon = math.Min(minLon, p[0]), math.Max(maxLon, p[0])
+			minLat, maxLat = math.Min(minLat, p[1]), math.Max(maxLat, p[1])
+		}
+	}
+	if math.IsInf(minLon, 0) {
+		return nil
+	}
+
+	x0, y0 := lonLatToTile(minLon, maxLat, z)
+	x1, y1 := lonLatToTile(maxLon, minLat, z)
+
+	// Tiles that contain a polygon vertex
+	withVertex := make(map[tileCoord]bool)
+	for _, ring := range rings {
+		for _, p := range ring {
+			x, y := lonLatToTile(p[0], p[1], z)
+			withVertex[tileCoord{z, x, y}] = true
+		}
+	}
+
+	var tiles []tileCoord
+	for x := x0; x <= x1; x++ {
+		for y := y0; y <= y1; y++ {
+			tile := tileCoord{z, x, y}
+			west, north := tileToLonLat(x, y, z)
+			east, south := tileToLonLat(x+1, y+1, z)
+			if withVertex[tile] ||
+				pointInRings((west+east)/2, (north+south)/2, rings) ||
+				pointInRings(west, north, rings) || pointInRings(east, north, rings) ||
+				pointInRings(west, south, rings) || pointInRings(east, south, rings) {
+				tiles = append(tiles, tile)
+			}
+		}
+	}
+	return tiles
+}
+
+// parseZoomRange parses "12" or "8-14"
+func parseZoomRange(spec string) (int, int, error) {
+	parts := strings.SplitN(spec, "-", 2)
+	minZoom, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid zoom range %q", spec)
+	}
+	maxZoom := minZoom
+	if len(parts) == 2 {
+		if maxZoom, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return 0, 0, fmt.Errorf("invalid zoom range %q", spec)
+		}
+	}
+	if minZoom < 0 || maxZoom > 20 || minZoom > maxZoom {
+		return 0, 0, fmt.Errorf("zoom range %q must be within 0-20", spec)
+	}
+	return minZoom, maxZoom, nil
+}
+
+// isCachedFresh checks for an unexpired cache entry without reading it
+func (c *tileCache) isCachedFresh(cacheKey string, rule *cacheRule) bool {
+	info, err := c.store.Stat(cacheKey)
+	if err != nil {
+		return false
+	}
+	return time.Since(info.Stored) <= rule.maxAge()
+}
+
+// prewarmTile fetches one tile through the key pool into the cache (and its
+// index, when open). It reports whether the tile was already cached.
+func (s *Server) prewarmTile(apiPath string, rule *cacheRule) (bool, error) {
+	cacheKey := getCacheKey(apiPath, url.Values{}, rule)
+	if s.cache.isCachedFresh(cacheKey, rule) {
+		return true, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "/api/mapy/"+apiPath, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.fetchUpstream(req, apiPath, url.Values{}, http.Header{})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return false, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	cw, err := s.cache.newCacheWriter(cacheKey, cacheKeySource(apiPath, url.Values{}, rule), rule, s.cache.shouldCompress(resp.Header.Get("Content-Type"), resp.Header.Get("Content-Encoding")))
+	if err != nil {
+		return false, err
+	}
+	n, err := io.Copy(cw, s.limitBody(resp.Body))
+	if err != nil || n == 0 {
+		cw.Abort()
+		if err == nil {
+			err = fmt.Errorf("empty response")
+		}
+		return false, err
+	}
+
+	headers, internal := cacheMetaFromResponse(resp, n)
+	return false, cw.Commit(headers, internal)
+}
+
+// runPrewarm implements `server prewarm [flags]` with the server config cfg
+func runPrewarm(cfg Config, args []string) {
+	fs := flag.NewFlagSet("prewarm", flag.ExitOnError)
+	region := fs.String("region", "", "boundary key or file name from boundaries/index.json, e.g. tabor or district-tabor")
+	zoom := fs.String("zoom", "8-14", "zoom level or range, e.g. 12 or 8-14")
+	mapsets := fs.String("mapsets", "basic", "comma-separated mapsets to fetch")
+	boundariesDir := fs.String("boundaries", "", "boundaries directory (default: the server's, see server.static_dir)")
+	concurrency := fs.Int("concurrency", 8, "parallel upstream requests")
+	maxFetches := fs.Int("max-fetches", 10000, "upstream request budget; remaining tiles are skipped once spent")
+	dryRun := fs.Bool("dry-run", false, "only count the tiles that would be fetched")
+	serverURL := fs.String("server", "", "prewarm through a running server's admin API, e.g. http://localhost:8080")
+	fs.Parse(args)
+
+	if *region == "" {
+		fmt.Fprintln(os.Stderr, "usage: server prewarm -region <key> [-zoom 8-14] [-mapsets basic] [-concurrency 8] [-max-fetches 10000] [-server <url>] [-dry-run]")
+		os.Exit(2)
+	}
+	minZoom, maxZoom, err := parseZoomRange(*zoom)
+	if err != nil {
+		logError("%v", err)
+		os.Exit(2)
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	// Keys, rules and the store come from the server config
+	srv := newServer(cfg)
+
+	boundaries := srv.assets.boundaries()
+	if *boundariesDir != "" {
+		boundaries = os.DirFS(*boundariesDir)
+	}
+	entry, err := findBoundary(boundaries, *region)
+	if err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+	rings, err := loadBoundaryRings(boundaries, entry.File)
+	if err != nil {
+		logWith("file", entry.File).Error("Failed to load boundary: %v", err)
+		os.Exit(1)
+	}
+
+	// Enumerate tile paths for every mapset and zoom level
+	var paths []string
+	for z := minZoom; z <= maxZoom; z++ {
+		tiles := tilesCoveringRings(rings, z)
+		logWith("region", entry.Name, "zoom", z, "tiles", len(tiles)).Info("🗺️ Tiles at zoom")
+		for _, mapset := range strings.Split(*mapsets, ",") {
+			mapset = strings.TrimSpace(mapset)
+			if srv.cache.matchCacheRule(fmt.Sprintf("v1/maptiles/%s/256/%d/0/0", mapset, z)) == nil {
+				logWith("mapset", mapset, "zoom", z).Warn("⚠️  No cache rule matches these tiles, skipping")
+				continue
+			}
+			for _, t := range tiles {
+				paths = append(paths, fmt.Sprintf("v1/maptiles/%s/256/%d/%d/%d", mapset, t.Z, t.X, t.Y))
+			}
+		}
+	}
+	logWith("region", entry.Name, "tiles", len(paths), "min_zoom", minZoom, "max_zoom", maxZoom, "mapsets", *mapsets).Info("🗺️ Tiles in total")
+	if *dryRun {
+		return
+	}
+
+	var cached func(apiPath string) bool
+	var warm func(apiPath string) (bool, error)
+	if *serverURL != "" {
+		warm = remotePrewarmer(*serverURL, srv.adminSettings(), *concurrency)
+	} else {
+		if err := srv.openCacheForPrewarm(); err != nil {
+			logError("Failed to open tile cache: %v", err)
+			logError("To prewarm the cache of a running server, pass -server with its URL")
+			os.Exit(1)
+		}
+		defer srv.cache.close()
+		cached = func(apiPath string) bool {
+			rule := srv.cache.matchCacheRule(apiPath)
+			return srv.cache.isCachedFresh(getCacheKey(apiPath, url.Values{}, rule), rule)
+		}
+		warm = func(apiPath string) (bool, error) {
+			return srv.prewarmTile(apiPath, srv.cache.matchCacheRule(apiPath))
+		}
+	}
+
+	start := time.Now()
+	stats := prewarmPaths(paths, *concurrency, *maxFetches, cached, warm)
+
+	logWith("region", entry.Name, "duration", time.Since(start).Round(time.Second), "tiles", len(paths), "cached", stats.cached,
+		"fetched", stats.fetched, "failed", stats.failed, "skipped", stats.skipped, "budget", *maxFetches).Info("🔥 Prewarm finished")
+	if stats.skipped > 0 {
+		logWarn("Fetch budget exhausted - rerun with a higher -max-fetches to finish the region")
+	}
+}
+
+// openCacheForPrewarm opens the tile store and index without the server's
+// background work. It fails while a server holds the index.
+func (s *Server) openCacheForPrewarm() error {
+	cfg := s.cache.settings()
+	store, err := openTileStore(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		store.Close()
+		return err
+	}
+	idx, err := openCacheIndex(cfg.Dir, store)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	s.cache.store = store
+	s.cache.idx = idx
+	return nil
+}
+
+// prewarmPaths warms tiles with up to concurrency requests in flight. cached
+// (optional) reports fresh entries without spending the budget of maxFetches
+// upstream requests, and so does a warm call that finds the tile cached after
+// all. Tiles left once the budget is spent are skipped.
+func prewarmPaths(paths []string, concurrency, maxFetches int, cached func(apiPath string) bool, warm func(apiPath string) (bool, error)) *prewarmStats {
+	stats := &prewarmStats{}
+	budget := int64(maxFetches)
+
+	// Progress reporter
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				done := atomic.LoadInt64(&stats.done)
+				logWith("done", done, "total", len(paths),
+					"cached", atomic.LoadInt64(&stats.cached), "fetched", atomic.LoadInt64(&stats.fetched),
+					"failed", atomic.LoadInt64(&stats.failed), "skipped", atomic.LoadInt64(&stats.skipped)).
+					Info("🔥 Progress: %.1f%%", float64(done)/float64(len(paths))*100)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for apiPath := range jobs {
+				switch {
+				case cached != nil && cached(apiPath):
+					atomic.AddInt64(&stats.cached, 1)
+				case atomic.AddInt64(&budget, -1) < 0:
+					atomic.AddInt64(&stats.skipped, 1)
+				default:
+					if wasCached, err := warm(apiPath); err != nil {
+						atomic.AddInt64(&stats.failed, 1)
+						logWith("path", apiPath).Warn("⚠️  Prewarm failed: %v", err)
+					} else if wasCached {
+						atomic.AddInt64(&budget, 1)
+						atomic.AddInt64(&stats.cached, 1)
+					} else {
+						atomic.AddInt64(&stats.fetched, 1)
+					}
+				}
+				atomic.AddInt64(&stats.done, 1)
+			}
+		}()
+	}
+	for _, p := range paths {
+		jobs <- p
+	}
+	close(jobs)
+	wg.Wait()
+
+	return stats
+}
+
+// remotePrewarmer returns a warm function for prewarmPaths that has the server
+// at serverURL fetch each tile, authenticating with the admin credentials
+func remotePrewarmer(serverURL string, admin AdminConfig, concurrency int) func(apiPath string) (bool, error) {
+	endpoint := strings.TrimSuffix(serverURL, "/") + "/api/admin/cache/prewarm"
+	client := &http.Client{
+		// The server may try every API key before it answers
+		Timeout: 5 * time.Minute,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+			MaxIdleConnsPerHost: concurrency,
+		},
+	}
+
+	return func(apiPath string) (bool, error) {
+		req, err := http.NewRequest(http.MethodPost, endpoint+"?path="+url.QueryEscape(apiPath), nil)
+		if err != nil {
+			return false, err
+		}
+		if admin.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+admin.Token)
+		} else {
+			req.SetBasicAuth(admin.Username, admin.Password)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			var body struct {
+				Error string `json:"error"`
+			}
+			json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body)
+			return false, fmt.Errorf("server answered HTTP %d: %s", resp.StatusCode, body.Error)
+		}
+		var result adminPrewarmResult
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return false, err
+		}
+		return result.Cached, nil
+	}
+}
+
+// ==================== END CACHE PRE-WARMING ====================
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// tileRing returns a ring just inside the tiles x0..x1, y0..y1 at zoom z,
+// shrunk (or with a negative inset, grown) by inset degrees
+func tileRing(x0, y0, x1, y1, z int, inset float64) lonLatRing {
+	west, north := tileToLonLat(x0, y0, z)
+	east, south := tileToLonLat(x1+1, y1+1, z)
+	west, north, east, south = west+inset, north-inset, east-inset, south+inset
+	return lonLatRing{{west, north}, {east, north}, {east, south}, {west, south}, {west, north}}
+}
+
+func sortedTiles(tiles []tileCoord) []tileCoord {
+	sort.Slice(tiles, func(i, j int) bool {
+		if tiles[i].X != tiles[j].X {
+			return tiles[i].X < tiles[j].X
+		}
+		return tiles[i].Y < tiles[j].Y
+	})
+	return tiles
+}
+
+func TestTilesCoveringRings(t *testing.T) {
+	const z = 10
+	const inset = 0.001
+
+	got := sortedTiles(tilesCoveringRings([]lonLatRing{tileRing(550, 300, 552, 301, z, inset)}, z))
+	want := []tileCoord{{z, 550, 300}, {z, 550, 301}, {z, 551, 300}, {z, 551, 301}, {z, 552, 300}, {z, 552, 301}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rectangle: tiles = %v, want %v", got, want)
+	}
+
+	// A hole a little larger than the middle tile of a 3x3 block drops it
+	rings := []lonLatRing{tileRing(550, 300, 552, 302, z, inset), tileRing(551, 301, 551, 301, z, -inset)}
+	got = tilesCoveringRings(rings, z)
+	if len(got) != 8 {
+		t.Errorf("with a hole: %d tiles, want 8", len(got))
+	}
+	for _, tile := range got {
+		if tile == (tileCoord{z, 551, 301}) {
+			t.Error("tile inside the hole is listed")
+		}
+	}
+
+	// A polygon smaller than a tile still gets the tile it lies in
+	west, north := tileToLonLat(551, 300, z)
+	small := lonLatRing{{west + 0.01, north - 0.01}, {west + 0.02, north - 0.01}, {west + 0.02, north - 0.02}, {west + 0.01, north - 0.01}}
+	if got := tilesCoveringRings([]lonLatRing{small}, z); !reflect.DeepEqual(got, []tileCoord{{z, 551, 300}}) {
+		t.Errorf("small polygon: tiles = %v, want [{10 551 300}]", got)
+	}
+
+	if got := tilesCoveringRings(nil, z); got != nil {
+		t.Errorf("no rings: tiles = %v, want none", got)
+	}
+}
+
+func TestFindBoundary(t *testing.T) {
+	boundaries := fstest.MapFS{
+		"index.json": {Data: []byte(`{"district": [{"key": "tabor", "name": "Tábor", "file": "district-tabor.json"}]}`)},
+		"district-tabor.json": {Data: []byte(`{"name": "Tábor", "type": "MultiPolygon", "coordinates": [
+			[[[14, 49], [15, 49], [15, 50], [14, 49]]],
+			[[[16, 49], [17, 49], [17, 50], [16, 49]], [[16.5, 49.2], [16.6, 49.2], [16.6, 49.3], [16.5, 49.2]]]
+		]}`)},
+	}
+
+	for _, region := range []string{"tabor", "district-tabor"} {
+		entry, err := findBoundary(boundaries, region)
+		if err != nil || entry.File != "district-tabor.json" {
+			t.Errorf("findBoundary(%q) = %+v, %v, want district-tabor.json", region, entry, err)
+		}
+	}
+	if _, err := findBoundary(boundaries, "praha"); err == nil {
+		t.Error("findBoundary found a region that isn't in the index")
+	}
+
+	rings, err := loadBoundaryRings(boundaries, "district-tabor.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rings) != 3 {
+		t.Errorf("MultiPolygon gave %d rings, want 3 (two outer rings and a hole)", len(rings))
+	}
+}
+
+func TestPrewarmPathsBudget(t *testing.T) {
+	var paths []string
+	for i := 0; i < 10; i++ {
+		paths = append(paths, fmt.Sprintf("p%d", i))
+	}
+	cached := func(apiPath string) bool { return apiPath == "p0" || apiPath == "p1" }
+	var warmed []string
+	warm := func(apiPath string) (bool, error) {
+		warmed = append(warmed, apiPath)
+		switch apiPath {
+		case "p2":
+			return true, nil // Cached since it was checked, costs nothing
+		case "p3":
+			return false, fmt.Errorf("HTTP 500")
+		}
+		return false, nil
+	}
+
+	// One worker keeps the order predictable
+	stats := prewarmPaths(paths, 1, 4, cached, warm)
+	if want := []string{"p2", "p3", "p4", "p5", "p6"}; !reflect.DeepEqual(warmed, want) {
+		t.Errorf("warmed %v, want %v", warmed, want)
+	}
+	if stats.done != 10 || stats.cached != 3 || stats.fetched != 3 || stats.failed != 1 || stats.skipped != 3 {
+		t.Errorf("stats = %+v, want 10 done, 3 cached, 3 fetched, 1 failed, 3 skipped", *stats)
+	}
+}
+
+func TestPrewarmPathsConcurrency(t *testing.T) {
+	const concurrency = 4
+	paths := make([]string, 40)
+	var inFlight, maxInFlight int64
+	var mutex sync.Mutex
+	warm := func(apiPath string) (bool, error) {
+		n := atomic.AddInt64(&inFlight, 1)
+		mutex.Lock()
+		if n > maxInFlight {
+			maxInFlight = n
+		}
+		mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt64(&inFlight, -1)
+		return false, nil
+	}
+
+	stats := prewarmPaths(paths, concurrency, 1000, nil, warm)
+	if stats.fetched != 40 {
+		t.Errorf("fetched %d tiles, want 40", stats.fetched)
+	}
+	if maxInFlight > concurrency || maxInFlight < 2 {
+		t.Errorf("up to %d tiles were warmed at once, want %d", maxInFlight, concurrency)
+	}
+}
+
+func TestPrewarmIndexesTiles(t *testing.T) {
+	mock, upstreamURL := newMockUpstreamServer(t, nil)
+	const tile = "v1/maptiles/basic/256/10/580/300"
+
+	// Offline: the command opens the index itself and records what it fetches
+	var cfg Config
+	cfg.Cache.Dir = t.TempDir()
+	cfg.Cache.StartupScan = "off"
+	cfg.Proxy.UpstreamURL = upstreamURL
+	cfg.APIKeys = []map[string]string{{"good": "good"}}
+	cfg.Admin.Token = "secret"
+	offline := newServer(cfg)
+	if err := offline.openCacheForPrewarm(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := offline.prewarmTile(tile, offline.cache.matchCacheRule(tile)); err != nil {
+		t.Fatal(err)
+	}
+	if _, count := offline.cache.getCacheSize(); count != 1 {
+		t.Errorf("offline prewarm indexed %d entries, want 1", count)
+	}
+
+	// The index is locked against a server while the command runs
+	if _, err := NewServer(cfg); err == nil {
+		t.Fatal("a server opened the cache of a running prewarm")
+	}
+	offline.cache.close()
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, count := s.cache.getCacheSize(); count != 1 {
+		t.Errorf("server found %d indexed entries, want 1", count)
+	}
+	if err := newServer(cfg).openCacheForPrewarm(); err == nil {
+		t.Fatal("offline prewarm opened the cache of a running server")
+	}
+
+	// Through the server's admin API
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	warm := remotePrewarmer(srv.URL, AdminConfig{Token: "secret"}, 1)
+	const other = "v1/maptiles/basic/256/10/581/300"
+	for i, want := range []bool{false, true} {
+		cached, err := warm(other)
+		if err != nil || cached != want {
+			t.Errorf("remote prewarm %d: cached = %t, %v, want %t", i+1, cached, err, want)
+		}
+	}
+	if _, count := s.cache.getCacheSize(); count != 2 {
+		t.Errorf("server indexed %d entries after a remote prewarm, want 2", count)
+	}
+	if n := mock.requestCount(other, ""); n != 1 {
+		t.Errorf("upstream saw %d requests for the remotely prewarmed tile, want 1", n)
+	}
+	if _, err := warm("v1/routing/route"); err == nil {
+		t.Error("remote prewarm of a non-allowlisted path succeeded")
+	}
+	if _, err := remotePrewarmer(srv.URL, AdminConfig{Token: "wrong"}, 1)(tile); err == nil {
+		t.Error("remote prewarm with a wrong token succeeded")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== RATE LIMITING ====================
+
+// RateLimitConfig holds per-client-IP limits for upstream-bound proxy requests
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+	TrustProxyHeaders bool    `yaml:"trust_proxy_headers"` // Use X-Forwarded-For / X-Real-IP (only behind a trusted reverse proxy)
+}
+
+// tokenBucket tracks the remaining request budget for one client
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// ipRateLimiter is a token bucket limiter keyed by client IP
+type ipRateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	rate    float64
+	burst   float64
+}
+
+// newIPRateLimiter creates a limiter and starts evicting idle clients
+func newIPRateLimiter(rate float64, burst int) *ipRateLimiter {
+	l := &ipRateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		rate:    rate,
+		burst:   float64(burst),
+	}
+
+	go func() {
+		for {
+			time.Sleep(5 * time.Minute)
+			l.evictIdle(10 * time.Minute)
+		}
+	}()
+
+	return l
+}
+
+// Allow takes one token for ip. When the bucket is empty it returns false and
+// how long the client should wait before retrying.
+func (l *ipRateLimiter) Allow(ip string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	b, exists := l.buckets[ip]
+	if !exists {
+		b = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[ip] = b
+	}
+
+	// Refill for the time since the last request
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.lastSeen).Seconds()*l.rate)
+	b.lastSeen = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// SetLimits changes the rate and burst, e.g. after a config reload. Clients
+// keep their remaining tokens, capped at the new burst.
+func (l *ipRateLimiter) SetLimits(rate float64, burst int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.rate = rate
+	l.burst = float64(burst)
+	for _, b := range l.buckets {
+		b.tokens = math.Min(l.burst, b.tokens)
+	}
+}
+
+// evictIdle drops buckets of clients that haven't been seen for maxIdle
+func (l *ipRateLimiter) evictIdle(maxIdle time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for ip, b := range l.buckets {
+		if time.Since(b.lastSeen) > maxIdle {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// clientIP returns the requesting client's IP address
+func clientIP(r *http.Request, trustProxyHeaders bool) string {
+	if trustProxyHeaders {
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			// Only the last entry was added by our proxy, earlier ones come from
+			// the client and can be forged to dodge the limit
+			entries := strings.Split(strings.Join(xff, ","), ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+		if xri := r.Header.Get("X-Real-IP"); xri != "" {
+			return strings.TrimSpace(xri)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ==================== END RATE LIMITING ====================
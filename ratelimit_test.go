@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	l := newIPRateLimiter(10, 3)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("192.0.2.1"); !ok {
+			t.Fatalf("request %d within the burst was refused", i+1)
+		}
+	}
+	ok, wait := l.Allow("192.0.2.1")
+	if ok {
+		t.Fatal("request past the burst was allowed")
+	}
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("wait = %v, want up to one token's worth (100ms)", wait)
+	}
+	if ok, _ := l.Allow("192.0.2.2"); !ok {
+		t.Error("another client shares the exhausted bucket")
+	}
+
+	// A quarter second refills two tokens at 10/s
+	l.mutex.Lock()
+	l.buckets["192.0.2.1"].lastSeen = time.Now().Add(-250 * time.Millisecond)
+	l.mutex.Unlock()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("192.0.2.1"); !ok {
+			t.Fatalf("refilled request %d was refused", i+1)
+		}
+	}
+	if ok, _ := l.Allow("192.0.2.1"); ok {
+		t.Error("refill gave more than two tokens")
+	}
+
+	// Refill never exceeds the burst
+	l.mutex.Lock()
+	l.buckets["192.0.2.1"].lastSeen = time.Now().Add(-time.Hour)
+	l.mutex.Unlock()
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.Allow("192.0.2.1"); ok {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("after a long idle %d requests were allowed, want the burst of 3", allowed)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		trust  bool
+		want   string
+	}{
+		{"remote address", nil, false, "192.0.2.1"},
+		{"proxy headers ignored", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, false, "192.0.2.1"},
+		{"forwarded", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, true, "198.51.100.7"},
+		{"forged entries", http.Header{"X-Forwarded-For": {"203.0.113.9, 198.51.100.7"}}, true, "198.51.100.7"},
+		{"repeated header", http.Header{"X-Forwarded-For": {"203.0.113.9", "198.51.100.7"}}, true, "198.51.100.7"},
+		{"real IP", http.Header{"X-Real-Ip": {"198.51.100.8"}}, true, "198.51.100.8"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "192.0.2.1:5000"
+		for key, values := range tt.header {
+			r.Header[key] = values
+		}
+		if got := clientIP(r, tt.trust); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProxyAllowlist(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	for path, want := range map[string]bool{
+		"v1/maptiles/basic/256/10/550/300": true,
+		"v1/panorama":                      true,
+		"v1/panorama/tiles/1/2":            true,
+		"v1/suggest":                       true,
+		"v1/suggest/extra":                 false,
+		"v1/panoramax":                     false,
+		"v1/routing/route":                 false,
+		"x/v1/maptiles/basic":              false,
+	} {
+		if got := s.isPathAllowed(path); got != want {
+			t.Errorf("isPathAllowed(%q) = %t, want %t", path, got, want)
+		}
+	}
+	for method, want := range map[string]bool{
+		http.MethodGet:    true,
+		"head":            true,
+		http.MethodPost:   false,
+		http.MethodDelete: false,
+	} {
+		if got := s.isMethodAllowed(method); got != want {
+			t.Errorf("isMethodAllowed(%q) = %t, want %t", method, got, want)
+		}
+	}
+
+	// Refused before anything is sent upstream
+	if rec := get(s, "/api/mapy/v1/routing/route", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("non-allowlisted path: status = %d, want 403", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/mapy/v1/suggest", nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") == "" {
+		t.Errorf("POST: status = %d, Allow = %q, want 405 with an Allow header", rec.Code, rec.Header().Get("Allow"))
+	}
+}
@@ -1,24 +1,27 @@
 package main
 
 import (
+	"compress/gzip"
 	"crypto/md5"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
-	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"gopkg.in/yaml.v3"
 )
 
 type APIKey struct {
@@ -32,21 +35,52 @@ type CacheConfig struct {
 	MaxSizeMB     int    `yaml:"max_size_mb"`
 	Dir           string `yaml:"dir"`
 	CleanupHours  int    `yaml:"cleanup_hours"`
+	MemoryMB      int    `yaml:"memory_mb"` // In-memory LRU tier for hot tiles, negative disables
+	StartupScan   string `yaml:"startup_scan"` // off, quick or full (see cacheintegrity.go)
+	Rules         []CacheRule `yaml:"rules"`    // Which paths are cached and how (see cacherules.go)
+	Compression   string `yaml:"compression"`  // gzip or off (see cachecompression.go)
+	
+	// Storage backend: disk, kv or object (see tilestore.go)
+	Backend     string            `yaml:"backend"`
+	KV          KVStoreConfig     `yaml:"kv"`
+	ObjectStore ObjectStoreConfig `yaml:"object_store"`
 }
 
-type Config struct {
-	APIKeys []map[string]string `yaml:"api_keys"`
-	Cache   CacheConfig         `yaml:"cache"`
+// TLSConfig holds upstream TLS verification settings from YAML
+type TLSConfig struct {
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	CAFile             string `yaml:"ca_file"`
 }
 
-type LogLevel int
+// ProxyConfig holds upstream connection settings from YAML
+type ProxyConfig struct {
+	UpstreamURL        string    `yaml:"upstream_url"`
+	TimeoutSeconds     int       `yaml:"timeout_seconds"`
+	IdleTimeoutSeconds int       `yaml:"idle_timeout_seconds"`
+	MaxResponseMB      int       `yaml:"max_response_mb"`
+	TLS                TLSConfig `yaml:"tls"`
+	
+	// Access control - the proxy attaches our API keys, so only forward what the game needs
+	AllowedPaths   []string        `yaml:"allowed_paths"`   // Regexes matched against the path after /api/mapy/
+	AllowedMethods []string        `yaml:"allowed_methods"`
+	RateLimit      RateLimitConfig `yaml:"rate_limit"`
+}
 
-const (
-	DEBUG LogLevel = iota
-	INFO
-	WARN
-	ERROR
-)
+// Config is everything a Server is built from (see NewServer and config.go)
+type Config struct {
+	Server      ServerConfig        `yaml:"server"`
+	Logging     LoggingConfig       `yaml:"logging"`
+	APIKeys     []map[string]string `yaml:"api_keys"`
+	Cache       CacheConfig         `yaml:"cache"`
+	Proxy       ProxyConfig         `yaml:"proxy"`
+	Multiplayer MultiplayerConfig   `yaml:"multiplayer"`
+	Admin       AdminConfig         `yaml:"admin"`
+	
+	file      string            // Config file asked for, empty for the default
+	flags     map[string]string // Command-line settings, applied again on reload
+	source    string            // File the config was read from, for messages
+	overrides []string          // Settings taken from env vars and flags
+}
 
 // Cache configuration defaults - tiles are immutable, cache them for months
 const (
@@ -54,91 +88,205 @@ const (
 	DefaultCacheDir        = ".tile_cache" // Cache directory
 	DefaultCacheMaxSizeMB  = 5000          // 5GB max cache size
 	DefaultCacheCleanupInt = 24            // Cleanup interval in hours
+	DefaultCacheMemoryMB   = 128           // In-memory hot tile tier
 )
 
-// Runtime cache config (loaded from YAML or defaults)
-var cacheConfig = CacheConfig{
+// Cache config used for settings YAML leaves unset
+var defaultCacheConfig = CacheConfig{
 	TTLDays:      DefaultCacheTTLDays,
 	MaxSizeMB:    DefaultCacheMaxSizeMB,
 	Dir:          DefaultCacheDir,
 	CleanupHours: DefaultCacheCleanupInt,
+	MemoryMB:     DefaultCacheMemoryMB,
+	StartupScan:  CacheScanQuick,
+	Rules:        DefaultCacheRules,
+	Compression:  CacheCompressionGzip,
+	Backend:      CacheBackendDisk,
+}
+
+// Proxy configuration defaults
+const (
+	DefaultUpstreamURL         = "https://api.mapy.cz/"
+	DefaultProxyTimeoutSec     = 30  // Whole upstream request, including body
+	DefaultProxyIdleTimeoutSec = 90  // Keep-alive for pooled connections
+	DefaultProxyMaxResponseMB  = 64  // Larger upstream bodies are rejected
+	DefaultRateLimitPerSecond  = 20  // Sustained upstream requests per client IP
+	DefaultRateLimitBurst      = 400 // A fresh panorama loads a few hundred tiles at once
+)
+
+// Default upstream paths the game uses: map tiles, panoramas and place search
+var DefaultAllowedPaths = []string{
+	`^v1/maptiles/`,
+	`^v1/panorama(/|$)`,
+	`^v1/suggest$`,
+	`^v1/geocode$`,
+	`^v1/rgeocode$`,
+}
+
+// Proxy config used for settings YAML leaves unset
+var defaultProxyConfig = ProxyConfig{
+	UpstreamURL:        DefaultUpstreamURL,
+	TimeoutSeconds:     DefaultProxyTimeoutSec,
+	IdleTimeoutSeconds: DefaultProxyIdleTimeoutSec,
+	MaxResponseMB:      DefaultProxyMaxResponseMB,
+	AllowedPaths:       DefaultAllowedPaths,
+	AllowedMethods:     []string{http.MethodGet, http.MethodHead},
+	RateLimit: RateLimitConfig{
+		RequestsPerSecond: DefaultRateLimitPerSecond,
+		Burst:             DefaultRateLimitBurst,
+	},
 }
 
 // Cache statistics
 type CacheStats struct {
-	hits       uint64
-	misses     uint64
-	savedBytes uint64
-}
-
-var (
-	apiKeys      []APIKey
-	keyIndex     uint32
-	httpClient   *http.Client
-	staticServer http.Handler
-	keyMutex     sync.RWMutex
-	logLevel     LogLevel = INFO
-	cacheStats   CacheStats
-	cacheMutex   sync.RWMutex
-	
-	// Patterns for cacheable tile requests
-	tilePatterns = []*regexp.Regexp{
-		regexp.MustCompile(`^v1/maptiles/`),              // Map tiles
-		regexp.MustCompile(`^v1/panorama/tiles/`),        // Panorama tiles (actual format!)
-		regexp.MustCompile(`^v1/panorama/\d+/thumbnail`), // Panorama thumbnails
-	}
-)
+	hits        uint64
+	misses      uint64
+	savedBytes  uint64
+	coalesced   uint64 // Requests that shared another request's upstream fetch
+	quarantined uint64 // Corrupt or orphaned entries moved out of the cache
+	notModified uint64 // 304s answered from cache validators
+	revalidated uint64 // Stale entries upstream confirmed unchanged
+	expired     uint64 // Entries removed by cleanup after their TTL
+	evicted     uint64 // Entries evicted to stay within size limits
+	
+	// Compression (see cachecompression.go)
+	compressedWrites   uint64 // Entries stored gzipped
+	originalBytes      uint64 // Their size as received
+	storedBytes        uint64 // Their size as stored
+	servedCompressed   uint64 // Gzipped entries passed through to clients accepting gzip
+	servedDecompressed uint64 // Gzipped entries decoded for clients that don't
+}
 
-func logDebug(format string, v ...interface{}) {
-	if logLevel <= DEBUG {
-		log.Printf("[DEBUG] "+format, v...)
-	}
+// Server is one configured game server: the API key pool, tile cache,
+// multiplayer sessions and HTTP routes. NewServer builds it from a Config, so
+// nothing is shared between servers in one process except the logger.
+type Server struct {
+	keys     *keyPool
+	cache    *tileCache
+	sessions *sessionRegistry
+	assets   *assetStore
+	
+	// Where the config came from, to load it the same way on reload
+	configFile  string
+	configFlags map[string]string
+	
+	// Proxy and admin settings, swapped on config reload
+	mutex         sync.RWMutex
+	server        ServerConfig
+	proxy         ProxyConfig
+	allowPatterns []*regexp.Regexp // Compiled proxy.allowed_paths
+	admin         AdminConfig
+	rateLimiter   *ipRateLimiter // nil when rate limiting is disabled
+	
+	// Request metrics (see metrics.go)
+	proxyRequests *counterVec
+	proxyLatency  *histogramVec
+	
+	handler      http.Handler // Routes behind the middleware chain
+	started      time.Time
+	shuttingDown int32         // Set once shutdown begins (see shutdown.go)
+	done         chan struct{} // Closed by Close to stop background work
 }
 
-func logInfo(format string, v ...interface{}) {
-	if logLevel <= INFO {
-		log.Printf("[INFO] "+format, v...)
-	}
+// keyPool rotates upstream requests through the API keys and tracks how each key fares
+type keyPool struct {
+	mutex  sync.RWMutex
+	keys   []APIKey
+	client *http.Client // Swapped on config reload
+	index  uint32
+	stats  sync.Map // Key ID -> *apiKeyStats
 }
 
-func logWarn(format string, v ...interface{}) {
-	if logLevel <= WARN {
-		log.Printf("[WARN] "+format, v...)
-	}
+// tileCache is the tile store with its index, memory tier, rules and stats
+type tileCache struct {
+	mutex  sync.RWMutex // Guards config and rules, swapped on config reload
+	config CacheConfig
+	rules  []*cacheRule
+	
+	stats         CacheStats
+	flight        flightGroup
+	mem           *memoryCache // nil when the memory tier is disabled
+	idx           *cacheIndex  // nil in subcommands, which leave the index alone
+	store         TileStore
+	pendingWrites int64 // Entries being written (see shutdown.go)
 }
 
-func logError(format string, v ...interface{}) {
-	if logLevel <= ERROR {
-		log.Printf("[ERROR] "+format, v...)
+// ==================== ACCESS CONTROL ====================
+
+// compilePathPatterns compiles allowlist regexes, skipping invalid ones
+func compilePathPatterns(patterns []string, issues *configIssues) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			issues.add("Invalid proxy.allowed_paths pattern %q, skipped: %v", p, err)
+			continue
+		}
+		compiled = append(compiled, re)
 	}
+	return compiled
 }
 
-// ==================== TILE CACHING ====================
+// proxySettings returns the current proxy settings
+func (s *Server) proxySettings() ProxyConfig {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.proxy
+}
 
-// isCacheable checks if a request path should be cached
-func isCacheable(path string) bool {
-	for _, pattern := range tilePatterns {
+// isPathAllowed checks an upstream path against the proxy allowlist
+func (s *Server) isPathAllowed(path string) bool {
+	s.mutex.RLock()
+	patterns := s.allowPatterns
+	s.mutex.RUnlock()
+	
+	for _, pattern := range patterns {
 		if pattern.MatchString(path) {
-			logDebug("✅ Cacheable: %s", path)
 			return true
 		}
 	}
-	logDebug("❌ Not cacheable: %s", path)
 	return false
 }
 
-// getCacheKey generates a unique cache key for a request
-func getCacheKey(path string, query url.Values) string {
-	// Create a normalized key from path + sorted query params (excluding apikey)
-	cleanQuery := url.Values{}
-	for k, v := range query {
-		// Exclude API key from cache key - same tile regardless of which key fetched it
-		if strings.ToLower(k) != "apikey" {
-			cleanQuery[k] = v
+// isMethodAllowed checks a request method against the proxy's allowed methods
+func (s *Server) isMethodAllowed(method string) bool {
+	for _, m := range s.proxySettings().AllowedMethods {
+		if strings.EqualFold(m, method) {
+			return true
 		}
 	}
+	return false
+}
+
+// allowRequest applies the per-client rate limit to a request that would hit
+// the upstream API or open a WebSocket, answering 429 when the client is over
+// its budget
+func (s *Server) allowRequest(w http.ResponseWriter, r *http.Request) bool {
+	s.mutex.RLock()
+	limiter, trustProxyHeaders := s.rateLimiter, s.proxy.RateLimit.TrustProxyHeaders
+	s.mutex.RUnlock()
+	if limiter == nil {
+		return true
+	}
 	
-	keyStr := path + "?" + cleanQuery.Encode()
+	ip := clientIP(r, trustProxyHeaders)
+	allowed, wait := limiter.Allow(ip)
+	if !allowed {
+		requestLog(r).With("ip", ip).Warn("🚦 Rate limit exceeded")
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// ==================== END ACCESS CONTROL ====================
+
+// ==================== TILE CACHING ====================
+
+// getCacheKey generates a unique cache key for a request under a cache rule
+func getCacheKey(path string, query url.Values, rule *cacheRule) string {
+	keyStr := cacheKeySource(path, query, rule)
 	hash := md5.Sum([]byte(keyStr))
 	cacheKey := hex.EncodeToString(hash[:])
 	
@@ -146,201 +294,407 @@ func getCacheKey(path string, query url.Values) string {
 	return cacheKey
 }
 
-// getCachePath returns the file path for a cache entry
-func getCachePath(cacheKey string) string {
-	// Use first 2 chars as subdirectory to avoid too many files in one dir
-	subdir := cacheKey[:2]
-	return filepath.Join(cacheConfig.Dir, subdir, cacheKey)
-}
-
-// getCacheMetaPath returns the metadata file path
-func getCacheMetaPath(cacheKey string) string {
-	return getCachePath(cacheKey) + ".meta"
+// cacheKeySource normalizes a request into the string its cache key is derived
+// from. It is stored in the entry's metadata to find the entry by path later.
+func cacheKeySource(path string, query url.Values, rule *cacheRule) string {
+	// Create a normalized key from path + sorted query params (excluding apikey)
+	cleanQuery := url.Values{}
+	if !rule.includeQuery() {
+		query = nil
+	}
+	for k, v := range query {
+		// Exclude API key from cache key - same tile regardless of which key fetched it
+		if strings.ToLower(k) != "apikey" {
+			cleanQuery[k] = v
+		}
+	}
+	
+	return path + "?" + cleanQuery.Encode()
 }
 
 // readFromCache tries to read a cached response
-func readFromCache(cacheKey string) ([]byte, map[string]string, bool) {
-	cachePath := getCachePath(cacheKey)
-	metaPath := getCacheMetaPath(cacheKey)
+func (c *tileCache) readFromCache(cacheKey string, rule *cacheRule) ([]byte, map[string]string, bool) {
+	maxAge := rule.maxAge()
+	
+	// Hot tiles are served from memory without touching the store
+	if c.mem != nil {
+		if entry, found := c.mem.Get(cacheKey); found {
+			if time.Since(entry.modTime) <= maxAge {
+				if c.idx != nil {
+					c.idx.Touch(cacheKey, rule.name(), 0, entry.modTime)
+				}
+				return entry.data, entry.headers, true
+			}
+			c.mem.Remove(cacheKey)
+		}
+	}
 	
-	// Check if cache file exists
-	info, err := os.Stat(cachePath)
+	entry, err := c.store.Get(cacheKey)
+	if err == errTileIncomplete {
+		c.quarantineCacheEntry(cacheKey, "metadata missing")
+		return nil, nil, false
+	}
 	if err != nil {
-		logDebug("📂 Cache file not found: %s", cachePath)
+		if err != errTileNotFound {
+			logWith("key", cacheKey).Warn("Failed to read cache entry: %v", err)
+		}
+		logDebug("📂 Cache entry not found: %s", cacheKey)
 		return nil, nil, false
 	}
 	
-	logDebug("📂 Cache file found: %s (size: %d)", cachePath, info.Size())
+	logWith("key", cacheKey, "bytes", len(entry.Data)).Debug("📂 Cache entry found")
+	headers, internal := parseCacheMeta(entry.Meta)
 	
 	// Check TTL
-	age := time.Since(info.ModTime())
-	if age > time.Duration(cacheConfig.TTLDays)*24*time.Hour {
-		// Cache expired, delete it
-		os.Remove(cachePath)
-		os.Remove(metaPath)
+	if time.Since(entry.Stored) > maxAge {
+		// Keep stale entries that upstream can revalidate, delete the rest
+		if hasRevalidators(internal) {
+			logDebug("📂 Cache entry stale, will revalidate: %s", cacheKey)
+			return nil, nil, false
+		}
+		c.removeCacheEntry(cacheKey)
+		if c.idx != nil {
+			c.idx.Remove(cacheKey)
+		}
 		return nil, nil, false
 	}
 	
-	// Read the cached data
-	data, err := os.ReadFile(cachePath)
-	if err != nil {
+	// Never serve a truncated or corrupted tile
+	if !verifyCacheData(entry.Data, internal) {
+		c.quarantineCacheEntry(cacheKey, "checksum mismatch")
 		return nil, nil, false
 	}
 	
-	// Read metadata (content-type, etc)
-	headers := make(map[string]string)
-	if metaData, err := os.ReadFile(metaPath); err == nil {
-		for _, line := range strings.Split(string(metaData), "\n") {
-			if parts := strings.SplitN(line, ": ", 2); len(parts) == 2 {
-				headers[parts[0]] = parts[1]
-			}
-		}
+	// Mark as recently used for LRU eviction
+	if c.idx != nil {
+		c.idx.Touch(cacheKey, rule.name(), entry.Size(), entry.Stored)
+		c.idx.SetPath(cacheKey, cacheSourcePath(internal[cacheMetaSource]))
 	}
 	
-	return data, headers, true
+	// Promote to the memory tier
+	if c.mem != nil {
+		c.mem.Add(cacheKey, entry.Data, headers, entry.Stored)
+	}
+	
+	return entry.Data, headers, true
 }
 
 // writeToCache stores a response in the cache
-func writeToCache(cacheKey string, data []byte, headers map[string]string) error {
-	cachePath := getCachePath(cacheKey)
-	metaPath := getCacheMetaPath(cacheKey)
-	
-	// Create subdirectory
-	dir := filepath.Dir(cachePath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+func (c *tileCache) writeToCache(cacheKey, source string, rule *cacheRule, data []byte, headers map[string]string) error {
+	cw, err := c.newCacheWriter(cacheKey, source, rule, c.shouldCompress(headers["Content-Type"], headers["Content-Encoding"]))
+	if err != nil {
 		return err
 	}
 	
-	// Write data
-	if err := os.WriteFile(cachePath, data, 0644); err != nil {
+	if _, err := cw.Write(data); err != nil {
+		cw.Abort()
 		return err
 	}
 	
-	// Write metadata
-	var metaLines []string
+	return cw.Commit(headers, nil)
+}
+
+// cacheWriter fills a cache entry in the tile store, hashing the stored bytes on
+// the way. Readers never see a partially written tile.
+type cacheWriter struct {
+	cache    *tileCache
+	cacheKey string
+	source   string // See cacheKeySource; recorded for finding entries by path
+	rule     *cacheRule
+	w        tileWriter
+	gz       *gzip.Writer // Set when the entry is stored compressed
+	written  int64        // Bytes as received
+	stored   int64        // Bytes as stored
+	hash     hash.Hash
+	done     bool // Counted out of the cache's pending writes
+}
+
+// newCacheWriter starts a new cache entry, gzipping it on the way when compress is set
+func (c *tileCache) newCacheWriter(cacheKey, source string, rule *cacheRule, compress bool) (*cacheWriter, error) {
+	w, err := c.store.Create(cacheKey)
+	if err != nil {
+		return nil, err
+	}
+	
+	cw := &cacheWriter{cache: c, cacheKey: cacheKey, source: source, rule: rule, w: w, hash: sha256.New()}
+	if compress {
+		cw.gz = gzip.NewWriter(storeWriterFunc(cw.writeStored))
+	}
+	atomic.AddInt64(&c.pendingWrites, 1)
+	return cw, nil
+}
+
+// finish counts the writer out of the pending writes shutdown waits for
+func (c *cacheWriter) finish() {
+	if !c.done {
+		c.done = true
+		atomic.AddInt64(&c.cache.pendingWrites, -1)
+	}
+}
+
+// storeWriterFunc adapts cacheWriter.writeStored for the gzip writer
+type storeWriterFunc func(p []byte) (int, error)
+
+func (f storeWriterFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func (c *cacheWriter) Write(p []byte) (int, error) {
+	if c.gz != nil {
+		n, err := c.gz.Write(p)
+		c.written += int64(n)
+		return n, err
+	}
+	n, err := c.writeStored(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// writeStored passes bytes to the store as they will be kept
+func (c *cacheWriter) writeStored(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.stored += int64(n)
+	c.hash.Write(p[:n])
+	return n, err
+}
+
+// Commit stores the entry with its metadata.
+// Entries without an upstream ETag get one derived from the content hash, and
+// Last-Modified defaults to the commit time.
+func (c *cacheWriter) Commit(headers, internal map[string]string) error {
+	defer c.finish()
+	
+	if c.gz != nil {
+		if err := c.gz.Close(); err != nil {
+			c.Abort()
+			return err
+		}
+	}
+	
+	// The metadata carries the checksum the data is verified against on read
+	sum := hex.EncodeToString(c.hash.Sum(nil))
+	metaHeaders := map[string]string{
+		"ETag":          `"` + sum[:32] + `"`,
+		"Last-Modified": time.Now().UTC().Format(http.TimeFormat),
+	}
 	for k, v := range headers {
-		metaLines = append(metaLines, k+": "+v)
+		if v != "" {
+			metaHeaders[k] = v
+		}
+	}
+	if c.gz != nil {
+		metaHeaders["Content-Encoding"] = "gzip"
+	}
+	metaInternal := map[string]string{cacheMetaChecksum: "sha256:" + sum}
+	if !strings.ContainsAny(c.source, "\r\n") {
+		metaInternal[cacheMetaSource] = c.source
+	}
+	for k, v := range internal {
+		if v != "" {
+			metaInternal[k] = v
+		}
+	}
+	metaData := formatCacheMeta(metaHeaders, metaInternal)
+	if err := c.w.Commit(metaData); err != nil {
+		return err
 	}
-	if err := os.WriteFile(metaPath, []byte(strings.Join(metaLines, "\n")), 0644); err != nil {
-		// Non-fatal, we can still serve without metadata
-		logWarn("Failed to write cache metadata: %v", err)
+	
+	if c.gz != nil {
+		atomic.AddUint64(&c.cache.stats.compressedWrites, 1)
+		atomic.AddUint64(&c.cache.stats.originalBytes, uint64(c.written))
+		atomic.AddUint64(&c.cache.stats.storedBytes, uint64(c.stored))
+	}
+	
+	// Track the new entry and keep the cache within its size limit
+	if c.cache.idx != nil {
+		c.cache.idx.Put(c.cacheKey, c.rule.name(), cacheSourcePath(c.source), c.stored+int64(len(metaData)), time.Now())
+		c.cache.enforceCacheLimit()
 	}
 	
 	return nil
 }
 
-// initCache creates cache directory and starts cleanup goroutine
-func initCache() {
-	// Create cache directory
-	if err := os.MkdirAll(cacheConfig.Dir, 0755); err != nil {
-		logError("Failed to create cache directory: %v", err)
-		return
+// Abort discards a partially written entry
+func (c *cacheWriter) Abort() {
+	c.w.Abort()
+	c.finish()
+}
+
+// newTileCache sets up a cache with its config and compiled rules. Nothing is
+// opened until open (or, in subcommands, until a store is assigned).
+func newTileCache(cfg CacheConfig, rules []*cacheRule) *tileCache {
+	return &tileCache{config: cfg, rules: rules}
+}
+
+// settings returns the current cache config
+func (c *tileCache) settings() CacheConfig {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.config
+}
+
+// open opens the tile store and index
+func (c *tileCache) open() error {
+	cfg := c.settings()
+	store, err := openTileStore(cfg)
+	if err != nil {
+		return err
+	}
+	c.store = store
+	logInfo("🗄️ Tile store: %s", c.store)
+	
+	// The index is local state, kept in the cache dir for every backend
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return err
+	}
+	
+	// Load the cache index (rebuilt from the store on first start)
+	idx, err := openCacheIndex(cfg.Dir, c.store)
+	if err != nil {
+		c.store.Close()
+		return err
+	}
+	c.idx = idx
+	
+	// Clean up after crashes in the background - reads verify checksums anyway
+	go c.scanCache(cfg.StartupScan)
+	
+	// In-memory tier for hot tiles
+	if cfg.MemoryMB > 0 {
+		c.mem = newMemoryCache(int64(cfg.MemoryMB) * 1024 * 1024)
+		logInfo("🧠 Memory cache tier: %dMB", cfg.MemoryMB)
 	}
 	
 	// Get initial cache size
-	size, count := getCacheSize()
-	logInfo("📦 Tile cache initialized: %d files, %.2f MB", count, float64(size)/(1024*1024))
+	size, count := c.getCacheSize()
+	logWith("entries", count, "bytes", size).Info("📦 Tile cache initialized")
 	
-	// Start background cleanup
-	go func() {
-		for {
-			time.Sleep(time.Duration(cacheConfig.CleanupHours) * time.Hour)
-			cleanupCache()
-		}
-	}()
+	return nil
 }
 
-// getCacheSize returns total cache size and file count
-func getCacheSize() (int64, int) {
-	var totalSize int64
-	var count int
-	
-	filepath.Walk(cacheConfig.Dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
+// runCleanup cleans the cache every cleanup_hours until done is closed
+func (c *tileCache) runCleanup(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Duration(c.settings().CleanupHours) * time.Hour):
+			c.cleanupCache()
 		}
-		totalSize += info.Size()
-		count++
-		return nil
-	})
+	}
+}
+
+// getCacheSize returns total cache size and entry count from the index
+func (c *tileCache) getCacheSize() (int64, int) {
+	if c.idx == nil {
+		return 0, 0
+	}
+	return c.idx.Stats()
+}
+
+// removeCacheEntry deletes an entry from the store and the memory tier
+func (c *tileCache) removeCacheEntry(cacheKey string) {
+	if err := c.store.Delete(cacheKey); err != nil {
+		logWith("key", cacheKey).Warn("Failed to delete cache entry: %v", err)
+	}
+	if c.mem != nil {
+		c.mem.Remove(cacheKey)
+	}
+}
+
+// clearCache deletes every cache entry and resets the stats
+func (c *tileCache) clearCache() error {
+	if err := c.store.Clear(); err != nil {
+		return err
+	}
+	if c.idx != nil {
+		c.idx.Reset()
+	}
+	if c.mem != nil {
+		c.mem.Clear()
+	}
 	
-	return totalSize, count
+	atomic.StoreUint64(&c.stats.hits, 0)
+	atomic.StoreUint64(&c.stats.misses, 0)
+	atomic.StoreUint64(&c.stats.savedBytes, 0)
+	atomic.StoreUint64(&c.stats.coalesced, 0)
+	atomic.StoreUint64(&c.stats.quarantined, 0)
+	atomic.StoreUint64(&c.stats.notModified, 0)
+	atomic.StoreUint64(&c.stats.revalidated, 0)
+	atomic.StoreUint64(&c.stats.expired, 0)
+	atomic.StoreUint64(&c.stats.evicted, 0)
+	atomic.StoreUint64(&c.stats.compressedWrites, 0)
+	atomic.StoreUint64(&c.stats.originalBytes, 0)
+	atomic.StoreUint64(&c.stats.storedBytes, 0)
+	atomic.StoreUint64(&c.stats.servedCompressed, 0)
+	atomic.StoreUint64(&c.stats.servedDecompressed, 0)
+	c.resetCacheRuleCounters()
+	return nil
 }
 
-// cleanupCache removes expired entries and enforces size limit
-func cleanupCache() {
-	logDebug("🧹 Starting cache cleanup...")
+// enforceCacheLimit evicts least recently used entries until every rule fits its
+// max_size_share and the cache fits max_size_mb
+func (c *tileCache) enforceCacheLimit() (int, int64) {
+	if c.idx == nil {
+		return 0, 0
+	}
 	
-	type fileInfo struct {
-		path    string
-		modTime time.Time
-		size    int64
+	count, freed := c.enforceCacheRuleShares()
+	
+	evicted, size := c.idx.TakeLRU(int64(c.settings().MaxSizeMB) * 1024 * 1024)
+	for _, key := range evicted {
+		c.removeCacheEntry(key)
 	}
+	count += len(evicted)
+	freed += size
+	atomic.AddUint64(&c.stats.evicted, uint64(count))
 	
-	var files []fileInfo
-	var totalSize int64
-	var expired int
+	if count > 0 {
+		logWith("entries", count, "freed_bytes", freed).Debug("🧹 Evicted LRU entries")
+	}
+	return count, freed
+}
+
+// cleanupCache removes expired entries and enforces size limit
+func (c *tileCache) cleanupCache() {
+	if c.idx == nil {
+		return
+	}
 	
-	now := time.Now()
-	maxAge := time.Duration(cacheConfig.TTLDays) * 24 * time.Hour
+	logDebug("🧹 Starting cache cleanup...")
 	
-	filepath.Walk(cacheConfig.Dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
-		}
-		
-		age := now.Sub(info.ModTime())
-		if age > maxAge {
-			// Remove expired files
-			os.Remove(path)
-			expired++
-			return nil
+	// Expired entries that upstream can revalidate stay until LRU eviction
+	var expired int
+	for _, key := range c.idx.ExpiredKeys(c.cacheRuleMaxAge) {
+		if internal, ok := c.readCacheInternal(key); ok && hasRevalidators(internal) {
+			continue
 		}
-		
-		files = append(files, fileInfo{path, info.ModTime(), info.Size()})
-		totalSize += info.Size()
-		return nil
-	})
+		c.idx.Remove(key)
+		c.removeCacheEntry(key)
+		expired++
+	}
+	atomic.AddUint64(&c.stats.expired, uint64(expired))
 	
-	// If over size limit, delete oldest files first
-	maxSize := int64(cacheConfig.MaxSizeMB) * 1024 * 1024
-	var sizeDeleted int64
-	var countDeleted int
-	
-	if totalSize > maxSize {
-		// Sort by mod time (oldest first) - simple bubble sort is fine for this
-		for i := 0; i < len(files)-1; i++ {
-			for j := 0; j < len(files)-i-1; j++ {
-				if files[j].modTime.After(files[j+1].modTime) {
-					files[j], files[j+1] = files[j+1], files[j]
-				}
-			}
-		}
-		
-		// Delete until under limit
-		for _, f := range files {
-			if totalSize <= maxSize {
-				break
-			}
-			os.Remove(f.path)
-			os.Remove(f.path + ".meta") // Also remove metadata
-			totalSize -= f.size
-			sizeDeleted += f.size
-			countDeleted++
+	// If over size limit, delete least recently used entries first
+	countDeleted, sizeDeleted := c.enforceCacheLimit()
+	
+	c.idx.Compact()
+	if compactor, ok := c.store.(tileStoreCompactor); ok {
+		if err := compactor.Compact(); err != nil {
+			logError("Failed to compact tile store: %v", err)
 		}
 	}
 	
 	if expired > 0 || countDeleted > 0 {
-		logInfo("🧹 Cache cleanup: %d expired, %d removed (%.2f MB freed)", 
-			expired, countDeleted, float64(sizeDeleted)/(1024*1024))
+		logWith("expired", expired, "removed", countDeleted, "freed_bytes", sizeDeleted).Info("🧹 Cache cleanup")
 	}
 }
 
 // logCacheStats periodically logs cache performance
-func logCacheStats() {
-	hits := atomic.LoadUint64(&cacheStats.hits)
-	misses := atomic.LoadUint64(&cacheStats.misses)
-	savedBytes := atomic.LoadUint64(&cacheStats.savedBytes)
+func (c *tileCache) logCacheStats() {
+	hits := atomic.LoadUint64(&c.stats.hits)
+	misses := atomic.LoadUint64(&c.stats.misses)
+	savedBytes := atomic.LoadUint64(&c.stats.savedBytes)
 	
 	total := hits + misses
 	if total == 0 {
@@ -348,215 +702,415 @@ func logCacheStats() {
 	}
 	
 	hitRate := float64(hits) / float64(total) * 100
-	savedMB := float64(savedBytes) / (1024 * 1024)
 	
-	logInfo("📊 Cache stats: %d hits, %d misses (%.1f%% hit rate), %.2f MB saved", 
-		hits, misses, hitRate, savedMB)
+	logWith("hits", hits, "misses", misses, "hit_rate", fmt.Sprintf("%.1f%%", hitRate), "saved_bytes", savedBytes).
+		Info("📊 Cache stats")
 }
 
 // ==================== END TILE CACHING ====================
 
-func init() {
-	// Parse log level from environment
-	logLevelStr := strings.ToUpper(os.Getenv("LOG_LEVEL"))
-	switch logLevelStr {
-	case "DEBUG":
-		logLevel = DEBUG
-	case "INFO", "":
-		logLevel = INFO
-	case "WARN", "WARNING":
-		logLevel = WARN
-	case "ERROR":
-		logLevel = ERROR
-	default:
-		logLevel = INFO
-		logWarn("Unknown LOG_LEVEL '%s', defaulting to INFO", logLevelStr)
-	}
-	
-	logInfo("Log level set to: %s", []string{"DEBUG", "INFO", "WARN", "ERROR"}[logLevel])
-	
-	// Load API keys from YAML file
-	if err := loadAPIKeys(); err != nil {
-		logWarn("Failed to load api_keys.yaml: %v", err)
-		logWarn("Falling back to environment variable...")
-		
-		// Fallback to environment variable
-		keysEnv := os.Getenv("MAPY_API_KEYS")
-		if keysEnv == "" {
-			logWarn("No API keys found. Set MAPY_API_KEYS or create api_keys.yaml")
-			apiKeys = []APIKey{{ID: "default", Value: "YOUR_API_KEY"}}
-		} else {
-			for i, key := range strings.Split(keysEnv, ",") {
-				apiKeys = append(apiKeys, APIKey{
-					ID:    fmt.Sprintf("env-%d", i+1),
-					Value: strings.TrimSpace(key),
-				})
-			}
-			logInfo("🔑 Loaded %d API key(s) from environment", len(apiKeys))
-		}
-	} else {
-		logInfo("🔑 Loaded %d API key(s) from api_keys.yaml", len(apiKeys))
-	}
+// ==================== SERVER ====================
 
-	// Create HTTP client with connection pooling and no SSL verification
-	httpClient = &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 100,
-			IdleConnTimeout:     90,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
+// NewServer builds a server from cfg and opens its tile cache. Close releases
+// it; ListenAndServe does so on shutdown.
+func NewServer(cfg Config) (*Server, error) {
+	s := newServer(cfg)
+	
+	// Subcommands that only need the config, keys and rules skip this
+	if err := s.cache.open(); err != nil {
+		return nil, err
 	}
-
-	// Static file server
-	staticServer = http.FileServer(http.Dir("."))
 	
-	// Initialize tile cache
-	initCache()
+	go s.cache.runCleanup(s.done)
 	
 	// Periodically log cache stats
 	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
 		for {
-			time.Sleep(5 * time.Minute)
-			logCacheStats()
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.cache.logCacheStats()
+			}
 		}
 	}()
+	
+	return s, nil
 }
 
-func loadAPIKeys() error {
-	// Try settings.yaml first, fall back to api_keys.yaml
-	var data []byte
-	var err error
-	var configFile string
+// newServer builds a server from cfg without opening the tile cache
+func newServer(cfg Config) *Server {
+	rc := cfg.resolve()
+	rc.logSummary()
+	proxyCfg := rc.Proxy
 	
-	data, err = os.ReadFile("settings.yaml")
-	if err == nil {
-		configFile = "settings.yaml"
-	} else {
-		data, err = os.ReadFile("api_keys.yaml")
-		if err != nil {
-			return err
-		}
-		configFile = "api_keys.yaml"
+	s := &Server{
+		keys:          &keyPool{client: newHTTPClient(proxyCfg)},
+		cache:         newTileCache(rc.Cache, rc.cacheRules),
+		sessions:      newSessionRegistry(rc.Multiplayer),
+		assets:        newAssetStore(rc.Server.StaticDir),
+		configFile:    cfg.file,
+		configFlags:   cfg.flags,
+		server:        rc.Server,
+		proxy:         proxyCfg,
+		allowPatterns: rc.allowPatterns,
+		admin:         cfg.Admin,
+		started:       time.Now(),
+		done:          make(chan struct{}),
 	}
+	s.keys.set(cfg.keyList())
+	s.initMetrics()
 	
-	logInfo("📄 Loading config from %s", configFile)
-
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return err
+	// Per-client rate limit for requests that reach the upstream API
+	if proxyCfg.RateLimit.RequestsPerSecond > 0 {
+		s.rateLimiter = newIPRateLimiter(proxyCfg.RateLimit.RequestsPerSecond, proxyCfg.RateLimit.Burst)
 	}
+	
+	s.handler = s.middleware(s.routes())
+	return s
+}
 
-	keyMutex.Lock()
-	defer keyMutex.Unlock()
+// middleware wraps h in the chain every request passes through (see middleware.go)
+func (s *Server) middleware(h http.Handler) http.Handler {
+	return chain(h, requestID, logRequests, recoverPanics, s.cors)
+}
 
-	apiKeys = nil
-	for _, keyMap := range config.APIKeys {
-		for id, value := range keyMap {
-			apiKeys = append(apiKeys, APIKey{
-				ID:    id,
-				Value: value,
-			})
-		}
+// routes registers the server's endpoints. Middleware shared by every route is
+// applied in newServer; route-specific middleware is applied here.
+func (s *Server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	
+	// WebSocket endpoint
+	mux.Handle("/ws", chain(http.HandlerFunc(s.handleWebSocket), s.rateLimit))
+	
+	// Build and protocol version (see version.go)
+	mux.HandleFunc("/api/version", s.versionHandler)
+	
+	// Cache stats endpoint
+	mux.HandleFunc("/api/cache", s.cacheHandler)
+	
+	// Liveness and readiness probes (see health.go)
+	mux.HandleFunc("/healthz", s.healthzHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	
+	// Prometheus metrics
+	mux.HandleFunc("/metrics", s.metricsHandler)
+	
+	// Authenticated admin API
+	mux.HandleFunc("/api/admin/", s.adminHandler)
+	
+	// Proxy API requests, rate limited once past the cache
+	mux.HandleFunc("/api/mapy/", s.proxyHandler)
+	
+	// Frontend and region boundaries (see static.go)
+	mux.Handle("/", s.assets)
+	
+	return mux
+}
+
+// ServeHTTP passes requests through the middleware chain to their route
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Close stops background work, flushes the index and closes the tile store
+func (s *Server) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+		close(s.done)
 	}
+	return s.cache.close()
+}
+
+// ==================== END SERVER ====================
 
-	if len(apiKeys) == 0 {
-		return fmt.Errorf("no API keys found in %s", configFile)
+// newHTTPClient builds the upstream client from proxy settings.
+// TLS verification is on unless explicitly disabled; ca_file adds a custom
+// CA bundle on top of the system roots.
+func newHTTPClient(cfg ProxyConfig) *http.Client {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.TLS.InsecureSkipVerify,
+	}
+	if cfg.TLS.InsecureSkipVerify {
+		logWarn("⚠️  Upstream TLS verification is DISABLED - API keys can be intercepted")
 	}
 	
-	// Load cache config with defaults for missing values
-	cacheMutex.Lock()
-	defer cacheMutex.Unlock()
+	if cfg.TLS.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(cfg.TLS.CAFile)
+		if err != nil {
+			logError("Failed to read CA bundle %s: %v", cfg.TLS.CAFile, err)
+		} else if !pool.AppendCertsFromPEM(pem) {
+			logError("No certificates found in CA bundle %s", cfg.TLS.CAFile)
+		} else {
+			tlsConfig.RootCAs = pool
+			logInfo("🔒 Using custom CA bundle: %s", cfg.TLS.CAFile)
+		}
+	}
 	
-	if config.Cache.TTLDays > 0 {
-		cacheConfig.TTLDays = config.Cache.TTLDays
+	return &http.Client{
+		Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     time.Duration(cfg.IdleTimeoutSeconds) * time.Second,
+			TLSClientConfig:     tlsConfig,
+		},
 	}
-	if config.Cache.MaxSizeMB > 0 {
-		cacheConfig.MaxSizeMB = config.Cache.MaxSizeMB
+}
+
+// upstreamURL builds the full upstream URL for an API path
+func (s *Server) upstreamURL(apiPath string, query url.Values) string {
+	return strings.TrimSuffix(s.proxySettings().UpstreamURL, "/") + "/" + apiPath + "?" + query.Encode()
+}
+
+// apiKeyStats counts upstream requests per API key
+type apiKeyStats struct {
+	requests   uint64
+	failures   uint64 // Network errors and rejected keys (401/403)
+	lastStatus int64  // Last upstream status, 0 for a network error
+	lastUsed   int64  // Unix time
+}
+
+// set replaces the pool's keys. A key whose value changed starts with fresh
+// results, so readiness doesn't judge a rotated key by the one it replaced
+// (see health.go).
+func (p *keyPool) set(keys []APIKey) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	
+	previous := make(map[string]string, len(p.keys))
+	for _, key := range p.keys {
+		previous[key.ID] = key.Value
 	}
-	if config.Cache.Dir != "" {
-		cacheConfig.Dir = config.Cache.Dir
+	for _, key := range keys {
+		if previous[key.ID] != key.Value {
+			p.stats.Delete(key.ID)
+		}
 	}
-	if config.Cache.CleanupHours > 0 {
-		cacheConfig.CleanupHours = config.Cache.CleanupHours
+	p.keys = keys
+}
+
+// list returns the pool's keys
+func (p *keyPool) list() []APIKey {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.keys
+}
+
+// httpClient returns the upstream client
+func (p *keyPool) httpClient() *http.Client {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.client
+}
+
+// setHTTPClient swaps the upstream client, closing the old one's idle connections
+func (p *keyPool) setHTTPClient(client *http.Client) {
+	p.mutex.Lock()
+	old := p.client
+	p.client = client
+	p.mutex.Unlock()
+	old.CloseIdleConnections()
+}
+
+// keyStats returns the results recorded for a key
+func (p *keyPool) keyStats(id string) (*apiKeyStats, bool) {
+	value, ok := p.stats.Load(id)
+	if !ok {
+		return nil, false
 	}
-	
-	logInfo("📦 Cache config: TTL=%d days, MaxSize=%dMB, Dir=%s, Cleanup=%dh",
-		cacheConfig.TTLDays, cacheConfig.MaxSizeMB, cacheConfig.Dir, cacheConfig.CleanupHours)
+	return value.(*apiKeyStats), true
+}
 
-	return nil
+// record counts one upstream attempt with a key
+func (p *keyPool) record(id string, status int) {
+	value, _ := p.stats.LoadOrStore(id, &apiKeyStats{})
+	stats := value.(*apiKeyStats)
+	atomic.AddUint64(&stats.requests, 1)
+	if status == 0 || status == http.StatusUnauthorized || status == http.StatusForbidden {
+		atomic.AddUint64(&stats.failures, 1)
+	}
+	atomic.StoreInt64(&stats.lastStatus, int64(status))
+	atomic.StoreInt64(&stats.lastUsed, time.Now().Unix())
 }
 
-// Get next API key with atomic rotation
-func getAPIKey() APIKey {
-	keyMutex.RLock()
-	defer keyMutex.RUnlock()
+// next returns the next API key with atomic rotation
+func (p *keyPool) next() APIKey {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
 	
-	if len(apiKeys) == 0 {
+	if len(p.keys) == 0 {
 		return APIKey{ID: "none", Value: ""}
 	}
 	
-	idx := atomic.AddUint32(&keyIndex, 1) % uint32(len(apiKeys))
-	return apiKeys[idx]
+	idx := atomic.AddUint32(&p.index, 1) % uint32(len(p.keys))
+	return p.keys[idx]
 }
 
-// Proxy handler for Mapy.cz API requests with retry logic and caching
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract path after /api/mapy/
-	apiPath := strings.TrimPrefix(r.URL.Path, "/api/mapy/")
-	
-	// Parse query parameters
-	query := r.URL.Query()
-	
-	// Check if this request is cacheable (tile requests)
-	shouldCache := isCacheable(apiPath)
-	var cacheKey string
-	
-	if shouldCache {
-		cacheKey = getCacheKey(apiPath, query)
-		
-		// Try to serve from cache
-		if data, headers, found := readFromCache(cacheKey); found {
-			// Cache hit! Serve from cache
-			atomic.AddUint64(&cacheStats.hits, 1)
-			atomic.AddUint64(&cacheStats.savedBytes, uint64(len(data)))
-			
-			// Set headers from cache
-			for k, v := range headers {
-				w.Header().Set(k, v)
-			}
-			
-			// Add CORS and cache headers
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("X-Cache", "HIT")
-			w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(cacheConfig.TTLDays*24*60*60))
-			
-			w.WriteHeader(http.StatusOK)
-			w.Write(data)
-			
-			logDebug("📦 Cache HIT: %s", apiPath)
-			return
+// upstreamResponse is the result of a coalesced upstream fetch, shared with
+// requests that waited for it
+type upstreamResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte // Buffered body of non-200 responses
+	Cached     bool   // 200 body was streamed into the cache; serve it from there
+}
+
+// upstreamError describes a failed upstream fetch and the status to report to the client
+type upstreamError struct {
+	Status  int
+	Message string
+}
+
+func (e *upstreamError) Error() string {
+	return e.Message
+}
+
+// errResponseTooLarge is returned when an upstream body exceeds proxy.max_response_mb
+var errResponseTooLarge = fmt.Errorf("upstream response exceeds size limit")
+
+// maxBytesReader fails with errResponseTooLarge once more than remaining bytes are read
+type maxBytesReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.remaining <= 0 {
+		// Probe for one more byte to tell "exactly at the limit" from "over it"
+		var probe [1]byte
+		n, err := m.r.Read(probe[:])
+		if n > 0 {
+			return 0, errResponseTooLarge
 		}
-		
-		// Cache miss
-		atomic.AddUint64(&cacheStats.misses, 1)
-		logDebug("📦 Cache MISS: %s", apiPath)
+		return 0, err
+	}
+	if int64(len(p)) > m.remaining {
+		p = p[:m.remaining]
 	}
+	n, err := m.r.Read(p)
+	m.remaining -= int64(n)
+	return n, err
+}
+
+// limitBody wraps an upstream body with the configured size limit
+func (s *Server) limitBody(body io.Reader) io.Reader {
+	return &maxBytesReader{r: body, remaining: int64(s.proxySettings().MaxResponseMB) * 1024 * 1024}
+}
+
+// clientWriteTimeout bounds each write of a streamed body to the client. The
+// server has no overall WriteTimeout (panoramas and WebSockets are long-lived),
+// so without it a stalled client would stall the coalesced fetch it leads.
+const clientWriteTimeout = 10 * time.Second
+
+// clientWriter writes to a client with a deadline per write
+type clientWriter struct {
+	w       http.ResponseWriter
+	control *http.ResponseController
+}
+
+func newClientWriter(w http.ResponseWriter) *clientWriter {
+	return &clientWriter{w: w, control: http.NewResponseController(w)}
+}
+
+func (c *clientWriter) Write(p []byte) (int, error) {
+	c.control.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	return c.w.Write(p)
+}
+
+// done clears the deadline so it can't hit the next request on the connection
+func (c *clientWriter) done() {
+	c.control.SetWriteDeadline(time.Time{})
+}
+
+// cacheTee streams a body to the client and into a cache entry. A failing client
+// doesn't stop the cache fill (coalesced requests depend on it), and a failing
+// cache write doesn't stop the client.
+type cacheTee struct {
+	client    io.Writer
+	cache     io.Writer
+	clientErr error
+	cacheErr  error
+}
+
+func (t *cacheTee) Write(p []byte) (int, error) {
+	if t.clientErr == nil {
+		_, t.clientErr = t.client.Write(p)
+	}
+	if t.cacheErr == nil {
+		_, t.cacheErr = t.cache.Write(p)
+	}
+	if t.clientErr != nil && t.cacheErr != nil {
+		return 0, t.clientErr
+	}
+	return len(p), nil
+}
+
+// flightCall is an in-progress or completed upstream fetch shared by concurrent requests
+type flightCall struct {
+	wg   sync.WaitGroup
+	resp *upstreamResponse
+	err  error
+}
+
+// flightGroup deduplicates concurrent upstream fetches keyed by cache key
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Do runs fn once per key at a time; concurrent callers with the same key wait
+// for the first one and receive its result. shared reports whether the result
+// was produced by another caller.
+func (g *flightGroup) Do(key string, fn func() (*upstreamResponse, error)) (resp *upstreamResponse, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.resp, c.err, true
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+	
+	c.resp, c.err = fn()
 	
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	c.wg.Done()
+	
+	return c.resp, c.err, false
+}
+
+// fetchUpstream forwards the request to Mapy.cz, rotating through API keys on failure.
+// For cached requests conditional is non-nil: the client's own conditional
+// and Range headers are dropped (they apply to our cache, not upstream's) and
+// these are sent instead. On success the caller owns the response and must close its body.
+func (s *Server) fetchUpstream(r *http.Request, apiPath string, query url.Values, conditional http.Header) (*http.Response, error) {
 	// Try each API key until one works
-	keyMutex.RLock()
-	maxAttempts := len(apiKeys)
-	keyMutex.RUnlock()
+	maxAttempts := len(s.keys.list())
+	client := s.keys.httpClient() // Swapped on config reload
 	
 	if maxAttempts == 0 {
-		http.Error(w, "No API keys configured", http.StatusInternalServerError)
-		return
+		return nil, &upstreamError{http.StatusInternalServerError, "No API keys configured"}
 	}
 	
 	for attempt := 0; attempt < maxAttempts; attempt++ {
-		apiKey := getAPIKey()
+		apiKey := s.keys.next()
 		
 		// Clone query for this attempt
 		attemptQuery := make(map[string][]string)
@@ -579,13 +1133,12 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 				queryParams.Add(k, val)
 			}
 		}
-		targetURL := fmt.Sprintf("https://api.mapy.cz/%s?%s", apiPath, queryParams.Encode())
+		targetURL := s.upstreamURL(apiPath, queryParams)
 		
 		// Create proxy request
 		proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, &upstreamError{http.StatusInternalServerError, err.Error()}
 		}
 		
 		// Copy headers, skipping hop-by-hop, browser-origin, and Sec-* headers
@@ -603,216 +1156,541 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 			if skipHeaders[canonical] || strings.HasPrefix(canonical, "Sec-") {
 				continue
 			}
+			if conditional != nil && strings.HasPrefix(canonical, "If-") {
+				continue
+			}
+			// A partial response must never be shared with coalesced requests or
+			// cached, so cacheable requests always fetch the whole body
+			if conditional != nil && canonical == "Range" {
+				continue
+			}
+			// Cached responses are stored decoded (or gzipped by us, see cachecompression.go),
+			// so let the transport negotiate and decode the upstream encoding
+			if conditional != nil && canonical == "Accept-Encoding" {
+				continue
+			}
 			for _, value := range values {
 				proxyReq.Header.Add(key, value)
 			}
 		}
+		for key, values := range conditional {
+			proxyReq.Header[key] = values
+		}
 
 		// Replace the SDK's X-Mapy-Api-Key header (sent as "proxy") with the real key
 		proxyReq.Header.Set("X-Mapy-Api-Key", apiKey.Value)
 		
-		// Make request to Mapy.cz
-		resp, err := httpClient.Do(proxyReq)
+		// Make request to upstream
+		resp, err := client.Do(proxyReq)
 		if err != nil {
-			logError("❌ [%s] Network error: %v", apiKey.ID, err)
+			s.keys.record(apiKey.ID, 0)
+			requestLog(r).With("key", apiKey.ID).Error("❌ Network error: %v", err)
 			if attempt < maxAttempts-1 {
-				logInfo("🔄 Retrying with next API key...")
+				requestLog(r).Info("🔄 Retrying with next API key...")
 				continue
 			}
-			http.Error(w, err.Error(), http.StatusBadGateway)
-			return
+			return nil, &upstreamError{http.StatusBadGateway, err.Error()}
 		}
 		
+		s.keys.record(apiKey.ID, resp.StatusCode)
+		
 		// Check for API key errors (401, 403)
 		if resp.StatusCode == 401 || resp.StatusCode == 403 {
-			logError("❌ [%s] Invalid API key (HTTP %d)", apiKey.ID, resp.StatusCode)
+			requestLog(r).With("key", apiKey.ID, "status", resp.StatusCode).Error("❌ Invalid API key")
 			resp.Body.Close() // Close before retrying
 			if attempt < maxAttempts-1 {
-				logInfo("🔄 Retrying with next API key...")
+				requestLog(r).Info("🔄 Retrying with next API key...")
 				continue
 			}
 			// Last attempt failed, return the error
-			http.Error(w, "API key authentication failed", resp.StatusCode)
-			return
+			return nil, &upstreamError{resp.StatusCode, "API key authentication failed"}
 		}
 		
 		// Success! Log at DEBUG level for 200s
 		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			logDebug("✅ [%s] Request successful (HTTP %d) - %s", apiKey.ID, resp.StatusCode, apiPath)
+			requestLog(r).With("key", apiKey.ID, "status", resp.StatusCode, "path", apiPath).Debug("✅ Request successful")
 		} else if resp.StatusCode >= 400 {
-			logWarn("⚠️  [%s] Request returned error (HTTP %d) - %s", apiKey.ID, resp.StatusCode, apiPath)
+			requestLog(r).With("key", apiKey.ID, "status", resp.StatusCode, "path", apiPath).Warn("⚠️  Request returned error")
 		}
 		
-		// Read response body (we need it for caching anyway)
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close() // Close immediately after reading
-		if err != nil {
-			http.Error(w, "Failed to read response", http.StatusBadGateway)
-			return
+		// Reject bodies that announce a size over the limit before streaming anything
+		if limit := int64(s.proxySettings().MaxResponseMB) * 1024 * 1024; resp.ContentLength > limit {
+			resp.Body.Close()
+			requestLog(r).With("key", apiKey.ID, "bytes", resp.ContentLength, "path", apiPath).Error("❌ Response too large")
+			return nil, &upstreamError{http.StatusBadGateway, errResponseTooLarge.Error()}
 		}
 		
-		// Cache successful tile responses
-		if shouldCache && resp.StatusCode == 200 && len(body) > 0 {
-			logDebug("📝 Will cache: %s (key: %s, size: %d)", apiPath, cacheKey, len(body))
-			// Prepare headers to cache
-			cacheHeaders := map[string]string{
-				"Content-Type": resp.Header.Get("Content-Type"),
-			}
-			if ct := resp.Header.Get("Content-Length"); ct != "" {
-				cacheHeaders["Content-Length"] = ct
-			}
-			
-			// Write to cache asynchronously - capture apiPath in closure
-			pathForLog := apiPath
-			go func(key string, data []byte, headers map[string]string, logPath string) {
-				if err := writeToCache(key, data, headers); err != nil {
-					logWarn("Failed to cache tile: %v", err)
-				} else {
-					logDebug("📦 Cached: %s (%d bytes)", logPath, len(data))
-				}
-			}(cacheKey, body, cacheHeaders, pathForLog)
-		} else if shouldCache {
-			logDebug("⚠️ Not caching: status=%d, bodyLen=%d", resp.StatusCode, len(body))
+		return resp, nil
+	}
+	
+	// All attempts failed
+	requestLog(r).With("attempts", maxAttempts).Error("❌ All API keys failed")
+	return nil, &upstreamError{http.StatusUnauthorized, "All API keys failed"}
+}
+
+// setProxyHeaders copies upstream response headers and adds cache headers
+// A nil rule marks a response that isn't cached. Only 200s get the rule's
+// lifetime; errors must not stick in browser caches for the tile TTL.
+func setProxyHeaders(w http.ResponseWriter, upstream http.Header, status int, rule *cacheRule, cacheStatus string) {
+	// Copy response headers; CORS is ours to answer (see middleware.go)
+	for key, values := range upstream {
+		if strings.HasPrefix(key, "Access-Control-") {
+			continue
 		}
-		
-		// Copy response headers
-		for key, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
+		for _, value := range values {
+			w.Header().Add(key, value)
 		}
-		
-		// Add CORS headers
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		
-		// Add cache headers
-		if shouldCache {
-			w.Header().Set("X-Cache", "MISS")
-			w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(cacheConfig.TTLDays*24*60*60))
+	}
+	
+	// Add cache headers
+	if rule != nil {
+		w.Header().Set("X-Cache", cacheStatus)
+		switch {
+		case status == http.StatusOK || status == http.StatusNotModified:
+			w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(rule.ttlDays()*24*60*60))
+		case upstream.Get("Cache-Control") == "":
+			w.Header().Set("Cache-Control", "no-store")
 		}
-		
-		// Write status code
-		w.WriteHeader(resp.StatusCode)
-		
-		// Write response body
-		w.Write(body)
+	}
+}
+
+// serveFromCache writes a cached entry to the client, reporting whether it was found.
+// Conditional requests matching the entry's validators get a 304.
+func (s *Server) serveFromCache(w http.ResponseWriter, r *http.Request, cacheKey, apiPath string, rule *cacheRule, cacheStatus string) bool {
+	data, headers, found := s.cache.readFromCache(cacheKey, rule)
+	if !found {
+		return false
+	}
+	
+	// Entries cached before validators were stored get a content-hash ETag
+	etag := headers["ETag"]
+	if etag == "" {
+		etag = `"` + strings.TrimPrefix(checksumData(data), "sha256:")[:32] + `"`
+	}
+	
+	// Gzipped entries go out as stored when the client accepts gzip (a weak ETag
+	// tells the variants apart) and are decoded for everyone else
+	body := data
+	compressed := headers["Content-Encoding"] == "gzip"
+	passthrough := compressed && acceptsGzip(r)
+	if passthrough {
+		etag = weakETag(etag)
+	}
+	notModified := isNotModified(r, map[string]string{
+		"ETag":          etag,
+		"Last-Modified": headers["Last-Modified"],
+	})
+	if compressed && !passthrough && !notModified {
+		decoded, err := gunzip(data)
+		if err != nil {
+			s.cache.quarantineCacheEntry(cacheKey, "invalid gzip data")
+			return false
+		}
+		body = decoded
+	}
+	
+	atomic.AddUint64(&s.cache.stats.savedBytes, uint64(len(data)))
+	
+	// Set headers from cache
+	for k, v := range headers {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("ETag", etag)
+	if compressed {
+		w.Header().Set("Vary", "Accept-Encoding")
+		if !passthrough {
+			w.Header().Del("Content-Encoding")
+		}
+	}
+	
+	// Add cache headers
+	w.Header().Set("X-Cache", cacheStatus)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(rule.ttlDays()*24*60*60))
+	
+	if notModified {
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		atomic.AddUint64(&s.cache.stats.notModified, 1)
+		requestLog(r).Debug("📦 Cache %s (304): %s", cacheStatus, apiPath)
+		return true
+	}
+	
+	if passthrough {
+		atomic.AddUint64(&s.cache.stats.servedCompressed, 1)
+	} else if compressed {
+		atomic.AddUint64(&s.cache.stats.servedDecompressed, 1)
+	}
+	
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	
+	requestLog(r).Debug("📦 Cache %s: %s", cacheStatus, apiPath)
+	return true
+}
+
+// proxyDirect streams an upstream response to the client without caching or coalescing
+// rule is the cache rule of cacheable requests, nil otherwise.
+func (s *Server) proxyDirect(w http.ResponseWriter, r *http.Request, apiPath string, query url.Values, rule *cacheRule) {
+	var conditional http.Header
+	if rule != nil {
+		conditional = http.Header{}
+	}
+	resp, err := s.fetchUpstream(r, apiPath, query, conditional)
+	if err != nil {
+		writeUpstreamError(w, err)
 		return
 	}
+	defer resp.Body.Close()
 	
-	// All attempts failed
-	logError("❌ All %d API keys failed", maxAttempts)
-	http.Error(w, "All API keys failed", http.StatusUnauthorized)
+	setProxyHeaders(w, resp.Header, resp.StatusCode, rule, "MISS")
+	w.WriteHeader(resp.StatusCode)
+	
+	if _, err := io.Copy(w, s.limitBody(resp.Body)); err == errResponseTooLarge {
+		requestLog(r).Error("❌ Response too large, aborting - %s", apiPath)
+		// Abort the connection so the client can't mistake a truncated body for a complete one
+		panic(http.ErrAbortHandler)
+	}
 }
 
-// Cache stats and management endpoint
-func cacheHandler(w http.ResponseWriter, r *http.Request) {
-	action := r.URL.Query().Get("action")
+// fetchAndCache fetches a tile as the leader of a coalesced group. It streams the
+// body to its own client while teeing it into the cache, and returns what waiting
+// requests need to answer theirs.
+func (s *Server) fetchAndCache(w http.ResponseWriter, r *http.Request, apiPath string, query url.Values, cacheKey string, rule *cacheRule) (*upstreamResponse, error) {
+	// A stale entry with upstream validators is revalidated rather than refetched
+	conditional := s.cache.staleCacheValidators(cacheKey)
 	
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	
-	switch action {
-	case "clear":
-		// Clear the entire cache
-		if err := os.RemoveAll(cacheConfig.Dir); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, `{"error": "Failed to clear cache: %s"}`, err.Error())
-			return
+	resp, err := s.fetchUpstream(r, apiPath, query, conditional)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	
+	result := &upstreamResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+	}
+	
+	if resp.StatusCode == http.StatusNotModified && len(conditional) > 0 {
+		if err := s.cache.refreshCacheEntry(cacheKey); err == nil && s.serveFromCache(w, r, cacheKey, apiPath, rule, "REVALIDATED") {
+			atomic.AddUint64(&s.cache.stats.revalidated, 1)
+			result.Cached = true
+			return result, nil
 		}
-		os.MkdirAll(cacheConfig.Dir, 0755)
-		
-		// Reset stats
-		atomic.StoreUint64(&cacheStats.hits, 0)
-		atomic.StoreUint64(&cacheStats.misses, 0)
-		atomic.StoreUint64(&cacheStats.savedBytes, 0)
-		
-		logInfo("🗑️ Cache cleared by request")
-		fmt.Fprintf(w, `{"status": "cleared"}`)
-		
-	case "cleanup":
-		// Force cleanup
-		go cleanupCache()
-		fmt.Fprintf(w, `{"status": "cleanup_started"}`)
-		
-	default:
-		// Return stats
-		hits := atomic.LoadUint64(&cacheStats.hits)
-		misses := atomic.LoadUint64(&cacheStats.misses)
-		savedBytes := atomic.LoadUint64(&cacheStats.savedBytes)
-		size, count := getCacheSize()
-		
-		total := hits + misses
-		hitRate := float64(0)
-		if total > 0 {
-			hitRate = float64(hits) / float64(total) * 100
+		// The entry vanished meanwhile - fetch it in full
+		resp.Body.Close()
+		resp, err = s.fetchUpstream(r, apiPath, query, http.Header{})
+		if err != nil {
+			return nil, err
 		}
+		defer resp.Body.Close()
+		result.StatusCode = resp.StatusCode
+		result.Header = resp.Header
+	}
+	
+	// Error responses are small and not cached - buffer them so waiting requests can share them
+	if resp.StatusCode != http.StatusOK {
+		requestLog(r).With("status", resp.StatusCode).Debug("⚠️ Not caching")
+		body, err := io.ReadAll(s.limitBody(resp.Body))
+		if err != nil {
+			return nil, &upstreamError{http.StatusBadGateway, "Failed to read response"}
+		}
+		result.Body = body
 		
-		fmt.Fprintf(w, `{
-	"hits": %d,
-	"misses": %d,
-	"hit_rate_percent": %.2f,
-	"saved_bytes": %d,
-	"saved_mb": %.2f,
-	"cache_size_bytes": %d,
-	"cache_size_mb": %.2f,
-	"cached_files": %d,
-	"ttl_days": %d,
-	"max_size_mb": %d
-}`, hits, misses, hitRate, savedBytes, float64(savedBytes)/(1024*1024),
-			size, float64(size)/(1024*1024), count, cacheConfig.TTLDays, cacheConfig.MaxSizeMB)
+		setProxyHeaders(w, resp.Header, resp.StatusCode, rule, "MISS")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+		return result, nil
+	}
+	
+	setProxyHeaders(w, resp.Header, resp.StatusCode, rule, "MISS")
+	w.WriteHeader(resp.StatusCode)
+	client := newClientWriter(w)
+	defer client.done()
+	
+	cw, err := s.cache.newCacheWriter(cacheKey, cacheKeySource(apiPath, query, rule), rule, s.cache.shouldCompress(resp.Header.Get("Content-Type"), resp.Header.Get("Content-Encoding")))
+	if err != nil {
+		requestLog(r).Warn("Failed to cache tile: %v", err)
+		io.Copy(client, s.limitBody(resp.Body))
+		return result, nil
+	}
+	
+	tee := &cacheTee{client: client, cache: cw}
+	n, err := io.Copy(tee, s.limitBody(resp.Body))
+	if err != nil || tee.cacheErr != nil || n == 0 {
+		cw.Abort()
+		if err == nil {
+			err = tee.cacheErr
+		}
+		requestLog(r).With("path", apiPath, "bytes", n).Debug("⚠️ Not caching: %v", err)
+		return result, nil
+	}
+	
+	cacheHeaders, cacheInternal := cacheMetaFromResponse(resp, n)
+	if err := cw.Commit(cacheHeaders, cacheInternal); err != nil {
+		requestLog(r).Warn("Failed to cache tile: %v", err)
+		return result, nil
+	}
+	
+	requestLog(r).With("path", apiPath, "bytes", n).Debug("📦 Cached")
+	result.Cached = true
+	return result, nil
+}
+
+// cacheMetaFromResponse builds the metadata stored with an upstream response of
+// n bytes. Upstream validators are served to clients and kept for revalidating
+// the entry once it expires.
+func cacheMetaFromResponse(resp *http.Response, n int64) (map[string]string, map[string]string) {
+	headers := map[string]string{
+		"Content-Type":     resp.Header.Get("Content-Type"),
+		"Content-Length":   strconv.FormatInt(n, 10),
+		"Content-Encoding": resp.Header.Get("Content-Encoding"),
+		"ETag":             resp.Header.Get("ETag"),
+		"Last-Modified":    resp.Header.Get("Last-Modified"),
+	}
+	internal := map[string]string{
+		cacheMetaRevalidateETag:         resp.Header.Get("ETag"),
+		cacheMetaRevalidateLastModified: resp.Header.Get("Last-Modified"),
 	}
+	return headers, internal
 }
 
-// Main handler
-func mainHandler(w http.ResponseWriter, r *http.Request) {
-	// Handle CORS preflight
-	if r.Method == "OPTIONS" {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		w.WriteHeader(http.StatusOK)
+// writeUpstreamError reports a failed upstream fetch to the client
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	if ue, ok := err.(*upstreamError); ok {
+		status = ue.Status
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// Proxy handler for Mapy.cz API requests with retry logic and caching
+func (s *Server) proxyHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract path after /api/mapy/
+	apiPath := strings.TrimPrefix(r.URL.Path, "/api/mapy/")
+	
+	// Request metrics (see metrics.go)
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = recorder
+	defer func() {
+		s.observeProxyRequest(apiPath, recorder.status, w.Header().Get("X-Cache"), time.Since(start))
+	}()
+	
+	// Only forward allowed methods and paths - every request carries our API key
+	if !s.isMethodAllowed(r.Method) {
+		w.Header().Set("Allow", strings.Join(s.proxySettings().AllowedMethods, ", "))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.isPathAllowed(apiPath) {
+		requestLog(r).Warn("🚫 Blocked proxy request to non-allowlisted path: %s", apiPath)
+		http.Error(w, "Path not allowed", http.StatusForbidden)
 		return
 	}
 	
-	// WebSocket endpoint
-	if r.URL.Path == "/ws" {
-		handleWebSocket(w, r)
+	// Parse query parameters
+	query := r.URL.Query()
+	
+	// Check if this request is cacheable (see cacherules.go)
+	rule := s.cache.matchCacheRule(apiPath)
+	if rule == nil || r.Method != http.MethodGet {
+		if s.allowRequest(w, r) {
+			s.proxyDirect(w, r, apiPath, query, nil)
+		}
 		return
 	}
 	
-	// Cache management endpoint
-	if r.URL.Path == "/api/cache" {
-		cacheHandler(w, r)
+	cacheKey := getCacheKey(apiPath, query, rule)
+	
+	// Try to serve from cache
+	if s.serveFromCache(w, r, cacheKey, apiPath, rule, "HIT") {
+		atomic.AddUint64(&s.cache.stats.hits, 1)
+		rule.countHit()
 		return
 	}
 	
-	// Proxy API requests
-	if strings.HasPrefix(r.URL.Path, "/api/mapy/") {
-		proxyHandler(w, r)
+	// Cache miss
+	atomic.AddUint64(&s.cache.stats.misses, 1)
+	rule.countMiss()
+	requestLog(r).Debug("📦 Cache MISS: %s", apiPath)
+	
+	if !s.allowRequest(w, r) {
 		return
 	}
 	
-	// Serve static files
-	staticServer.ServeHTTP(w, r)
+	// Coalesce concurrent fetches of the same tile into one upstream request.
+	// The leader answers its own client while streaming; everyone else waits.
+	resp, err, shared := s.cache.flight.Do(cacheKey, func() (*upstreamResponse, error) {
+		return s.fetchAndCache(w, r, apiPath, query, cacheKey, rule)
+	})
+	if !shared {
+		if err != nil {
+			writeUpstreamError(w, err)
+		}
+		return
+	}
+	
+	atomic.AddUint64(&s.cache.stats.coalesced, 1)
+	requestLog(r).Debug("🤝 Coalesced upstream fetch: %s", apiPath)
+	
+	switch {
+	case err != nil:
+		writeUpstreamError(w, err)
+	case resp.Cached && s.serveFromCache(w, r, cacheKey, apiPath, rule, "COALESCED"):
+	case resp.StatusCode != http.StatusOK:
+		setProxyHeaders(w, resp.Header, resp.StatusCode, rule, "COALESCED")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(resp.Body)
+	default:
+		// The leader couldn't cache the body - fetch our own copy
+		s.proxyDirect(w, r, apiPath, query, rule)
+	}
+}
+
+// Public cache stats endpoint. Cache management lives in the admin API (admin.go).
+func (s *Server) cacheHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	
+	if r.URL.Query().Get("action") != "" {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprintf(w, `{"error": "Cache management moved to the authenticated /api/admin/cache endpoints"}`)
+		return
+	}
+	
+	s.cache.writeCacheStats(w)
+}
+
+// writeCacheStats writes the cache stats as JSON
+func (c *tileCache) writeCacheStats(w http.ResponseWriter) {
+	cfg := c.settings()
+	hits := atomic.LoadUint64(&c.stats.hits)
+	misses := atomic.LoadUint64(&c.stats.misses)
+	savedBytes := atomic.LoadUint64(&c.stats.savedBytes)
+	coalesced := atomic.LoadUint64(&c.stats.coalesced)
+	quarantined := atomic.LoadUint64(&c.stats.quarantined)
+	notModified := atomic.LoadUint64(&c.stats.notModified)
+	revalidated := atomic.LoadUint64(&c.stats.revalidated)
+	size, count := c.getCacheSize()
+	
+	compressedWrites := atomic.LoadUint64(&c.stats.compressedWrites)
+	originalBytes := atomic.LoadUint64(&c.stats.originalBytes)
+	storedBytes := atomic.LoadUint64(&c.stats.storedBytes)
+	rules, _ := json.MarshalIndent(c.getCacheRuleStats(), "\t", "\t")
+	
+	compressionRatio := float64(0)
+	if storedBytes > 0 {
+		compressionRatio = float64(originalBytes) / float64(storedBytes)
+	}
+	
+	var memHits, memMisses uint64
+	var memEntries int
+	var memSize int64
+	if c.mem != nil {
+		memHits, memMisses, memEntries, memSize = c.mem.Stats()
+	}
+	
+	total := hits + misses
+	hitRate := float64(0)
+	if total > 0 {
+		hitRate = float64(hits) / float64(total) * 100
+	}
+	
+	fmt.Fprintf(w, `{
+	"hits": %d,
+	"misses": %d,
+	"hit_rate_percent": %.2f,
+	"saved_bytes": %d,
+	"saved_mb": %.2f,
+	"coalesced": %d,
+	"quarantined": %d,
+	"not_modified": %d,
+	"revalidated": %d,
+	"cache_size_bytes": %d,
+	"cache_size_mb": %.2f,
+	"cached_files": %d,
+	"ttl_days": %d,
+	"max_size_mb": %d,
+	"memory": {
+		"enabled": %t,
+		"hits": %d,
+		"misses": %d,
+		"entries": %d,
+		"size_bytes": %d,
+		"max_size_mb": %d
+	},
+	"compression": {
+		"algorithm": %q,
+		"compressed_writes": %d,
+		"original_bytes": %d,
+		"stored_bytes": %d,
+		"saved_bytes": %d,
+		"ratio": %.2f,
+		"served_compressed": %d,
+		"served_decompressed": %d
+	},
+	"rules": %s
+}`, hits, misses, hitRate, savedBytes, float64(savedBytes)/(1024*1024), coalesced, quarantined, notModified, revalidated,
+		size, float64(size)/(1024*1024), count, cfg.TTLDays, cfg.MaxSizeMB,
+		c.mem != nil, memHits, memMisses, memEntries, memSize, cfg.MemoryMB,
+		cfg.Compression, compressedWrites, originalBytes, storedBytes, originalBytes-storedBytes, compressionRatio,
+		atomic.LoadUint64(&c.stats.servedCompressed), atomic.LoadUint64(&c.stats.servedDecompressed), rules)
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "config":
+			runConfigCommand(os.Args[2:])
+			return
+		case "mock-upstream":
+			mustLoadConfig("", nil)
+			runMockUpstream(os.Args[2:])
+			return
+		case "prewarm":
+			runPrewarm(mustLoadConfig("", nil), os.Args[2:])
+			return
+		}
 	}
 	
-	http.HandleFunc("/", mainHandler)
+	// Settings from the config file, env vars and flags (see config.go)
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	configFile, configFlags := configFlags(fs)
+	fs.Parse(os.Args[1:])
 	
-	addr := fmt.Sprintf(":%s", port)
-	logInfo("🚀 Server running on http://localhost%s", addr)
+	cfg := mustLoadConfig(*configFile, configFlags)
+	srv, err := NewServer(cfg)
+	if err != nil {
+		logError("Failed to open tile cache: %v", err)
+		os.Exit(1)
+	}
+	
+	addr := net.JoinHostPort(srv.server.Host, strconv.Itoa(srv.server.Port))
+	host := srv.server.Host
+	if host == "" {
+		host = "localhost"
+	}
+	
+	cacheCfg := srv.cache.settings()
+	scheme := "http"
+	if srv.server.TLS.enabled() {
+		scheme = "https"
+	}
+	logInfo("🚀 Server running on %s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(srv.server.Port)))
 	logInfo("📊 Connection pool: 100 max idle connections")
-	logInfo("📦 Tile cache: %d-day TTL, %dMB max size, dir: %s", cacheConfig.TTLDays, cacheConfig.MaxSizeMB, cacheConfig.Dir)
+	logInfo("📦 Tile cache: %d-day TTL, %dMB max size, dir: %s, %d rules", cacheCfg.TTLDays, cacheCfg.MaxSizeMB, cacheCfg.Dir, len(srv.cache.cacheRuleList()))
 	logInfo("📍 Cache stats endpoint: /api/cache")
+	logInfo("📈 Metrics endpoint: /metrics")
+	logInfo("🩺 Health checks: /healthz (liveness), /readyz (readiness)")
+	if srv.adminEnabled() {
+		logInfo("🔐 Admin API: /api/admin/")
+	} else {
+		logInfo("🔐 Admin API disabled (set admin.token or admin.username/password in settings.yaml)")
+	}
 	
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if err := srv.ListenAndServe(addr); err != nil {
 		logError("Failed to start server: %v", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	setupLogging(LoggingConfig{Level: "ERROR"})
+	os.Exit(m.Run())
+}
+
+// newTestServer builds a Server with its cache in a temp dir; configure
+// adjusts the config before the server is built
+func newTestServer(t *testing.T, configure func(cfg *Config)) *Server {
+	t.Helper()
+	var cfg Config
+	cfg.Cache.Dir = t.TempDir()
+	cfg.Cache.MemoryMB = -1
+	cfg.Cache.StartupScan = "off"
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// newMockUpstreamServer starts the fake Mapy.cz API (see mockupstream.go);
+// keyStatus forces HTTP statuses for some API keys
+func newMockUpstreamServer(t *testing.T, keyStatus map[string]int) (*mockUpstream, string) {
+	t.Helper()
+	if keyStatus == nil {
+		keyStatus = make(map[string]int)
+	}
+	mock := &mockUpstream{
+		fixturesDir: "mockdata",
+		keyStatus:   keyStatus,
+		requests:    make(map[string]map[string]int),
+	}
+	srv := httptest.NewServer(mock)
+	t.Cleanup(srv.Close)
+	return mock, srv.URL + "/"
+}
+
+// requestCount returns how many requests for path the mock received with key,
+// or with any key when key is empty
+func (m *mockUpstream) requestCount(path, key string) int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if key != "" {
+		return m.requests[path][key]
+	}
+	total := 0
+	for _, n := range m.requests[path] {
+		total += n
+	}
+	return total
+}
+
+// newProxyTestServer builds a Server proxying to upstreamURL with the given
+// API key values
+func newProxyTestServer(t *testing.T, upstreamURL string, keys ...string) *Server {
+	t.Helper()
+	return newTestServer(t, func(cfg *Config) {
+		cfg.Proxy.UpstreamURL = upstreamURL
+		for _, key := range keys {
+			cfg.APIKeys = append(cfg.APIKeys, map[string]string{key: key})
+		}
+	})
+}
+
+// get sends a GET request through the server's middleware chain
+func get(s *Server, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestProxyMockUpstream(t *testing.T) {
+	mock, upstreamURL := newMockUpstreamServer(t, nil)
+	s := newProxyTestServer(t, upstreamURL, "good")
+
+	const tile = "v1/maptiles/basic/256/10/550/300"
+	rec := get(s, "/api/mapy/"+tile+"?apikey=proxy", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("tile status = %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("tile Content-Type = %q, want image/png", ct)
+	}
+	if _, err := png.Decode(rec.Body); err != nil {
+		t.Errorf("tile isn't a PNG: %v", err)
+	}
+	if n := mock.requestCount(tile, "good"); n != 1 {
+		t.Errorf("upstream saw %d tile requests with the real key, want 1", n)
+	}
+
+	// Not cached: served from mockdata/v1/suggest.json
+	rec = get(s, "/api/mapy/v1/suggest?query=praha&apikey=proxy", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("suggest status = %d, want 200", rec.Code)
+	}
+	fixture, err := os.ReadFile("mockdata/v1/suggest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), fixture) {
+		t.Errorf("suggest body doesn't match the fixture")
+	}
+}
+
+func TestProxyCacheMissThenHit(t *testing.T) {
+	mock, upstreamURL := newMockUpstreamServer(t, nil)
+	s := newProxyTestServer(t, upstreamURL, "good")
+
+	const tile = "v1/maptiles/basic/256/10/551/300"
+	first := get(s, "/api/mapy/"+tile, nil)
+	second := get(s, "/api/mapy/"+tile, nil)
+
+	if first.Code != http.StatusOK || second.Code != http.StatusOK {
+		t.Fatalf("statuses = %d, %d, want 200", first.Code, second.Code)
+	}
+	if got := first.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("first X-Cache = %q, want MISS", got)
+	}
+	if got := second.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("second X-Cache = %q, want HIT", got)
+	}
+	if !bytes.Equal(first.Body.Bytes(), second.Body.Bytes()) {
+		t.Errorf("cached body differs from the fetched one")
+	}
+	if n := mock.requestCount(tile, ""); n != 1 {
+		t.Errorf("upstream saw %d requests, want 1", n)
+	}
+}
+
+func TestProxyCoalescesConcurrentMisses(t *testing.T) {
+	mock, upstreamURL := newMockUpstreamServer(t, nil)
+	mock.latency = 200 * time.Millisecond // Keeps the leader's fetch open while the rest arrive
+	s := newProxyTestServer(t, upstreamURL, "good")
+
+	const tile = "v1/maptiles/basic/256/10/552/300"
+	const clients = 10
+	recs := make([]*httptest.ResponseRecorder, clients)
+	var wg sync.WaitGroup
+	for i := range recs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recs[i] = get(s, "/api/mapy/"+tile, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	statuses := make(map[string]int)
+	for _, rec := range recs {
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), recs[0].Body.Bytes()) {
+			t.Errorf("clients got different bodies")
+		}
+		statuses[rec.Header().Get("X-Cache")]++
+	}
+	if statuses["MISS"] != 1 {
+		t.Errorf("X-Cache statuses = %v, want exactly one MISS", statuses)
+	}
+	if statuses["COALESCED"] == 0 {
+		t.Errorf("X-Cache statuses = %v, want COALESCED requests", statuses)
+	}
+	if n := mock.requestCount(tile, ""); n != 1 {
+		t.Errorf("upstream saw %d requests, want 1", n)
+	}
+}
+
+func TestProxyNotModified(t *testing.T) {
+	mock, upstreamURL := newMockUpstreamServer(t, nil)
+	s := newProxyTestServer(t, upstreamURL, "good")
+
+	const tile = "v1/maptiles/basic/256/10/553/300"
+	first := get(s, "/api/mapy/"+tile, nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("status = %d, ETag = %q, want 200 with an ETag", first.Code, etag)
+	}
+
+	// The client's copy is current
+	rec := get(s, "/api/mapy/"+tile, http.Header{"If-None-Match": {etag}})
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("conditional status = %d, want 304", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("304 has a %d byte body", rec.Body.Len())
+	}
+
+	// An expired entry is revalidated upstream instead of fetched again
+	key := getCacheKey(tile, url.Values{}, s.cache.matchCacheRule(tile))
+	if err := s.cache.store.Touch(key, time.Now().AddDate(-1, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	rec = get(s, "/api/mapy/"+tile, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Errorf("stale entry: status = %d, X-Cache = %q, want 200 REVALIDATED", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if !bytes.Equal(rec.Body.Bytes(), first.Body.Bytes()) {
+		t.Errorf("revalidated body differs from the original")
+	}
+	if n := mock.requestCount(tile, ""); n != 2 {
+		t.Errorf("upstream saw %d requests, want 2 (fetch and revalidation)", n)
+	}
+}
+
+func TestProxyIgnoresRangeOnCacheablePaths(t *testing.T) {
+	// Unlike the mock, this upstream honors Range
+	tileBody := bytes.Repeat([]byte("0123456789"), 100)
+	var ranged int
+	var mutex sync.Mutex
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			mutex.Lock()
+			ranged++
+			mutex.Unlock()
+		}
+		w.Header().Set("Content-Type", "image/png")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(tileBody))
+	}))
+	defer upstream.Close()
+	s := newProxyTestServer(t, upstream.URL+"/", "good")
+
+	const tile = "/api/mapy/v1/maptiles/basic/256/10/554/300"
+	rec := get(s, tile, http.Header{"Range": {"bytes=0-9"}})
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), tileBody) {
+		t.Errorf("ranged request: status = %d with %d bytes, want 200 with the whole tile", rec.Code, rec.Body.Len())
+	}
+	rec = get(s, tile, nil)
+	if rec.Header().Get("X-Cache") != "HIT" || !bytes.Equal(rec.Body.Bytes(), tileBody) {
+		t.Errorf("follow-up: X-Cache = %q with %d bytes, want a HIT with the whole tile", rec.Header().Get("X-Cache"), rec.Body.Len())
+	}
+	if ranged != 0 {
+		t.Errorf("upstream saw %d ranged requests, want 0", ranged)
+	}
+}
+
+func TestProxyKeyFailover(t *testing.T) {
+	mock, upstreamURL := newMockUpstreamServer(t, map[string]int{"revoked": http.StatusUnauthorized})
+	s := newProxyTestServer(t, upstreamURL, "revoked", "good")
+
+	for i := 0; i < 3; i++ {
+		tile := fmt.Sprintf("v1/maptiles/basic/256/10/%d/300", 560+i)
+		rec := get(s, "/api/mapy/"+tile, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", tile, rec.Code)
+		}
+		if n := mock.requestCount(tile, "good"); n != 1 {
+			t.Errorf("%s: upstream saw %d requests with the good key, want 1", tile, n)
+		}
+	}
+
+	// With every key rejected the client gets an error, not a cached failure
+	mock.mutex.Lock()
+	mock.keyStatus["good"] = http.StatusForbidden
+	mock.mutex.Unlock()
+	rec := get(s, "/api/mapy/v1/maptiles/basic/256/10/570/300", nil)
+	if rec.Code == http.StatusOK {
+		t.Errorf("status = 200 with every key rejected")
+	}
+}
+
+func TestWebSocketCreateSession(t *testing.T) {
+	s := newTestServer(t, nil)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "hello" {
+		t.Fatalf("first message = %+v, %v, want hello", msg, err)
+	}
+	conn.WriteJSON(WSMessage{Type: "hello", Payload: map[string]interface{}{"protocol": ProtocolVersion}})
+	conn.WriteJSON(WSMessage{Type: "createSession", Payload: map[string]interface{}{
+		"nick": "Tester", "icon": "😀", "settings": map[string]interface{}{},
+	}})
+
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "sessionCreated" {
+		t.Fatalf("reply = %+v, %v, want sessionCreated", msg, err)
+	}
+	payload, _ := msg.Payload.(map[string]interface{})
+	if code, _ := payload["code"].(string); code == "" {
+		t.Errorf("sessionCreated without a code: %+v", payload)
+	}
+}
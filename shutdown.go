@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ==================== GRACEFUL SHUTDOWN ====================
+//
+// On SIGINT/SIGTERM the server marks itself not ready (see health.go), stops
+// taking new multiplayer sessions and games, and sends every session a
+// serverShutdown message with a countdown. Rounds in progress may finish until
+// server.shutdown_timeout_seconds runs out. Then the HTTP server shuts down,
+// letting in-flight requests complete, cache writes still pending are waited
+// for, WebSockets are closed and the index is flushed once as the tile store is
+// released. A second signal exits immediately.
+
+const (
+	shutdownRequestTimeout = 10 * time.Second // Time left for in-flight requests
+	cacheFlushTimeout      = 5 * time.Second
+)
+
+// isShuttingDown reports whether shutdown has begun
+func (s *Server) isShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) != 0
+}
+
+// shutdownTimeout returns the drain time from server.shutdown_timeout_seconds
+func (s *Server) shutdownTimeout() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return time.Duration(*s.server.ShutdownTimeoutSeconds) * time.Second
+}
+
+// ListenAndServe serves on addr, over HTTPS when configured (see tls.go),
+// until a listener fails or a shutdown signal arrives. Either way the server is
+// closed when it returns.
+func (s *Server) ListenAndServe(addr string) error {
+	defer s.Close()
+
+	listeners, err := s.httpListeners(addr)
+	if err != nil {
+		return err
+	}
+	servers := make([]*http.Server, len(listeners))
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		servers[i] = l.srv
+		go func(l httpListener) {
+			errs <- l.serve()
+		}(l)
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errs:
+		for _, srv := range servers {
+			srv.Close()
+		}
+		return err
+	case sig := <-signals:
+		logWith("signal", sig.String()).Info("🛑 Shutting down")
+	}
+
+	go func() {
+		<-signals
+		logWarn("🛑 Second signal, exiting immediately")
+		os.Exit(1)
+	}()
+
+	s.shutdown(servers, s.shutdownTimeout())
+	for range servers {
+		if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// shutdown drains multiplayer sessions, stops servers and closes the cache
+func (s *Server) shutdown(servers []*http.Server, timeout time.Duration) {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+
+	s.sessions.drain(timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownRequestTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			logWarn("HTTP shutdown incomplete: %v", err)
+		}
+	}
+
+	// No new writes start now; Close flushes the index after these
+	s.cache.waitForWrites(cacheFlushTimeout)
+	s.sessions.closeAll()
+	s.Close()
+	logInfo("👋 Server stopped")
+}
+
+// drain stops new sessions, games and rounds, announces the shutdown to every
+// session and waits until no round is in progress or the timeout passes
+func (reg *sessionRegistry) drain(timeout time.Duration) {
+	atomic.StoreInt32(&reg.draining, 1)
+
+	reg.mutex.RLock()
+	list := make([]*GameSession, 0, len(reg.sessions))
+	for _, s := range reg.sessions {
+		list = append(list, s)
+	}
+	reg.mutex.RUnlock()
+
+	if len(list) == 0 {
+		return
+	}
+
+	seconds := int(timeout.Seconds())
+	for _, s := range list {
+		s.broadcast("serverShutdown", map[string]interface{}{
+			"seconds": seconds,
+		})
+	}
+	logWith("sessions", len(list), "timeout_seconds", seconds).Info("🛑 Notified sessions, waiting for running rounds")
+
+	deadline := time.Now().Add(timeout)
+	for {
+		active := reg.activeRounds()
+		if active == 0 {
+			logInfo("🛑 No rounds in progress")
+			return
+		}
+		if time.Now().After(deadline) {
+			logWith("rounds", active).Warn("🛑 Shutdown timeout reached with rounds in progress")
+			return
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// isDraining reports whether the registry stopped taking new sessions and games
+func (reg *sessionRegistry) isDraining() bool {
+	return atomic.LoadInt32(&reg.draining) != 0
+}
+
+// activeRounds counts sessions with a round being played
+func (reg *sessionRegistry) activeRounds() int {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	active := 0
+	for _, s := range reg.sessions {
+		s.mutex.RLock()
+		if s.RoundActive {
+			active++
+		}
+		s.mutex.RUnlock()
+	}
+	return active
+}
+
+// closeAll closes every remaining WebSocket connection
+func (reg *sessionRegistry) closeAll() {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for _, s := range reg.sessions {
+		s.mutex.RLock()
+		for _, p := range s.Players {
+			if p.Conn != nil {
+				p.Conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+				p.Conn.Close()
+			}
+		}
+		s.mutex.RUnlock()
+	}
+}
+
+// waitForWrites waits for cache entries being written
+func (c *tileCache) waitForWrites(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&c.pendingWrites) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if pending := atomic.LoadInt64(&c.pendingWrites); pending > 0 {
+		logWith("pending", pending).Warn("📦 Cache writes still pending")
+	}
+}
+
+// close closes the index and the tile store
+func (c *tileCache) close() error {
+	if c.idx != nil {
+		if err := c.idx.Close(); err != nil {
+			logWarn("Failed to close cache index: %v", err)
+		}
+	}
+	if c.store == nil {
+		return nil
+	}
+	if err := c.store.Close(); err != nil {
+		logWarn("Failed to close tile store: %v", err)
+		return err
+	}
+	return nil
+}
+
+// ==================== END GRACEFUL SHUTDOWN ====================
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsClient is a test WebSocket client past the protocol handshake
+type wsClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func dialWS(t *testing.T, srv *httptest.Server) *wsClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &wsClient{t: t, conn: conn}
+	c.expect("hello")
+	c.send("hello", map[string]interface{}{"protocol": ProtocolVersion})
+	return c
+}
+
+func (c *wsClient) send(msgType string, payload interface{}) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(WSMessage{Type: msgType, Payload: payload}); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect skips messages until one of msgType arrives
+func (c *wsClient) expect(msgType string) WSMessage {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg WSMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+// expectError waits for an error message with the given text
+func (c *wsClient) expectError(text string) {
+	c.t.Helper()
+	msg := c.expect("error")
+	payload, _ := msg.Payload.(map[string]interface{})
+	if payload["message"] != text {
+		c.t.Errorf("error = %v, want %q", payload["message"], text)
+	}
+}
+
+func TestDrainStopsNewRounds(t *testing.T) {
+	saved := nextRoundDelay
+	nextRoundDelay = 50 * time.Millisecond
+	t.Cleanup(func() { nextRoundDelay = saved })
+
+	s := newTestServer(t, nil)
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	owner := dialWS(t, srv)
+	owner.send("createSession", map[string]interface{}{
+		"nick": "Owner", "icon": "😀", "settings": map[string]interface{}{},
+	})
+	owner.expect("sessionCreated")
+	owner.send("toggleReady", nil)
+	owner.expect("playerReady")
+	owner.send("startGame", nil)
+	owner.expect("gameStarted")
+
+	// Draining waits for the round in progress
+	drained := make(chan struct{})
+	go func() {
+		s.sessions.drain(5 * time.Second)
+		close(drained)
+	}()
+	msg := owner.expect("serverShutdown")
+	if payload, _ := msg.Payload.(map[string]interface{}); payload["seconds"] != 5.0 {
+		t.Errorf("serverShutdown payload = %v, want 5 seconds", msg.Payload)
+	}
+	select {
+	case <-drained:
+		t.Fatal("drain returned with a round in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	owner.send("submitGuess", map[string]interface{}{"lat": 50.0, "lon": 14.0, "score": 100.0})
+	owner.expect("roundEnd")
+	select {
+	case <-drained:
+	case <-time.After(2 * time.Second):
+		t.Fatal("drain still waiting after the round ended")
+	}
+
+	// The next round would have started after nextRoundDelay
+	owner.conn.SetReadDeadline(time.Now().Add(10 * nextRoundDelay))
+	for {
+		var msg WSMessage
+		if err := owner.conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		if msg.Type == "startNextRound" {
+			t.Fatalf("round %v started while draining", msg.Payload)
+		}
+	}
+
+	// The timeout left the connection unusable, so check the rest on a new one
+	other := dialWS(t, srv)
+	other.send("createSession", map[string]interface{}{
+		"nick": "Late", "icon": "😀", "settings": map[string]interface{}{},
+	})
+	other.expectError("Server is shutting down")
+
+	s.sessions.mutex.RLock()
+	defer s.sessions.mutex.RUnlock()
+	for _, session := range s.sessions.sessions {
+		if session.Round != 1 {
+			t.Errorf("session %s is at round %d, want 1", session.Code, session.Round)
+		}
+	}
+}
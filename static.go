@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== STATIC ASSETS ====================
+//
+// The frontend and boundaries/ are embedded in the binary, and only they are
+// served - never the working directory with settings.yaml and the tile cache.
+// Every asset has a content-hash ETag. index.html is rewritten at startup to
+// load scripts and styles as app.js?v=<hash>; those URLs are cached for a year,
+// everything else is revalidated with its ETag. server.static_dir serves the
+// same allowlisted files from a directory instead, read on every request, for
+// frontend development without rebuilding.
+
+//go:embed index.html styles.css app.js i18n.js multiplayer.js panorama-proxy.js challenge.js boundaries
+var embeddedAssets embed.FS
+
+// Cache lifetime of versioned asset URLs
+const immutableMaxAge = 365 * 24 * 60 * 60
+
+// Asset types worth compressing; images are compressed already
+var compressibleAssets = map[string]bool{
+	".html": true, ".js": true, ".css": true, ".json": true, ".svg": true,
+}
+
+// Script and stylesheet references in index.html that get a ?v= version
+var assetRefPattern = regexp.MustCompile(`((?:src|href)=")([^":?#]+\.(?:js|css))(")`)
+
+// staticAsset is one servable file
+type staticAsset struct {
+	name    string
+	data    []byte
+	etag    string // Quoted content hash
+	version string // Short content hash for ?v= URLs, empty when served from static_dir
+
+	gzipOnce sync.Once
+	gzipped  []byte // Compressed on first request, nil when not compressible
+}
+
+func newStaticAsset(name string, data []byte) *staticAsset {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	return &staticAsset{name: name, data: data, etag: `"` + hash[:32] + `"`, version: hash[:12]}
+}
+
+// compressed returns the gzipped body, or nil for types not worth compressing
+func (a *staticAsset) compressed() []byte {
+	if !compressibleAssets[path.Ext(a.name)] {
+		return nil
+	}
+	a.gzipOnce.Do(func() {
+		var buf bytes.Buffer
+		gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		gz.Write(a.data)
+		gz.Close()
+		a.gzipped = buf.Bytes()
+	})
+	return a.gzipped
+}
+
+// assetStore serves the allowlisted static files
+type assetStore struct {
+	dir    string                  // static_dir, empty for the embedded copies
+	fsys   fs.FS                   // Where the files are read from
+	assets map[string]*staticAsset // Embedded assets by name; the names are the allowlist
+}
+
+// newAssetStore prepares the embedded assets; dir serves them from disk
+// instead (checked by resolveServerConfig)
+func newAssetStore(dir string) *assetStore {
+	a := &assetStore{dir: dir, fsys: embeddedAssets, assets: make(map[string]*staticAsset)}
+	if dir != "" {
+		a.fsys = os.DirFS(dir)
+	}
+
+	fs.WalkDir(embeddedAssets, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := embeddedAssets.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		a.assets[name] = newStaticAsset(name, data)
+		return nil
+	})
+
+	// Versioned references change whenever a script or stylesheet does
+	if index, ok := a.assets["index.html"]; ok {
+		html := assetRefPattern.ReplaceAllFunc(index.data, func(ref []byte) []byte {
+			m := assetRefPattern.FindSubmatch(ref)
+			if asset, ok := a.assets[string(m[2])]; ok {
+				return []byte(string(m[1]) + asset.name + "?v=" + asset.version + string(m[3]))
+			}
+			return ref
+		})
+		a.assets["index.html"] = newStaticAsset("index.html", html)
+	}
+	return a
+}
+
+// boundaries returns the region polygons (see prewarm.go)
+func (a *assetStore) boundaries() fs.FS {
+	sub, _ := fs.Sub(a.fsys, "boundaries")
+	return sub
+}
+
+// lookup returns an allowlisted asset, read from static_dir when set
+func (a *assetStore) lookup(name string) (*staticAsset, bool) {
+	asset, ok := a.assets[name]
+	if !ok || a.dir == "" {
+		return asset, ok
+	}
+	data, err := fs.ReadFile(a.fsys, name)
+	if err != nil {
+		return nil, false
+	}
+	asset = newStaticAsset(name, data)
+	asset.version = "" // Never cached for long while developing
+	return asset, true
+}
+
+func (a *assetStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	asset, ok := a.lookup(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if asset.version != "" && r.URL.Query().Get("v") == asset.version {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(immutableMaxAge)+", immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	body, etag := asset.data, asset.etag
+	if gzipped := asset.compressed(); gzipped != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		// Byte ranges refer to the uncompressed file
+		if acceptsGzip(r) && r.Header.Get("Range") == "" {
+			body, etag = gzipped, strings.TrimSuffix(etag, `"`)+`-gzip"`
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(body))
+}
+
+// ==================== END STATIC ASSETS ====================
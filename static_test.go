@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Only the embedded allowlist is served, with or without static_dir
+func TestStaticServesOnlyAllowlistedFiles(t *testing.T) {
+	root := t.TempDir()
+	staticDir := filepath.Join(root, "static")
+	files := map[string]string{
+		"settings.yaml":                   "admin:\n  token: root-secret\n",
+		"static/index.html":               "<html>dev</html>",
+		"static/app.js":                   "// dev",
+		"static/settings.yaml":            "admin:\n  token: secret\n",
+		"static/go.mod":                   "module gde-game\n",
+		"static/notes.txt":                "not an asset",
+		"static/.tile_cache/index.lock":   "",
+		"static/.tile_cache/ab/abcd.data": "tile",
+	}
+	for name, content := range files {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	notFound := []string{
+		"/settings.yaml",
+		"/go.mod",
+		"/.tile_cache/index.lock",
+		"/.tile_cache/ab/abcd.data",
+		"/../settings.yaml",
+		"/%2e%2e/settings.yaml",
+		"/boundaries/../settings.yaml",
+		"/notes.txt",
+		"/server.go",
+	}
+	for _, mode := range []struct {
+		name string
+		dir  string
+	}{{"embedded", ""}, {"static_dir", staticDir}} {
+		t.Run(mode.name, func(t *testing.T) {
+			s := newTestServer(t, func(cfg *Config) { cfg.Server.StaticDir = mode.dir })
+			for _, target := range notFound {
+				rec := get(s, target, nil)
+				// The mux redirects unclean paths to their clean form first
+				if rec.Code == http.StatusMovedPermanently {
+					rec = get(s, rec.Header().Get("Location"), nil)
+				}
+				if rec.Code != http.StatusNotFound {
+					t.Errorf("%s: status = %d, want 404", target, rec.Code)
+				}
+			}
+
+			rec := get(s, "/", nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/: status = %d, want 200", rec.Code)
+			}
+			if fromDir := rec.Body.String() == files["static/index.html"]; fromDir != (mode.dir != "") {
+				t.Errorf("/ served %q", rec.Body.String())
+			}
+			if rec := get(s, "/app.js", nil); rec.Code != http.StatusOK {
+				t.Errorf("/app.js: status = %d, want 200", rec.Code)
+			}
+		})
+	}
+}
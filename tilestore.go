@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// ==================== TILE STORE ====================
+//
+// A TileStore persists cache entries - response data plus the metadata written
+// by formatCacheMeta - for the cache layer in server.go. The index, memory tier,
+// checksums and TTL handling sit on top of it and are the same for every store.
+//
+// Backends (cache.backend):
+//
+//	disk    data and .meta files under cache.dir (default)
+//	kv      one append-only file, see kvstore.go
+//	object  HTTP/S3-compatible object store shared by several replicas, see objectstore.go
+
+// Cache storage backends
+const (
+	CacheBackendDisk   = "disk"
+	CacheBackendKV     = "kv"
+	CacheBackendObject = "object"
+)
+
+var (
+	errTileNotFound   = errors.New("tile not found")
+	errTileIncomplete = errors.New("tile metadata missing")
+	errInvalidTileKey = errors.New("invalid cache key")
+)
+
+// Cache keys are hex MD5 hashes (see getCacheKey). Stores build file and object
+// paths from them, so they refuse anything else.
+var tileKeyPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// validTileKey reports whether key can name a cache entry
+func validTileKey(key string) bool {
+	return tileKeyPattern.MatchString(key)
+}
+
+// tileInfo describes a stored entry without its contents
+type tileInfo struct {
+	Size   int64     // Data plus metadata, as accounted in the index
+	Stored time.Time // Write time, or the last revalidation; the TTL counts from here
+}
+
+// tileEntry is a stored entry with its contents
+type tileEntry struct {
+	Data   []byte
+	Meta   []byte
+	Stored time.Time
+}
+
+// Size returns the bytes an entry occupies, as accounted in the index
+func (e *tileEntry) Size() int64 {
+	return int64(len(e.Data) + len(e.Meta))
+}
+
+// tileWriter streams a new entry into a store. Nothing is visible to readers
+// until Commit.
+type tileWriter interface {
+	io.Writer
+	Commit(meta []byte) error
+	Abort()
+}
+
+// TileStore is a cache storage backend. Get and Stat return errTileNotFound for
+// missing entries; Get returns errTileIncomplete when data exists without metadata.
+// Stores that derive paths from keys return errInvalidTileKey for keys that
+// aren't valid (see validTileKey).
+type TileStore interface {
+	Get(key string) (*tileEntry, error)
+	Put(key string, data, meta []byte) error
+	Create(key string) (tileWriter, error)
+	Delete(key string) error
+	Stat(key string) (tileInfo, error)
+	Touch(key string, stored time.Time) error // Restart the TTL of an unchanged entry
+	Iterate(fn func(key string, info tileInfo) error) error
+	Clear() error
+	Close() error
+	String() string // Description for logs
+}
+
+// tileStoreQuarantiner is implemented by stores that can keep corrupt entries
+// aside for inspection; other stores just delete them
+type tileStoreQuarantiner interface {
+	Quarantine(key string) error
+}
+
+// tileStoreRepairer is implemented by stores that can be left with partial
+// writes after a crash. Repair removes them and returns entries with missing parts.
+type tileStoreRepairer interface {
+	Repair() (removed int, orphans []string)
+}
+
+// tileStoreCompactor is implemented by stores that reclaim space in the background
+type tileStoreCompactor interface {
+	Compact() error
+}
+
+// openTileStore creates the storage backend selected in the cache config
+func openTileStore(cfg CacheConfig) (TileStore, error) {
+	switch cfg.Backend {
+	case "", CacheBackendDisk:
+		return newDiskStore(cfg.Dir)
+	case CacheBackendKV:
+		path := cfg.KV.Path
+		if path == "" {
+			path = filepath.Join(cfg.Dir, DefaultKVStoreFile)
+		}
+		return openKVStore(path)
+	case CacheBackendObject:
+		return newObjectStore(cfg.ObjectStore)
+	}
+	return nil, fmt.Errorf("unknown cache backend %q", cfg.Backend)
+}
+
+// bufferedTileWriter collects an entry in memory and stores it with Put on
+// Commit, for stores that can't stream a write
+type bufferedTileWriter struct {
+	store TileStore
+	key   string
+	buf   bytes.Buffer
+}
+
+func (w *bufferedTileWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *bufferedTileWriter) Commit(meta []byte) error {
+	return w.store.Put(w.key, w.buf.Bytes(), meta)
+}
+
+func (w *bufferedTileWriter) Abort() {
+	w.buf.Reset()
+}
+
+// ==================== END TILE STORE ====================
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== TLS ====================
+//
+// With server.tls.cert_file and key_file set the server speaks HTTPS on
+// server.port, and HTTP/2 with it (net/http negotiates h2 over TLS by itself;
+// plain HTTP stays HTTP/1.1). The certificate files are checked for changes
+// every minute, so certificates renewed in place (e.g. by certbot) are picked
+// up without a restart. server.tls.redirect_port adds a plain HTTP listener
+// that redirects everything to HTTPS. ACME isn't built in: it needs
+// golang.org/x/crypto, which this module doesn't depend on.
+
+const (
+	certCheckInterval = time.Minute
+
+	// Connection timeouts of every listener, against clients that open
+	// connections and never finish a request (WebSockets are hijacked and
+	// aren't affected; streamed bodies have their own, see clientWriter)
+	readHeaderTimeout = 10 * time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+// enabled reports whether HTTPS is configured
+func (cfg ServerTLSConfig) enabled() bool {
+	return cfg.CertFile != "" || cfg.KeyFile != ""
+}
+
+// httpListener is one HTTP server of a Server, with how to start it
+type httpListener struct {
+	srv *http.Server
+	tls bool
+}
+
+func (l httpListener) serve() error {
+	if l.tls {
+		return l.srv.ListenAndServeTLS("", "") // Certificates come from TLSConfig
+	}
+	return l.srv.ListenAndServe()
+}
+
+// httpListeners builds the HTTP servers for addr: the main one, over TLS when
+// configured, and the HTTPS redirect
+func (s *Server) httpListeners(addr string) ([]httpListener, error) {
+	s.mutex.RLock()
+	cfg := s.server
+	s.mutex.RUnlock()
+
+	primary := httpListener{srv: &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+	}}
+	if !cfg.TLS.enabled() {
+		return []httpListener{primary}, nil
+	}
+
+	certs, err := newCertLoader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	primary.tls = true
+	primary.srv.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}
+	logInfo("🔒 HTTPS with HTTP/2, certificate %s", cfg.TLS.CertFile)
+	listeners := []httpListener{primary}
+
+	if cfg.TLS.RedirectPort > 0 {
+		redirectAddr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.TLS.RedirectPort))
+		listeners = append(listeners, httpListener{srv: &http.Server{
+			Addr:              redirectAddr,
+			Handler:           redirectToHTTPS(cfg.Port),
+			ReadHeaderTimeout: readHeaderTimeout,
+			IdleTimeout:       idleTimeout,
+		}})
+		logInfo("↪️ Redirecting http://%s to HTTPS", redirectAddr)
+	}
+	return listeners, nil
+}
+
+// redirectToHTTPS redirects every request to the same URL on the HTTPS port
+func redirectToHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+
+		// 308 keeps the method and body of anything but GET and HEAD
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
+
+// certLoader serves a certificate and reloads it when its files change
+type certLoader struct {
+	certFile, keyFile string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // Newest file modification when loaded
+	checked time.Time // Last look at the files
+}
+
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("server.tls needs both cert_file and key_file")
+	}
+	l := &certLoader{certFile: certFile, keyFile: keyFile}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// filesModTime returns the newest modification time of the certificate files
+func (l *certLoader) filesModTime() (time.Time, error) {
+	var newest time.Time
+	for _, name := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// load reads the certificate files; the caller holds mutex or owns l
+func (l *certLoader) load() error {
+	modTime, err := l.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.cert = &cert
+	l.modTime = modTime
+	l.checked = time.Now()
+	return nil
+}
+
+func (l *certLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if time.Since(l.checked) >= certCheckInterval {
+		l.checked = time.Now()
+		if modTime, err := l.filesModTime(); err == nil && modTime.After(l.modTime) {
+			if err := l.load(); err != nil {
+				// Half-written renewals fail here; the next check retries
+				logWarn("🔒 Failed to reload TLS certificate, keeping the current one: %v", err)
+			} else {
+				logInfo("🔒 Reloaded TLS certificate %s", l.certFile)
+			}
+		}
+	}
+	return l.cert, nil
+}
+
+// ==================== END TLS ====================
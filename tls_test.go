@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		name   string
+		port   int
+		method string
+		host   string
+		target string
+		want   string
+		status int
+	}{
+		{"default port", 443, http.MethodGet, "game.example.com", "/", "https://game.example.com/", http.StatusMovedPermanently},
+		{"drops http port", 443, http.MethodGet, "game.example.com:80", "/", "https://game.example.com/", http.StatusMovedPermanently},
+		{"custom port", 8443, http.MethodGet, "game.example.com:8080", "/", "https://game.example.com:8443/", http.StatusMovedPermanently},
+		{"path and query", 443, http.MethodHead, "game.example.com", "/api/mapy/v1/suggest?query=praha&lang=cs", "https://game.example.com/api/mapy/v1/suggest?query=praha&lang=cs", http.StatusMovedPermanently},
+		{"escaped path", 443, http.MethodGet, "game.example.com", "/a%20b/%2F", "https://game.example.com/a%20b/%2F", http.StatusMovedPermanently},
+		{"ipv4", 8443, http.MethodGet, "192.0.2.1:8080", "/", "https://192.0.2.1:8443/", http.StatusMovedPermanently},
+		{"ipv6 default port", 443, http.MethodGet, "[2001:db8::1]:80", "/", "https://[2001:db8::1]/", http.StatusMovedPermanently},
+		{"ipv6 custom port", 8443, http.MethodGet, "[2001:db8::1]:8080", "/", "https://[2001:db8::1]:8443/", http.StatusMovedPermanently},
+		{"ipv6 without port", 8443, http.MethodGet, "[2001:db8::1]", "/", "https://[2001:db8::1]:8443/", http.StatusMovedPermanently},
+		{"post keeps method", 443, http.MethodPost, "game.example.com", "/api/admin/cache/clear", "https://game.example.com/api/admin/cache/clear", http.StatusPermanentRedirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://"+tt.host+tt.target, nil)
+			rec := httptest.NewRecorder()
+			redirectToHTTPS(tt.port).ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
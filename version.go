@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ==================== VERSION ====================
+//
+// The build version is set with ldflags (see Dockerfile):
+//
+//	go build -ldflags "-X main.buildVersion=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ) -X main.buildBranch=main"
+//
+// /api/version reports it to the frontend. ProtocolVersion guards the
+// multiplayer messages: the server sends it in a hello message when a
+// WebSocket connects, and the client's first message must be a hello with the
+// same version. A client loaded before an incompatible change gets a
+// protocolMismatch error asking for a reload instead of misread messages.
+
+// Build info, set with -ldflags "-X main.buildVersion=..."
+var (
+	buildVersion = "dev"
+	buildDate    = "local-development"
+	buildBranch  = "local"
+)
+
+// ProtocolVersion is the multiplayer message protocol. Bump it together with
+// PROTOCOL_VERSION in multiplayer.js whenever messages change incompatibly.
+const ProtocolVersion = 1
+
+// versionInfo describes the running build
+func versionInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"version":  buildVersion,
+		"date":     buildDate,
+		"branch":   buildBranch,
+		"protocol": ProtocolVersion,
+		"go":       runtime.Version(),
+	}
+}
+
+func (s *Server) versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(versionInfo())
+}
+
+// sendHello greets a new WebSocket connection with the server's versions
+func (reg *sessionRegistry) sendHello(conn *websocket.Conn) {
+	reg.countMessage("out", "hello")
+	conn.WriteJSON(WSMessage{
+		Type: "hello",
+		Payload: map[string]interface{}{
+			"protocol": ProtocolVersion,
+			"version":  buildVersion,
+		},
+	})
+}
+
+// checkHello checks a connection's first message: a hello with the server's
+// protocol version. On a mismatch the client is told to reload.
+func (reg *sessionRegistry) checkHello(conn *websocket.Conn, msg WSMessage) bool {
+	protocol := 0 // Clients from before the handshake don't send a hello
+	if msg.Type == "hello" {
+		if payload, ok := msg.Payload.(map[string]interface{}); ok {
+			if p, ok := payload["protocol"].(float64); ok {
+				protocol = int(p)
+			}
+		}
+	}
+	if protocol == ProtocolVersion {
+		return true
+	}
+
+	logWith("protocol", protocol, "server_protocol", ProtocolVersion).Info("🔌 Rejected WebSocket client")
+	reg.countMessage("out", "error")
+	conn.WriteJSON(WSMessage{
+		Type: "error",
+		Payload: map[string]interface{}{
+			"code":     "protocolMismatch",
+			"message":  "The game was updated - please reload the page.",
+			"protocol": ProtocolVersion,
+		},
+	})
+	closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "protocol mismatch")
+	conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+	return false
+}
+
+// ==================== END VERSION ====================